@@ -1,11 +1,15 @@
 package telehash
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 	"net"
 	"time"
 
 	"github.com/telehash/gogotelehash/e3x"
+	"github.com/telehash/gogotelehash/e3x/cipherset"
+	"github.com/telehash/gogotelehash/e3x/keyfile"
 	"github.com/telehash/gogotelehash/internal/hashname"
 	"github.com/telehash/gogotelehash/internal/lob"
 	"github.com/telehash/gogotelehash/transports"
@@ -16,10 +20,13 @@ import (
 
 type (
 	EndpointOption e3x.EndpointOption
+	ListenerOption e3x.ListenerOption
 	Endpoint       struct{ inner *e3x.Endpoint }
 	Exchange       struct{ inner *e3x.Exchange }
 	Listener       struct{ inner *e3x.Listener }
+	AcceptRequest  struct{ inner *e3x.AcceptRequest }
 	Channel        struct{ inner *e3x.Channel }
+	ChannelMux     struct{ inner *e3x.ChannelMux }
 	Hashname       hashname.H
 	Identity       struct{ inner *e3x.Identity }
 	Identifier     e3x.Identifier
@@ -30,6 +37,71 @@ func Transport(config transports.Config) EndpointOption {
 	return EndpointOption(e3x.Transport(config))
 }
 
+// KeyFile loads the keys of the endpoint from a (passphrase-encrypted) key file.
+func KeyFile(path string, passphrase keyfile.PassphraseFunc) EndpointOption {
+	return EndpointOption(e3x.KeyFile(path, passphrase))
+}
+
+// CipherSets restricts and orders the cipher sets used by the endpoint.
+func CipherSets(policy cipherset.Policy) EndpointOption {
+	return EndpointOption(e3x.CipherSets(policy))
+}
+
+// KeyAgent uses the keys held by the key agent listening on the unix socket at
+// path (see th-keyagent).
+func KeyAgent(path string) EndpointOption {
+	return EndpointOption(e3x.KeyAgent(path))
+}
+
+// AllowFile only accepts handshakes from the hashnames listed in the file at
+// path (one per line). The file is reloaded when it changes.
+func AllowFile(path string) EndpointOption {
+	return EndpointOption(e3x.AllowFile(path))
+}
+
+// DenyFile refuses handshakes from the hashnames listed in the file at path
+// (one per line). The file is reloaded when it changes.
+func DenyFile(path string) EndpointOption {
+	return EndpointOption(e3x.DenyFile(path))
+}
+
+// LimitHandshakes protects the endpoint against handshake floods with
+// per-source rate limits and stateless cookie challenges. Only this
+// implementation answers cookie challenges; other peers are rate limited
+// while the cookie threshold is exceeded.
+func LimitHandshakes(limits e3x.HandshakeLimits) EndpointOption {
+	return EndpointOption(e3x.LimitHandshakes(limits))
+}
+
+// Peers remembers remote peers in store so they can be dialed by hashname
+// after a restart.
+func Peers(store e3x.PeerStore) EndpointOption {
+	return EndpointOption(e3x.Peers(store))
+}
+
+// FilePeerStore returns a PeerStore which keeps peers in a JSON file at path.
+func FilePeerStore(path string) e3x.PeerStore {
+	return e3x.NewFilePeerStore(path)
+}
+
+// Timeouts configures the timers of all exchanges and channels of the endpoint.
+// Zero fields keep their defaults.
+func Timeouts(x e3x.ExchangeTimeouts, c e3x.ChannelTimeouts) EndpointOption {
+	return EndpointOption(e3x.Timeouts(x, c))
+}
+
+// PeerTimeouts configures the timers of the exchange (and its channels) with
+// the peer hn.
+func PeerTimeouts(hn Hashname, x e3x.ExchangeTimeouts, c e3x.ChannelTimeouts) EndpointOption {
+	return EndpointOption(e3x.PeerTimeouts(hashname.H(hn), x, c))
+}
+
+// WithBacklog sets the maximum number of channels which are waiting to be
+// accepted (default: 512). n <= 0 keeps the default.
+func WithBacklog(n int) ListenerOption {
+	return ListenerOption(e3x.WithBacklog(n))
+}
+
 func Open(options ...EndpointOption) (*Endpoint, error) {
 	innerOptions := make([]e3x.EndpointOption, len(options)+10)
 
@@ -52,8 +124,92 @@ func (e *Endpoint) Close() error {
 	return e.inner.Close()
 }
 
-func (e *Endpoint) Listen(typ string, reliable bool) *Listener {
-	return &Listener{e.inner.Listen(typ, reliable)}
+// Shutdown closes the endpoint after its reliable channels were flushed or
+// when ctx is done.
+func (e *Endpoint) Shutdown(ctx context.Context) error {
+	return e.inner.Shutdown(ctx)
+}
+
+// Stats returns a snapshot of the statistics of all exchanges.
+func (e *Endpoint) Stats() e3x.EndpointStats {
+	return e.inner.Stats()
+}
+
+func (e *Endpoint) Listen(typ string, reliable bool, options ...ListenerOption) *Listener {
+	innerOptions := make([]e3x.ListenerOption, len(options))
+	for i, option := range options {
+		innerOptions[i] = e3x.ListenerOption(option)
+	}
+
+	return &Listener{e.inner.Listen(typ, reliable, innerOptions...)}
+}
+
+// A Handler serves the channels opened by remote peers (see e3x.Handler).
+type Handler interface {
+	ServeChannel(c *Channel)
+}
+
+// The HandlerFunc type is an adapter to allow the use of ordinary functions as
+// channel handlers.
+type HandlerFunc func(c *Channel)
+
+// ServeChannel calls f(c).
+func (f HandlerFunc) ServeChannel(c *Channel) { f(c) }
+
+// Middleware wraps a Handler.
+type Middleware func(Handler) Handler
+
+func innerHandler(h Handler) e3x.Handler {
+	return e3x.HandlerFunc(func(c *e3x.Channel) {
+		h.ServeChannel(&Channel{c})
+	})
+}
+
+func innerMiddlewareFor(m Middleware) e3x.Middleware {
+	return func(next e3x.Handler) e3x.Handler {
+		return innerHandler(m(HandlerFunc(func(c *Channel) {
+			next.ServeChannel(c.inner)
+		})))
+	}
+}
+
+// ChannelMux returns the channel multiplexer of the endpoint. It serves the
+// incoming channels for which no Listener exists.
+func (e *Endpoint) ChannelMux() *ChannelMux {
+	return &ChannelMux{e.inner.ChannelMux()}
+}
+
+// Handle serves the incoming channels whose type matches pattern (see
+// e3x.ChannelMux) with handler.
+func (e *Endpoint) Handle(pattern string, handler Handler) {
+	e.ChannelMux().Handle(pattern, handler)
+}
+
+// HandleFunc serves the incoming channels whose type matches pattern (see
+// e3x.ChannelMux) with handler.
+func (e *Endpoint) HandleFunc(pattern string, handler func(c *Channel)) {
+	e.ChannelMux().HandleFunc(pattern, handler)
+}
+
+// Handle registers the handler for the given pattern.
+func (mux *ChannelMux) Handle(pattern string, handler Handler) {
+	mux.inner.Handle(pattern, innerHandler(handler))
+}
+
+// HandleFunc registers the handler function for the given pattern.
+func (mux *ChannelMux) HandleFunc(pattern string, handler func(c *Channel)) {
+	mux.Handle(pattern, HandlerFunc(handler))
+}
+
+// Use appends middleware to the chain which wraps all handlers of the mux.
+// The first middleware is the outermost.
+func (mux *ChannelMux) Use(middleware ...Middleware) {
+	innerMiddleware := make([]e3x.Middleware, len(middleware))
+	for i, m := range middleware {
+		innerMiddleware[i] = innerMiddlewareFor(m)
+	}
+
+	mux.inner.Use(innerMiddleware...)
 }
 
 func (e *Endpoint) LocalIdentity() (*Identity, error) {
@@ -74,8 +230,28 @@ func (e *Endpoint) Dial(identifier Identifier) (*Exchange, error) {
 	return &Exchange{inner}, nil
 }
 
-func (e *Endpoint) Open(identifier Identifier, typ string, reliable bool) (*Channel, error) {
-	inner, err := e.inner.Open(identifier, typ, reliable)
+// DialContext is like Dial but gives up when ctx is done.
+func (e *Endpoint) DialContext(ctx context.Context, identifier Identifier) (*Exchange, error) {
+	inner, err := e.inner.DialContext(ctx, e3x.Identifier(identifier))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Exchange{inner}, nil
+}
+
+func (e *Endpoint) Open(identifier Identifier, typ string, reliable bool, options ...e3x.ChannelOption) (*Channel, error) {
+	inner, err := e.inner.Open(identifier, typ, reliable, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Channel{inner}, nil
+}
+
+// OpenContext is like Open but gives up when ctx is done.
+func (e *Endpoint) OpenContext(ctx context.Context, identifier Identifier, typ string, reliable bool, options ...e3x.ChannelOption) (*Channel, error) {
+	inner, err := e.inner.OpenContext(ctx, identifier, typ, reliable, options...)
 	if err != nil {
 		return nil, err
 	}
@@ -87,8 +263,45 @@ func (x *Exchange) RemoteIdentity() *Identity {
 	return &Identity{x.inner.RemoteIdentity()}
 }
 
-func (x *Exchange) Open(typ string, reliable bool) (*Channel, error) {
-	inner, err := x.inner.Open(typ, reliable)
+// SetTimeouts changes the timers of the exchange and the defaults of its new
+// channels.
+func (x *Exchange) SetTimeouts(t e3x.ExchangeTimeouts, c e3x.ChannelTimeouts) error {
+	return x.inner.SetOptions(e3x.WithTimeouts(t, c))
+}
+
+// Stats returns a snapshot of the statistics of the exchange.
+func (x *Exchange) Stats() e3x.ExchangeStats {
+	return x.inner.Stats()
+}
+
+// Close closes the exchange and all its channels with reason.
+func (x *Exchange) Close(reason error) error {
+	return x.inner.Close(reason)
+}
+
+func (x *Exchange) Open(typ string, reliable bool, options ...e3x.ChannelOption) (*Channel, error) {
+	inner, err := x.inner.Open(typ, reliable, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Channel{inner}, nil
+}
+
+// OpenWithPayload opens a channel and writes body and headers in the packet
+// which opens the channel.
+func (x *Exchange) OpenWithPayload(typ string, reliable bool, body []byte, headers map[string]interface{}, options ...e3x.ChannelOption) (*Channel, error) {
+	inner, err := x.inner.OpenWithPayload(typ, reliable, body, headers, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Channel{inner}, nil
+}
+
+// OpenContext is like Open but gives up when ctx is done.
+func (x *Exchange) OpenContext(ctx context.Context, typ string, reliable bool, options ...e3x.ChannelOption) (*Channel, error) {
+	inner, err := x.inner.OpenContext(ctx, typ, reliable, options...)
 	if err != nil {
 		return nil, err
 	}
@@ -113,10 +326,81 @@ func (l *Listener) AcceptChannel() (*Channel, error) {
 	return &Channel{inner}, nil
 }
 
+// AcceptChannelContext is like AcceptChannel but gives up when ctx is done.
+func (l *Listener) AcceptChannelContext(ctx context.Context) (*Channel, error) {
+	inner, err := l.inner.AcceptChannelContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Channel{inner}, nil
+}
+
+// AcceptRequest waits for the next channel and returns it as a request which
+// can be inspected before it is accepted or rejected.
+func (l *Listener) AcceptRequest() (*AcceptRequest, error) {
+	inner, err := l.inner.AcceptRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	return &AcceptRequest{inner}, nil
+}
+
+// AcceptRequestContext is like AcceptRequest but gives up when ctx is done.
+func (l *Listener) AcceptRequestContext(ctx context.Context) (*AcceptRequest, error) {
+	inner, err := l.inner.AcceptRequestContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AcceptRequest{inner}, nil
+}
+
 func (l *Listener) Close() error {
 	return l.inner.Close()
 }
 
+// RemoteIdentity returns the identity of the peer which opened the channel.
+func (r *AcceptRequest) RemoteIdentity() *Identity {
+	return &Identity{r.inner.RemoteIdentity()}
+}
+
+// RemoteHashname returns the hashname of the peer which opened the channel.
+func (r *AcceptRequest) RemoteHashname() Hashname {
+	return Hashname(r.inner.RemoteHashname())
+}
+
+// Type returns the type of the requested channel.
+func (r *AcceptRequest) Type() string {
+	return r.inner.Type()
+}
+
+// Reliable returns true when the requested channel is reliable.
+func (r *AcceptRequest) Reliable() bool {
+	return r.inner.Reliable()
+}
+
+// Header returns the header of the initial packet. It must not be modified.
+func (r *AcceptRequest) Header() *lob.Header {
+	return r.inner.Header()
+}
+
+// Accept accepts the request and returns the channel.
+func (r *AcceptRequest) Accept() *Channel {
+	return &Channel{r.inner.Accept()}
+}
+
+// Reject refuses the request. The peer receives an `err` packet with reason.
+func (r *AcceptRequest) Reject(reason error) error {
+	return r.inner.Reject(reason)
+}
+
+// Type returns the type of the channel.
+func (c *Channel) Type() string {
+	return c.inner.Type()
+}
+
 func (c *Channel) LocalAddr() net.Addr {
 	return c.inner.LocalAddr()
 }
@@ -145,6 +429,16 @@ func (c *Channel) Read(b []byte) (int, error) {
 	return c.inner.Read(b)
 }
 
+// WriteMessage writes all data from r as one message (reliable channels only).
+func (c *Channel) WriteMessage(r io.Reader) error {
+	return c.inner.WriteMessage(r)
+}
+
+// ReadMessage reads the next message written with WriteMessage.
+func (c *Channel) ReadMessage() (io.Reader, error) {
+	return c.inner.ReadMessage()
+}
+
 func (c *Channel) SetDeadline(d time.Time) error {
 	return c.inner.SetDeadline(d)
 }
@@ -169,6 +463,26 @@ func (c *Channel) Close() error {
 	return c.inner.Close()
 }
 
+// CloseWrite closes the write direction of the channel.
+func (c *Channel) CloseWrite() error {
+	return c.inner.CloseWrite()
+}
+
+// CloseRead closes the read direction of the channel.
+func (c *Channel) CloseRead() error {
+	return c.inner.CloseRead()
+}
+
+func (h Hashname) String() string {
+	return string(h)
+}
+
+// Identify makes Hashname an Identifier which resolves to the identity known
+// by the endpoint (from an exchange or from its PeerStore).
+func (h Hashname) Identify(e *e3x.Endpoint) (*e3x.Identity, error) {
+	return e3x.HashnameIdentifier(hashname.H(h)).Identify(e)
+}
+
 func (i *Identity) Hashname() Hashname {
 	return Hashname(i.inner.Hashname())
 }
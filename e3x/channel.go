@@ -1,6 +1,7 @@
 package e3x
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -39,9 +40,9 @@ func (err *BrokenChannelError) Error() string {
 }
 
 const (
-	cReadBufferSize  = 100
-	cWriteBufferSize = 100
-	earlyAdHocAck    = 50
+	cReadBufferSize  = 100 // default receive window
+	cWriteBufferSize = 100 // default maximum congestion window
+	earlyAdHocAck    = 2
 	cBlankSeq        = uint32(0)
 	cInitialSeq      = uint32(1)
 )
@@ -61,7 +62,9 @@ type Channel struct {
 	typ          string
 	hashname     hashname.H
 	reliable     bool
+	pipelined    bool // writes don't wait for the response to the initial packet
 	broken       bool
+	err          error // reason the channel was closed by its exchange
 
 	oSeq         uint32 // highest seq in write stream
 	iBufferedSeq uint32 // highest buffered seq in read stream
@@ -69,20 +72,45 @@ type Channel struct {
 	iSeq         uint32 // highest seq in read stream
 	oAckedSeq    uint32 // highest acked seq in write stream
 	iAckedSeq    uint32 // highest acked seq in read stream
+	iAckedSeen   uint32 // highest seen seq when the last ack was delivered
+	iAckedWindow uint32 // highest acceptable seq advertised to the peer
+	oWindowSeq   uint32 // highest acceptable seq advertised by the peer
 
-	deliveredEnd bool
-	receivedEnd  bool
+	deliveredEnd bool // the write direction is closed (see CloseWrite)
+	receivedEnd  bool // the peer closed its write direction
 	readEnd      bool
-	needsResend  bool
+	readClosed   bool // received packets are discarded (see CloseRead)
+	ackScheduled bool
 
 	openDeadlineReached  bool
 	writeDeadlineReached bool
 	readDeadlineReached  bool
 	closeDeadlineReached bool
+	hasReadDeadline      bool // read deadline set with SetReadDeadline
+	hasWriteDeadline     bool // write deadline set with SetWriteDeadline
+
+	timeouts ChannelTimeouts
+
+	// congestion and flow control (see channel_congestion.go)
+	readWindow  int // receive window
+	writeWindow int // maximum congestion window
+	cwnd        float64
+	ssthresh    float64
+	recoverSeq  uint32 // losses up to this seq belong to the current recovery
+	srtt        time.Duration
+	rttvar      time.Duration
+	rto         time.Duration
 
 	readBuffer  readBufferSlice
 	writeBuffer map[uint32]*writeBufferEntry
 
+	// messages (see channel_message.go)
+	messageMtx    sync.Mutex
+	oMessageID    uint32
+	maxMessage    int64
+	iMessages     map[uint32]*incomingMessage
+	iMessageBytes int64 // buffered bytes of incomplete messages
+
 	tOpenDeadline  *time.Timer
 	tCloseDeadline *time.Timer
 	tReadDeadline  *time.Timer
@@ -108,6 +136,7 @@ type readBufferEntry struct {
 type writeBufferEntry struct {
 	pkt        *lob.Packet
 	end        bool
+	sentAt     time.Time
 	lastResend time.Time
 	dst        *Pipe
 }
@@ -117,7 +146,7 @@ func newChannel(
 	reliable bool, serverside bool,
 	x exchangeI,
 	options ...ChannelOption,
-) *Channel {
+) (*Channel, error) {
 	c := &Channel{
 		TID:          tracer.NewID(),
 		x:            x,
@@ -133,28 +162,39 @@ func newChannel(
 		iSeq:         cBlankSeq,
 		oAckedSeq:    cBlankSeq,
 		iAckedSeq:    cBlankSeq,
+		timeouts:     defaultChannelTimeouts,
+		readWindow:   cReadBufferSize,
+		writeWindow:  cWriteBufferSize,
+		maxMessage:   cMaxMessageSize,
 	}
 
 	c.cndRead = sync.NewCond(&c.mtx)
 	c.cndWrite = sync.NewCond(&c.mtx)
 	c.cndClose = sync.NewCond(&c.mtx)
 
+	err := c.setOptions(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.initCongestion()
 	c.setOpenDeadline()
 
-	c.tReadDeadline = time.AfterFunc(10*time.Second, c.onReadDeadlineReached)
-	c.tWriteDeadline = time.AfterFunc(10*time.Second, c.onWriteDeadlineReached)
+	c.tReadDeadline = time.AfterFunc(c.timeouts.OpenTimeout, c.onReadDeadlineReached)
+	c.tWriteDeadline = time.AfterFunc(c.timeouts.OpenTimeout, c.onWriteDeadlineReached)
 	c.tReadDeadline.Stop()
 	c.tWriteDeadline.Stop()
+	c.resetReadTimeout()
+	c.resetWriteTimeout()
 
 	if reliable {
-		c.tResend = time.AfterFunc(1*time.Second, c.resendLastPacket)
-		c.tAcker = time.AfterFunc(10*time.Second, c.autoDeliverAck)
+		c.tResend = time.AfterFunc(c.timeouts.ResendInterval, c.resendPacket)
+		c.tAcker = time.AfterFunc(c.timeouts.AckInterval, c.autoDeliverAck)
 	}
 
-	c.setOptions(options...)
 	c.traceNew()
 
-	return c
+	return c, nil
 }
 
 func (c *Channel) setOptions(options ...ChannelOption) error {
@@ -170,6 +210,10 @@ func registerExchange(x *Exchange) ChannelOption {
 	return func(c *Channel) error {
 		c.channelHooks = x.channelHooks
 		c.channelHooks.channel = c
+
+		x.mtx.Lock()
+		c.timeouts = x.channelTimeouts
+		x.mtx.Unlock()
 		return nil
 	}
 }
@@ -283,13 +327,19 @@ func (c *Channel) Exchange() *Exchange {
 	return nil
 }
 
-func (e *Endpoint) Open(i Identifier, typ string, reliable bool) (*Channel, error) {
-	x, err := e.Dial(i)
+func (e *Endpoint) Open(i Identifier, typ string, reliable bool, options ...ChannelOption) (*Channel, error) {
+	return e.OpenContext(context.Background(), i, typ, reliable, options...)
+}
+
+// OpenContext is like Open but gives up when ctx is done before the exchange
+// is open.
+func (e *Endpoint) OpenContext(ctx context.Context, i Identifier, typ string, reliable bool, options ...ChannelOption) (*Channel, error) {
+	x, err := e.DialContext(ctx, i)
 	if err != nil {
 		return nil, err
 	}
 
-	return x.Open(typ, reliable)
+	return x.OpenContext(ctx, typ, reliable, options...)
 }
 
 func (c *Channel) WritePacket(pkt *lob.Packet) error {
@@ -307,6 +357,9 @@ func (c *Channel) WritePacketTo(pkt *lob.Packet, p *Pipe) error {
 	}
 
 	err := c.write(pkt, p)
+	if err == nil {
+		c.resetWriteTimeout()
+	}
 
 	if !c.blockWrite() {
 		c.cndWrite.Signal()
@@ -331,15 +384,15 @@ func (c *Channel) blockWrite() bool {
 		return true
 	}
 
-	if !c.serverside && (c.iSeq == cBlankSeq && c.oAckedSeq == cBlankSeq) && c.oSeq >= cInitialSeq {
+	if !c.serverside && !c.pipelined && (c.iSeq == cBlankSeq && c.oAckedSeq == cBlankSeq) && c.oSeq >= cInitialSeq {
 		// When a client channel sent a packet but did not yet read a response
 		// to the initial packet then subsequent writes must be deferred.
 		return true
 	}
 
-	if len(c.writeBuffer) >= cWriteBufferSize {
-		// When a channel filled its write buffer then
-		// all writes must be deferred.
+	if c.reliable && c.sendWindowFull() {
+		// When a channel filled its congestion window or the receive window
+		// of the peer then all writes must be deferred.
 		return true
 	}
 
@@ -355,7 +408,7 @@ func (c *Channel) write(pkt *lob.Packet, p *Pipe) error {
 		// When a channel is marked as broken the all writes
 		// must return a BrokenChannelError.
 		return c.traceWriteError(pkt, p,
-			&BrokenChannelError{c.hashname, c.typ, c.id})
+			c.brokenError())
 	}
 
 	if c.writeDeadlineReached {
@@ -372,6 +425,21 @@ func (c *Channel) write(pkt *lob.Packet, p *Pipe) error {
 			io.EOF)
 	}
 
+	if orig := pkt; len(c.channelHooks.hooks) > 0 {
+		var err error
+		pkt, err = c.channelHooks.WritePacket(pkt)
+		if err != nil {
+			return c.traceWriteError(orig, p, err)
+		}
+		if pkt == nil {
+			// dropped by a hook
+			return nil
+		}
+		if pkt.TID == 0 {
+			pkt.TID = orig.TID
+		}
+	}
+
 	c.oSeq++
 	hdr := pkt.Header()
 	hdr.C, hdr.HasC = c.id, true
@@ -385,15 +453,19 @@ func (c *Channel) write(pkt *lob.Packet, p *Pipe) error {
 	end := hdr.HasEnd && hdr.End
 	if end {
 		c.deliveredEnd = true
-		c.setCloseDeadline()
+		if c.receivedEnd {
+			c.setCloseDeadline()
+		}
 	}
 
 	if c.reliable {
 		if c.oSeq%30 == 0 || hdr.End {
 			c.applyAckHeaders(pkt)
 		}
-		c.writeBuffer[c.oSeq] = &writeBufferEntry{pkt, end, time.Time{}, p}
-		c.needsResend = false
+		if len(c.writeBuffer) == 0 {
+			c.restartResendTimer()
+		}
+		c.writeBuffer[c.oSeq] = &writeBufferEntry{pkt, end, time.Now(), time.Time{}, p}
 	}
 
 	err := c.x.deliverPacket(pkt, p)
@@ -431,6 +503,7 @@ func (c *Channel) ReadPacket() (*lob.Packet, error) {
 	pkt, err := c.peekPacket()
 	if pkt != nil {
 		c.readPacket()
+		c.resetReadTimeout()
 	}
 
 	c.mtx.Unlock()
@@ -450,9 +523,10 @@ func (c *Channel) blockRead() bool {
 		return false
 	}
 
-	if c.readEnd {
+	if c.readEnd || c.readClosed {
 		// When a channel read a packet with the "end" header set
-		// then all subsequent reads must return io.EOF
+		// (or its read direction was closed) then all subsequent
+		// reads must return io.EOF
 		return false
 	}
 
@@ -478,11 +552,51 @@ func (c *Channel) blockRead() bool {
 	return false
 }
 
+// waitInitialPacket waits until the initial packet of a server channel was
+// received and returns a copy of its header (without the channel headers).
+func (c *Channel) waitInitialPacket(ctx context.Context) (lob.Header, error) {
+	stop := context.AfterFunc(ctx, func() {
+		c.mtx.Lock()
+		c.cndRead.Broadcast()
+		c.mtx.Unlock()
+	})
+	defer stop()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for !c.broken && ctx.Err() == nil &&
+		(len(c.readBuffer) == 0 || c.readBuffer[0].seq != c.iSeq+1) {
+		c.cndRead.Wait()
+	}
+
+	if c.broken {
+		return lob.Header{}, c.brokenError()
+	}
+	if err := ctx.Err(); err != nil {
+		return lob.Header{}, err
+	}
+
+	hdr := *c.readBuffer[0].pkt.Header()
+	cleanHeader(&hdr)
+	return hdr, nil
+}
+
+// cleanHeader removes the channel headers from hdr.
+func cleanHeader(h *lob.Header) {
+	h.HasAck = false
+	h.HasC = false
+	h.HasMiss = false
+	h.HasSeq = false
+	h.HasType = false
+	h.HasEnd = false
+}
+
 func (c *Channel) peekPacket() (*lob.Packet, error) {
 	if c.broken {
 		// When a channel is marked as broken the all reads
 		// must return a BrokenChannelError.
-		return nil, &BrokenChannelError{c.hashname, c.typ, c.id}
+		return nil, c.brokenError()
 	}
 
 	if c.readDeadlineReached {
@@ -491,23 +605,16 @@ func (c *Channel) peekPacket() (*lob.Packet, error) {
 		return nil, ErrTimeout
 	}
 
-	if c.readEnd {
+	if c.readEnd || c.readClosed {
 		// When a channel read a packet with the "end" header set
-		// then all subsequent reads must return io.EOF
+		// (or its read direction was closed) then all subsequent
+		// reads must return io.EOF
 		return nil, io.EOF
 	}
 
 	e := c.readBuffer[0]
 
-	{ // clean headers
-		h := e.pkt.Header()
-		h.HasAck = false
-		h.HasC = false
-		h.HasMiss = false
-		h.HasSeq = false
-		h.HasType = false
-		h.HasEnd = false
-	}
+	cleanHeader(e.pkt.Header())
 
 	if e.pkt.BodyLen() == 0 && e.pkt.Header().IsZero() && e.end {
 		// read empty `end` packet
@@ -556,14 +663,29 @@ func (c *Channel) receivedPacket(pkt *lob.Packet) {
 		errMissingSeq      = "missing seq"
 		errDuplicatePacket = "duplicate packet"
 		errFullBuffer      = "full buffer"
+		errDroppedByHook   = "dropped by hook"
 	)
 
+	if orig := pkt; len(c.channelHooks.hooks) > 0 {
+		pkt, _ = c.channelHooks.ReceivedPacket(pkt)
+		if pkt == nil {
+			c.traceDroppedPacket(orig, errDroppedByHook)
+			statChannelRcvPktDrop.Add(1)
+			c.counters().drop()
+			return
+		}
+		if pkt.TID == 0 {
+			pkt.TID = orig.TID
+		}
+	}
+
 	c.mtx.Lock()
 
 	if c.broken {
 		c.mtx.Unlock()
 		c.traceDroppedPacket(pkt, errBrokenChannel)
 		statChannelRcvPktDrop.Add(1)
+		c.counters().drop()
 		return
 	}
 
@@ -594,8 +716,13 @@ func (c *Channel) receivedPacket(pkt *lob.Packet) {
 				changed bool
 			)
 
+			if c.receivedAck(oldAck, ack, miss, time.Now()) {
+				changed = true
+			}
+
 			if c.oAckedSeq < ack {
 				c.oAckedSeq = ack
+				c.restartResendTimer()
 				changed = true
 			}
 
@@ -607,10 +734,6 @@ func (c *Channel) receivedPacket(pkt *lob.Packet) {
 				changed = true
 			}
 
-			if len(c.writeBuffer) == 0 {
-				c.needsResend = false
-			}
-
 			if changed {
 				c.cndWrite.Signal()
 				if c.deliveredEnd || c.receivedEnd {
@@ -631,6 +754,7 @@ func (c *Channel) receivedPacket(pkt *lob.Packet) {
 
 		if !hasAck {
 			statChannelRcvPktDrop.Add(1)
+			c.counters().drop()
 		}
 
 		return
@@ -643,38 +767,52 @@ func (c *Channel) receivedPacket(pkt *lob.Packet) {
 
 	if seq <= c.iSeq {
 		// drop: the reader already read a packet with this seq
+		c.scheduleAck() // the previous ack may have been lost
 		c.mtx.Unlock()
 		c.traceDroppedPacket(pkt, errDuplicatePacket)
 		statChannelRcvPktDrop.Add(1)
+		c.counters().drop()
 		return
 	}
 
-	if len(c.readBuffer) >= cReadBufferSize {
+	if len(c.readBuffer) >= c.readWindow || seq > c.windowSeq() {
 		// drop: the read buffer is full
 		c.mtx.Unlock()
 		c.traceDroppedPacket(pkt, errFullBuffer)
 		statChannelRcvPktDrop.Add(1)
+		c.counters().drop()
 		return
 	}
 
 	if c.readBuffer.IndexOf(seq) >= 0 {
 		// drop: a packet with this seq is already buffered
+		c.scheduleAck() // the previous ack may have been lost
 		c.mtx.Unlock()
 		c.traceDroppedPacket(pkt, errDuplicatePacket)
 		statChannelRcvPktDrop.Add(1)
+		c.counters().drop()
 		return
 	}
 
 	if c.iBufferedSeq < seq {
 		c.iBufferedSeq = seq
 	}
+	c.readBuffer = append(c.readBuffer, &readBufferEntry{pkt, seq, end})
+	sort.Sort(c.readBuffer)
+
 	if end && hasEnd {
 		c.receivedEnd = true
+		if c.deliveredEnd {
+			c.setCloseDeadline()
+		}
 		c.deliverAck()
+	} else {
+		c.maybeDeliverAdHocAck()
 	}
 
-	c.readBuffer = append(c.readBuffer, &readBufferEntry{pkt, seq, end})
-	sort.Sort(c.readBuffer)
+	if c.readClosed {
+		c.discardReadBuffer()
+	}
 
 	c.cndRead.Signal()
 	c.mtx.Unlock()
@@ -698,7 +836,7 @@ func (c *Channel) Error(err error) error {
 		// When a channel is marked as broken the all closes
 		// must return a BrokenChannelError.
 		c.mtx.Unlock()
-		return &BrokenChannelError{c.hashname, c.typ, c.id}
+		return c.brokenError()
 	}
 
 	for c.blockWrite() {
@@ -739,25 +877,14 @@ func (c *Channel) Close() error {
 		// When a channel is marked as broken the all closes
 		// must return a BrokenChannelError.
 		c.mtx.Unlock()
-		return &BrokenChannelError{c.hashname, c.typ, c.id}
+		return c.brokenError()
 	}
 
 	c.setCloseDeadline()
 
-	if !c.deliveredEnd {
-		for c.blockWrite() {
-			c.cndWrite.Wait()
-		}
-
-		if !c.deliveredEnd {
-			pkt := &lob.Packet{}
-			hdr := pkt.Header()
-			hdr.End, hdr.HasEnd = true, true
-			if err := c.write(pkt, nil); err != nil {
-				c.mtx.Unlock()
-				return err
-			}
-		}
+	if err := c.writeEnd(); err != nil {
+		c.mtx.Unlock()
+		return err
 	}
 
 	for {
@@ -785,7 +912,7 @@ func (c *Channel) Close() error {
 		// When a channel is marked as broken the all closes
 		// must return a BrokenChannelError.
 		c.mtx.Unlock()
-		return &BrokenChannelError{c.hashname, c.typ, c.id}
+		return c.brokenError()
 	}
 
 	c.unsetTimers()
@@ -800,6 +927,75 @@ func (c *Channel) Close() error {
 	return nil
 }
 
+// CloseWrite closes the write direction of the channel. The peer reads io.EOF
+// after it read all packets written before CloseWrite. The channel can still
+// be read until the peer closes its write direction. Most callers should call
+// Close after reading io.EOF.
+func (c *Channel) CloseWrite() error {
+	if c == nil {
+		return os.ErrInvalid
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.broken {
+		return c.brokenError()
+	}
+
+	return c.writeEnd()
+}
+
+// CloseRead closes the read direction of the channel. Buffered and subsequently
+// received packets are acknowledged and discarded and all reads return
+// io.EOF. The channel can still be written.
+func (c *Channel) CloseRead() error {
+	if c == nil {
+		return os.ErrInvalid
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.broken {
+		return c.brokenError()
+	}
+
+	c.readClosed = true
+	c.discardReadBuffer()
+	c.cndRead.Broadcast()
+	return nil
+}
+
+// writeEnd writes an `end` packet unless one was already written.
+func (c *Channel) writeEnd() error {
+	if c.deliveredEnd {
+		return nil
+	}
+
+	for c.blockWrite() {
+		c.cndWrite.Wait()
+	}
+
+	if c.deliveredEnd {
+		return nil
+	}
+
+	pkt := &lob.Packet{}
+	hdr := pkt.Header()
+	hdr.End, hdr.HasEnd = true, true
+	return c.write(pkt, nil)
+}
+
+// discardReadBuffer reads and frees all buffered packets which are in order.
+func (c *Channel) discardReadBuffer() {
+	for !c.readEnd && len(c.readBuffer) > 0 && c.readBuffer[0].seq == c.iSeq+1 {
+		pkt := c.readBuffer[0].pkt
+		c.readPacket()
+		pkt.Free()
+	}
+}
+
 func (c *Channel) blockClose() bool {
 	if c.broken {
 		return false
@@ -817,70 +1013,69 @@ func (c *Channel) blockClose() bool {
 }
 
 func (c *Channel) buildMissList() []uint32 {
-	// c.iSeq last read packet
-	// c.iSeq+1 is the next packet to be read
+	// ack is the highest seq up to which all packets were received
+	// ack+1 is the first missing packet
 	// c.iSeenSeq is the highest seq sean.
-	// c.iSeq + cReadBufferSize must be the last seq in the miss list
+	// c.windowSeq() must be the last seq in the miss list
 
 	var (
-		miss []uint32
-		last = c.iSeq
-		n    int
-		seq  uint32 = c.iSeq + 1
+		miss   []uint32
+		ack    = c.ackSeq()
+		window = c.windowSeq()
+		last   = ack
+		n      int
+		seq    = ack + 1
 	)
 
 	for _, e := range c.readBuffer {
-		if seq == e.seq {
-			seq++
+		if e.seq < seq {
 			continue
 		}
 
-		for seq < e.seq {
+		for seq < e.seq && seq <= window {
+			if n >= c.readWindow-1 {
+				goto ADD_HIGHEST_ACCEPTABLE_SEQ
+			}
 			if miss == nil {
-				miss = make([]uint32, 0, cReadBufferSize)
+				miss = make([]uint32, 0, 8)
 			}
 			miss = append(miss, seq-last)
 			last = seq
 			seq++
-
 			n++
-			if n >= cReadBufferSize-1 {
-				goto ADD_HIGHEST_ACCEPTABLE_SEQ
-			}
 		}
+
+		seq = e.seq + 1
 	}
 
-	for seq <= c.iSeenSeq {
-		if miss == nil {
-			miss = make([]uint32, 0, cReadBufferSize)
+	for seq <= c.iSeenSeq && seq <= window {
+		if n >= c.readWindow-1 {
+			goto ADD_HIGHEST_ACCEPTABLE_SEQ
 		}
 		miss = append(miss, seq-last)
 		last = seq
 		seq++
-
 		n++
-		if n >= cReadBufferSize-1 {
-			goto ADD_HIGHEST_ACCEPTABLE_SEQ
-		}
 	}
 
 ADD_HIGHEST_ACCEPTABLE_SEQ:
-	if n > 0 {
-		miss = append(miss, c.iSeq+cReadBufferSize-last)
-	}
+	miss = append(miss, window-last)
 
 	return miss
 }
 
 func (c *Channel) processMissingPackets(ack uint32, miss []uint32) {
+	if len(miss) < 2 {
+		return // nothing is missing (the last entry is the window)
+	}
+
 	var (
-		omiss     = c.buildMissList()
 		now       = time.Now()
-		oneSecAgo = now.Add(-1 * time.Second)
+		resendAge = now.Add(-c.rto)
 		last      = ack
 	)
 
-	for _, delta := range miss {
+	for _, delta := range miss[:len(miss)-1] {
 		seq := last + delta
 		last = seq
 
@@ -889,58 +1084,45 @@ func (c *Channel) processMissingPackets(ack uint32, miss []uint32) {
 			continue
 		}
 
-		if e.lastResend.After(oneSecAgo) {
+		if e.lastResend.After(resendAge) {
 			continue
 		}
 
-		hdr := e.pkt.Header()
-		if c.iSeq >= cInitialSeq {
-			hdr.Ack, hdr.HasAck = c.iSeq, true
-		}
-		if len(omiss) > 0 {
-			hdr.Miss, hdr.HasMiss = omiss, true
-		}
+		c.lostPacket(seq)
+
+		c.applyAckHeaders(e.pkt)
 		e.lastResend = now
 
 		err := c.x.deliverPacket(e.pkt, e.dst)
 		if err == nil {
 			statChannelSndPkt.Add(1)
+			c.counters().retransmit()
 		}
 	}
 }
 
-func (c *Channel) resendLastPacket() {
+// resendPacket resends the oldest unacknowledged packet when nothing was
+// acked during the last retransmission timeout.
+func (c *Channel) resendPacket() {
 	c.mtx.Lock()
 
-	var needsResend bool
-	needsResend, c.needsResend = c.needsResend, true
-	c.tResend.Reset(1 * time.Second)
-
-	if !needsResend {
-		c.mtx.Unlock()
-		return
-	}
-
-	e := c.writeBuffer[c.oSeq]
+	e := c.writeBuffer[c.oAckedSeq+1]
 	if e == nil {
 		c.mtx.Unlock()
 		return
 	}
 
-	omiss := c.buildMissList()
-	hdr := e.pkt.Header()
-	if c.iSeq >= cInitialSeq {
-		hdr.Ack, hdr.HasAck = c.iSeq, true
-	}
-	if len(omiss) > 0 {
-		hdr.Miss, hdr.HasMiss = omiss, true
-	}
+	c.retransmitTimeout()
+	c.restartResendTimer()
+
+	c.applyAckHeaders(e.pkt)
 	e.lastResend = time.Now()
 	c.mtx.Unlock()
 
 	err := c.x.deliverPacket(e.pkt, e.dst)
 	if err == nil {
 		statChannelSndPkt.Add(1)
+		c.counters().retransmit()
 	}
 }
 
@@ -949,12 +1131,30 @@ func (c *Channel) maybeDeliverAdHocAck() {
 		return
 	}
 
-	if c.iSeq < cInitialSeq {
+	ack := c.ackSeq()
+	if ack < cInitialSeq {
 		return // nothing to ack
 	}
 
-	if c.iSeq-c.iAckedSeq >= earlyAdHocAck {
+	var (
+		pendingAck    = ack - c.iAckedSeq
+		pendingWindow = c.windowSeq() - c.iAckedWindow
+		pendingMiss   = c.iSeenSeq > ack && c.iSeenSeq > c.iAckedSeen
+	)
+
+	if pendingAck >= earlyAdHocAck || pendingWindow >= uint32(c.readWindow/2) {
+		c.deliverAck()
+		return
+	}
+
+	if pendingMiss && c.iAckedSeen <= c.iAckedSeq {
+		// report the first missing packet right away
 		c.deliverAck()
+		return
+	}
+
+	if pendingAck > 0 || pendingWindow > 0 || pendingMiss {
+		c.scheduleAck()
 	}
 }
 
@@ -962,8 +1162,9 @@ func (c *Channel) autoDeliverAck() {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
+	c.ackScheduled = false
 	c.deliverAck()
-	c.tAcker.Reset(10 * time.Second)
+	c.tAcker.Reset(c.timeouts.AckInterval)
 }
 
 func (c *Channel) deliverAck() {
@@ -986,20 +1187,19 @@ func (c *Channel) applyAckHeaders(pkt *lob.Packet) {
 		return
 	}
 
-	if c.iSeq == cBlankSeq {
+	ack := c.ackSeq()
+	if ack == cBlankSeq {
 		// nothin to ack
 		return
 	}
 
 	hdr := pkt.Header()
-	if c.iSeq >= cInitialSeq {
-		hdr.Ack, hdr.HasAck = c.iSeq, true
-	}
-	if l := c.buildMissList(); len(l) > 0 {
-		hdr.Miss, hdr.HasMiss = l, true
-	}
+	hdr.Ack, hdr.HasAck = ack, true
+	hdr.Miss, hdr.HasMiss = c.buildMissList(), true
 
-	c.iAckedSeq = c.iSeq
+	c.iAckedSeq = ack
+	c.iAckedSeen = c.iSeenSeq
+	c.iAckedWindow = c.windowSeq()
 }
 
 func (c *Channel) setCloseDeadline() {
@@ -1009,7 +1209,7 @@ func (c *Channel) setCloseDeadline() {
 		}
 
 		c.tCloseDeadline = time.AfterFunc(
-			60*time.Second,
+			c.timeouts.CloseTimeout,
 			c.onCloseDeadlineReached,
 		)
 	}
@@ -1046,7 +1246,7 @@ func (c *Channel) setOpenDeadline() {
 		}
 
 		c.tOpenDeadline = time.AfterFunc(
-			60*time.Second,
+			c.timeouts.OpenTimeout,
 			c.onOpenDeadlineReached,
 		)
 	}
@@ -1119,6 +1319,47 @@ func (c *Channel) onOpenDeadlineReached() {
 	c.channelHooks.Closed()
 }
 
+// closeWithError breaks the channel. All subsequent reads, writes and closes
+// return err.
+func (c *Channel) closeWithError(err error) {
+	c.mtx.Lock()
+
+	if c.broken {
+		c.mtx.Unlock()
+		return
+	}
+
+	c.broken = true
+	c.err = err
+	c.unsetTimers()
+
+	// broadcast
+	c.cndWrite.Broadcast()
+	c.cndRead.Broadcast()
+	c.cndClose.Broadcast()
+
+	c.mtx.Unlock()
+
+	c.channelHooks.Closed()
+}
+
+// brokenError returns the error for operations on a broken channel.
+func (c *Channel) brokenError() error {
+	if c.err != nil {
+		return c.err
+	}
+	return &BrokenChannelError{c.hashname, c.typ, c.id}
+}
+
+// discard stops the timers of a channel which was never registered with its
+// exchange.
+func (c *Channel) discard() {
+	c.mtx.Lock()
+	c.broken = true
+	c.unsetTimers()
+	c.mtx.Unlock()
+}
+
 func (c *Channel) Kill() {
 	c.mtx.Lock()
 
@@ -1177,11 +1418,16 @@ func (c *Channel) SetDeadline(d time.Time) error {
 
 	now := time.Now()
 
+	c.hasReadDeadline = !d.IsZero()
+	c.hasWriteDeadline = !d.IsZero()
+
 	if d.IsZero() {
 		c.tReadDeadline.Stop()
 		c.readDeadlineReached = false
 		c.tWriteDeadline.Stop()
 		c.writeDeadlineReached = false
+		c.resetReadTimeout()
+		c.resetWriteTimeout()
 	} else if d.Before(now) {
 		c.tReadDeadline.Stop()
 		c.readDeadlineReached = true
@@ -1208,9 +1454,12 @@ func (c *Channel) SetReadDeadline(d time.Time) error {
 
 	now := time.Now()
 
+	c.hasReadDeadline = !d.IsZero()
+
 	if d.IsZero() {
 		c.tReadDeadline.Stop()
 		c.readDeadlineReached = false
+		c.resetReadTimeout()
 	} else if d.Before(now) {
 		c.tReadDeadline.Stop()
 		c.readDeadlineReached = true
@@ -1232,9 +1481,12 @@ func (c *Channel) SetWriteDeadline(d time.Time) error {
 
 	now := time.Now()
 
+	c.hasWriteDeadline = !d.IsZero()
+
 	if d.IsZero() {
 		c.tWriteDeadline.Stop()
 		c.writeDeadlineReached = false
+		c.resetWriteTimeout()
 	} else if d.Before(now) {
 		c.tWriteDeadline.Stop()
 		c.writeDeadlineReached = true
@@ -1250,6 +1502,20 @@ func (c *Channel) SetWriteDeadline(d time.Time) error {
 	return nil
 }
 
+// resetReadTimeout restarts the ReadTimeout unless a read deadline is set.
+func (c *Channel) resetReadTimeout() {
+	if c.timeouts.ReadTimeout > 0 && !c.hasReadDeadline && !c.readDeadlineReached {
+		c.tReadDeadline.Reset(c.timeouts.ReadTimeout)
+	}
+}
+
+// resetWriteTimeout restarts the WriteTimeout unless a write deadline is set.
+func (c *Channel) resetWriteTimeout() {
+	if c.timeouts.WriteTimeout > 0 && !c.hasWriteDeadline && !c.writeDeadlineReached {
+		c.tWriteDeadline.Reset(c.timeouts.WriteTimeout)
+	}
+}
+
 func (c *Channel) onReadDeadlineReached() {
 	c.mtx.Lock()
 
@@ -1291,7 +1557,7 @@ func (s readBufferSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s readBufferSlice) IndexOf(seq uint32) int {
 	l := len(s)
 	idx := sort.Search(l, func(i int) bool { return s[i].seq >= seq })
-	if idx == l {
+	if idx == l || s[idx].seq != seq {
 		return -1
 	}
 	return idx
@@ -0,0 +1,235 @@
+package e3x
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Congestion and flow control
+//
+// Reliable channels estimate the round trip time from the acks of packets
+// which were sent only once (Karn's algorithm) and derive the retransmission
+// timeout from it (RFC 6298). The retransmission timeout doubles every time
+// it expires.
+//
+// The number of unacknowledged packets is limited by a congestion window
+// (AIMD). The window grows by one packet per acked packet during slow start
+// and by one packet per window afterwards. It is halved (once per window)
+// when the peer reports missing packets and collapses when the retransmission
+// timer expires.
+//
+// Packets are acked when they are received. The last entry of the miss list
+// is the highest seq the receiver accepts (its window). The window follows the
+// reader, so a slow reader applies backpressure to the writer. Peers which do
+// not advertise a window are assumed to accept cReadBufferSize packets past
+// their ack.
+
+// ErrInvalidWindow is returned when a window option is out of range.
+var ErrInvalidWindow = errors.New("e3x: invalid window")
+
+const (
+	cInitialWindow = 10
+	cMinWindow     = 2
+	cMaxWindow     = 4096
+	cMinRTO        = 200 * time.Millisecond
+	cMaxRTO        = 10 * time.Second
+	cAckDelay      = 10 * time.Millisecond
+)
+
+// WithWindow configures the windows of a reliable channel. recv is the number
+// of received packets buffered for the reader (default: 100) and send is the
+// maximum number of unacknowledged written packets (default: 100). Zero keeps
+// the default.
+func WithWindow(recv, send int) ChannelOption {
+	return func(c *Channel) error {
+		for _, n := range []int{recv, send} {
+			if n != 0 && (n < cMinWindow || n > cMaxWindow) {
+				return ErrInvalidWindow
+			}
+		}
+
+		if recv > 0 {
+			c.readWindow = recv
+		}
+		if send > 0 {
+			c.writeWindow = send
+		}
+		return nil
+	}
+}
+
+func (c *Channel) initCongestion() {
+	c.cwnd = math.Min(cInitialWindow, float64(c.writeWindow))
+	c.ssthresh = float64(c.writeWindow)
+	c.oWindowSeq = cReadBufferSize
+	c.setRTO(c.timeouts.ResendInterval)
+}
+
+// sendWindowFull returns true when a reliable channel must wait for acks
+// before it writes another packet.
+func (c *Channel) sendWindowFull() bool {
+	inflight := len(c.writeBuffer)
+
+	if inflight >= c.writeWindow || float64(inflight) >= c.cwnd {
+		// the congestion window is full
+		return true
+	}
+
+	if c.oSeq+1 > c.oWindowSeq {
+		// the receive window of the peer is full
+		return true
+	}
+
+	return false
+}
+
+// receivedAck updates the RTT estimate, the congestion window and the window
+// of the peer. It must be called before the acked packets are removed from the
+// write buffer. It returns true when the window of the peer moved.
+func (c *Channel) receivedAck(oldAck, ack uint32, miss []uint32, now time.Time) bool {
+	window := ack + cReadBufferSize
+	if len(miss) > 0 {
+		window = ack
+		for _, delta := range miss {
+			window += delta
+		}
+	}
+	moved := window > c.oWindowSeq
+	if moved {
+		c.oWindowSeq = window
+	}
+
+	if ack <= oldAck {
+		return moved
+	}
+
+	// Karn's algorithm: when a packet in the acked range was resent the ack
+	// may have been delayed by the loss, so no RTT sample is taken.
+	sample := true
+
+	for seq := oldAck + 1; seq <= ack; seq++ {
+		e := c.writeBuffer[seq]
+		if e == nil {
+			continue
+		}
+		if !e.lastResend.IsZero() {
+			sample = false
+		}
+
+		if c.cwnd < c.ssthresh {
+			c.cwnd++ // slow start
+		} else {
+			c.cwnd += 1 / c.cwnd // congestion avoidance
+		}
+	}
+
+	if max := float64(c.writeWindow); c.cwnd > max {
+		c.cwnd = max
+	}
+
+	if e := c.writeBuffer[ack]; sample && e != nil {
+		c.updateRTT(now.Sub(e.sentAt))
+	}
+
+	return moved
+}
+
+func (c *Channel) updateRTT(sample time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = sample
+		c.rttvar = sample / 2
+	} else {
+		delta := c.srtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + sample) / 8
+	}
+
+	// the peer may delay its acks by cAckDelay
+	variance := 4 * c.rttvar
+	if variance < cAckDelay {
+		variance = cAckDelay
+	}
+
+	c.setRTO(c.srtt + variance)
+}
+
+func (c *Channel) setRTO(rto time.Duration) {
+	min := cMinRTO
+	if c.timeouts.ResendInterval < min {
+		min = c.timeouts.ResendInterval
+	}
+
+	if rto < min {
+		rto = min
+	}
+	if rto > cMaxRTO {
+		rto = cMaxRTO
+	}
+
+	c.rto = rto
+}
+
+// restartResendTimer restarts the retransmission timer. It is restarted when
+// the first packet is written and whenever the peer acks new packets.
+func (c *Channel) restartResendTimer() {
+	if c.tResend != nil && !c.broken {
+		c.tResend.Reset(c.rto)
+	}
+}
+
+// lostPacket is called when the peer reports seq as missing.
+func (c *Channel) lostPacket(seq uint32) {
+	if seq <= c.recoverSeq {
+		// already reacted to the losses of this window
+		return
+	}
+
+	c.ssthresh = math.Max(c.cwnd/2, cMinWindow)
+	c.cwnd = c.ssthresh
+	c.recoverSeq = c.oSeq
+}
+
+// retransmitTimeout is called when the retransmission timer expires.
+func (c *Channel) retransmitTimeout() {
+	c.ssthresh = math.Max(float64(len(c.writeBuffer))/2, cMinWindow)
+	c.cwnd = cMinWindow
+	c.recoverSeq = c.oSeq
+	c.setRTO(2 * c.rto)
+}
+
+// ackSeq returns the highest seq up to which all packets were received.
+func (c *Channel) ackSeq() uint32 {
+	seq := c.iSeq
+	for _, e := range c.readBuffer {
+		if e.seq != seq+1 {
+			break
+		}
+		seq = e.seq
+	}
+	return seq
+}
+
+// windowSeq returns the highest seq the channel accepts.
+func (c *Channel) windowSeq() uint32 {
+	return c.iSeq + uint32(c.readWindow)
+}
+
+// scheduleAck delivers an ack after a short delay (unless one is already
+// scheduled).
+func (c *Channel) scheduleAck() {
+	if c.broken || c.ackScheduled || c.tAcker == nil {
+		return
+	}
+
+	d := cAckDelay
+	if c.timeouts.AckInterval < d {
+		d = c.timeouts.AckInterval
+	}
+
+	c.ackScheduled = true
+	c.tAcker.Reset(d)
+}
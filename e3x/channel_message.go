@@ -0,0 +1,225 @@
+package e3x
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/telehash/gogotelehash/internal/lob"
+)
+
+// Messages
+//
+// WriteMessage splits a message into fragments which are written as packets
+// to a reliable channel. Each fragment carries the id of the message ("msg"),
+// the offset of its body in the message ("off") and the last fragment is
+// marked as final ("fin"). Fragments of concurrently written messages may be
+// interleaved; ReadMessage reassembles them by message id.
+//
+// A server channel can not read more than the initial packet before it wrote a
+// packet. ReadMessage writes an empty packet when it needs more fragments of a
+// message before the channel responded. Empty packets are skipped by
+// ReadMessage.
+
+var (
+	// ErrUnreliableMessage is returned when messages are used on an unreliable
+	// channel.
+	ErrUnreliableMessage = errors.New("e3x: messages require a reliable channel")
+
+	// ErrMessageTooLarge is returned by ReadMessage when a message (or all
+	// partially received messages together) exceeds the message limit.
+	ErrMessageTooLarge = errors.New("e3x: message too large")
+
+	// ErrInvalidMessage is returned by ReadMessage when a packet is not a
+	// valid message fragment.
+	ErrInvalidMessage = errors.New("e3x: invalid message fragment")
+)
+
+const (
+	cMessageFragmentSize = 1024
+	cMaxMessageSize      = 64 << 20
+)
+
+type incomingMessage struct {
+	buf     bytes.Buffer
+	discard bool // the message was dropped
+}
+
+// WithMessageLimit limits the size of the messages read with ReadMessage
+// (default: 64MiB). The limit also applies to all partially received messages
+// together.
+func WithMessageLimit(n int64) ChannelOption {
+	return func(c *Channel) error {
+		if n <= 0 {
+			return os.ErrInvalid
+		}
+		c.maxMessage = n
+		return nil
+	}
+}
+
+// WriteMessage writes all data from r as one message. The message is split in
+// fragments which are reassembled by ReadMessage on the other end.
+func (c *Channel) WriteMessage(r io.Reader) error {
+	if c == nil {
+		return os.ErrInvalid
+	}
+	if !c.reliable {
+		return ErrUnreliableMessage
+	}
+
+	var (
+		id     = atomic.AddUint32(&c.oMessageID, 1)
+		buf    = make([]byte, cMessageFragmentSize)
+		offset int
+	)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		fin := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !fin {
+			return err
+		}
+
+		pkt := lob.New(buf[:n])
+		hdr := pkt.Header()
+		hdr.SetUint32("msg", id)
+		hdr.SetInt("off", offset)
+		if fin {
+			hdr.SetBool("fin", true)
+		}
+
+		err = c.WritePacket(pkt)
+		if err != nil {
+			return err
+		}
+
+		if fin {
+			return nil
+		}
+		offset += n
+	}
+}
+
+// ReadMessage reads the next complete message. Empty packets are skipped, other
+// packets which are not message fragments are dropped and ErrInvalidMessage is
+// returned. When the channel
+// ends while messages are incomplete io.ErrUnexpectedEOF is returned.
+func (c *Channel) ReadMessage() (io.Reader, error) {
+	if c == nil {
+		return nil, os.ErrInvalid
+	}
+	if !c.reliable {
+		return nil, ErrUnreliableMessage
+	}
+
+	c.messageMtx.Lock()
+	defer c.messageMtx.Unlock()
+
+	for {
+		pkt, err := c.ReadPacket()
+		if err == io.EOF && len(c.iMessages) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		msg, err := c.receivedFragment(pkt)
+		pkt.Free()
+		if err != nil || msg != nil {
+			return msg, err
+		}
+
+		err = c.respondToOpen()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// respondToOpen writes an empty packet when a server channel did not yet
+// respond to the initial packet (otherwise all subsequent reads are deferred).
+func (c *Channel) respondToOpen() error {
+	c.mtx.Lock()
+	respond := c.serverside && c.oSeq == cBlankSeq
+	c.mtx.Unlock()
+
+	if !respond {
+		return nil
+	}
+
+	return c.WritePacket(lob.New(nil))
+}
+
+// receivedFragment adds the fragment in pkt to its message. It returns the
+// message when it is complete.
+func (c *Channel) receivedFragment(pkt *lob.Packet) (io.Reader, error) {
+	var (
+		hdr               = pkt.Header()
+		id, hasID         = hdr.GetUint32("msg")
+		offset, hasOffset = hdr.GetInt("off")
+		fin, _            = hdr.GetBool("fin")
+	)
+
+	if !hasID && len(hdr.Extra) == 0 && pkt.BodyLen() == 0 {
+		// skip empty packets
+		return nil, nil
+	}
+
+	if !hasID || !hasOffset {
+		return nil, ErrInvalidMessage
+	}
+
+	if c.iMessages == nil {
+		c.iMessages = make(map[uint32]*incomingMessage)
+	}
+
+	msg := c.iMessages[id]
+	if msg == nil {
+		msg = &incomingMessage{}
+		c.iMessages[id] = msg
+	}
+
+	if fin {
+		delete(c.iMessages, id)
+	}
+
+	if msg.discard {
+		// the error was already reported
+		return nil, nil
+	}
+
+	if offset != msg.buf.Len() {
+		// fragments are delivered in order; a gap means a broken peer
+		c.discardMessage(msg)
+		return nil, ErrInvalidMessage
+	}
+
+	n := int64(pkt.BodyLen())
+	if int64(msg.buf.Len())+n > c.maxMessage || c.iMessageBytes+n > c.maxMessage {
+		c.discardMessage(msg)
+		return nil, ErrMessageTooLarge
+	}
+
+	if n > 0 {
+		msg.buf.Write(pkt.Body(nil))
+	}
+	if !fin {
+		c.iMessageBytes += n
+		return nil, nil
+	}
+
+	c.iMessageBytes -= int64(msg.buf.Len()) - n
+	return bytes.NewReader(msg.buf.Bytes()), nil
+}
+
+// discardMessage drops the buffered fragments of a message. The remaining
+// fragments of the message are ignored.
+func (c *Channel) discardMessage(msg *incomingMessage) {
+	c.iMessageBytes -= int64(msg.buf.Len())
+	msg.discard = true
+	msg.buf = bytes.Buffer{}
+}
@@ -0,0 +1,214 @@
+package e3x
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Handler serves the channels opened by remote peers.
+//
+// ServeChannel is called in its own goroutine and owns the channel; it should
+// close the channel when it is done.
+type Handler interface {
+	ServeChannel(c *Channel)
+}
+
+// The HandlerFunc type is an adapter to allow the use of ordinary functions as
+// channel handlers.
+type HandlerFunc func(c *Channel)
+
+// ServeChannel calls f(c).
+func (f HandlerFunc) ServeChannel(c *Channel) { f(c) }
+
+// Middleware wraps a Handler.
+type Middleware func(Handler) Handler
+
+// ChannelMux is a channel multiplexer. It matches the type of each incoming
+// channel against a list of registered patterns and calls the handler of the
+// pattern that most closely matches the type.
+//
+// Patterns are matched in this order:
+//
+//	"ping"      exactly the type "ping"
+//	"_thtp.*"   any type with the prefix "_thtp." (longest prefix first)
+//	"_?ing"     any type matching the pattern (see path.Match)
+//
+// Channels of unknown types are refused with an error.
+type ChannelMux struct {
+	mtx        sync.RWMutex
+	exact      map[string]Handler
+	prefixes   []muxEntry // sorted by length (longest first)
+	patterns   []muxEntry // in order of registration
+	middleware []Middleware
+}
+
+type muxEntry struct {
+	pattern string
+	handler Handler
+}
+
+// NewChannelMux allocates and returns a new ChannelMux.
+func NewChannelMux() *ChannelMux {
+	return &ChannelMux{exact: make(map[string]Handler)}
+}
+
+// Handle registers the handler for the given pattern. Handle panics when a
+// handler already exists for pattern or when pattern is malformed.
+func (mux *ChannelMux) Handle(pattern string, handler Handler) {
+	if pattern == "" {
+		panic("e3x: invalid pattern")
+	}
+	if handler == nil {
+		panic("e3x: nil handler")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		panic("e3x: invalid pattern " + pattern)
+	}
+
+	mux.mtx.Lock()
+	defer mux.mtx.Unlock()
+
+	if mux.exact == nil {
+		mux.exact = make(map[string]Handler)
+	}
+
+	if mux.registered(pattern) {
+		panic("e3x: multiple registrations for " + pattern)
+	}
+
+	switch {
+	case !hasMeta(pattern):
+		mux.exact[pattern] = handler
+
+	case strings.HasSuffix(pattern, "*") && !hasMeta(pattern[:len(pattern)-1]):
+		mux.prefixes = append(mux.prefixes, muxEntry{pattern, handler})
+		sort.SliceStable(mux.prefixes, func(i, j int) bool {
+			return len(mux.prefixes[i].pattern) > len(mux.prefixes[j].pattern)
+		})
+
+	default:
+		mux.patterns = append(mux.patterns, muxEntry{pattern, handler})
+	}
+}
+
+// HandleFunc registers the handler function for the given pattern.
+func (mux *ChannelMux) HandleFunc(pattern string, handler func(c *Channel)) {
+	mux.Handle(pattern, HandlerFunc(handler))
+}
+
+// Use appends middleware to the chain which wraps all handlers of the mux
+// (including the handler which refuses unknown types). The first middleware is
+// the outermost.
+func (mux *ChannelMux) Use(middleware ...Middleware) {
+	mux.mtx.Lock()
+	mux.middleware = append(mux.middleware, middleware...)
+	mux.mtx.Unlock()
+}
+
+// Handler returns the handler (wrapped in the middleware of the mux) for
+// channels of type typ.
+func (mux *ChannelMux) Handler(typ string) Handler {
+	mux.mtx.RLock()
+	defer mux.mtx.RUnlock()
+
+	h := mux.match(typ)
+	for i := len(mux.middleware) - 1; i >= 0; i-- {
+		h = mux.middleware[i](h)
+	}
+	return h
+}
+
+// ServeChannel dispatches the channel to the handler whose pattern most
+// closely matches the type of the channel.
+func (mux *ChannelMux) ServeChannel(c *Channel) {
+	mux.Handler(c.typ).ServeChannel(c)
+}
+
+func (mux *ChannelMux) match(typ string) Handler {
+	if h := mux.exact[typ]; h != nil {
+		return h
+	}
+
+	for _, e := range mux.prefixes {
+		if strings.HasPrefix(typ, e.pattern[:len(e.pattern)-1]) {
+			return e.handler
+		}
+	}
+
+	for _, e := range mux.patterns {
+		if ok, _ := path.Match(e.pattern, typ); ok {
+			return e.handler
+		}
+	}
+
+	return HandlerFunc(refuseChannel)
+}
+
+func (mux *ChannelMux) registered(pattern string) bool {
+	if mux.exact[pattern] != nil {
+		return true
+	}
+	for _, e := range mux.prefixes {
+		if e.pattern == pattern {
+			return true
+		}
+	}
+	for _, e := range mux.patterns {
+		if e.pattern == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// refuseChannel is the default handler of a ChannelMux.
+func refuseChannel(c *Channel) {
+	// a server channel must read the initial packet before it can respond
+	if pkt, err := c.ReadPacket(); err == nil {
+		pkt.Free()
+	}
+
+	c.Errorf("unknown channel type: %q", c.typ)
+}
+
+// ChannelMux returns the channel multiplexer of the endpoint. It serves the
+// incoming channels for which no Listener exists.
+func (e *Endpoint) ChannelMux() *ChannelMux {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if e.mux == nil {
+		e.mux = NewChannelMux()
+		e.listenerSet.setHandler(e.mux)
+	}
+
+	return e.mux
+}
+
+// Handle registers the handler for the given pattern with the channel
+// multiplexer of the endpoint.
+func (e *Endpoint) Handle(pattern string, handler Handler) {
+	e.ChannelMux().Handle(pattern, handler)
+}
+
+// HandleFunc registers the handler function for the given pattern with the
+// channel multiplexer of the endpoint.
+func (e *Endpoint) HandleFunc(pattern string, handler func(c *Channel)) {
+	e.ChannelMux().HandleFunc(pattern, handler)
+}
+
+// Type returns the type of the channel.
+func (c *Channel) Type() string {
+	return c.typ
+}
+
+// Reliable returns true when the channel is reliable.
+func (c *Channel) Reliable() bool {
+	return c.reliable
+}
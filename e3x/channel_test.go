@@ -2,7 +2,10 @@ package e3x
 
 import (
 	"bytes"
+	"crypto/rand"
+	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"runtime"
 	"testing"
@@ -162,6 +165,368 @@ func TestPingPongReliable(t *testing.T) {
 	})
 }
 
+func TestCloseWrite(t *testing.T) {
+	withTwoEndpoints(t, func(A, B *Endpoint) {
+		A.setOptions(DisableLog())
+		B.setOptions(DisableLog())
+
+		var (
+			assert = assert.New(t)
+			done   = make(chan bool)
+		)
+
+		go func() {
+			defer close(done)
+
+			c, err := A.Listen("req", true).AcceptChannel()
+			if !assert.NoError(err) {
+				return
+			}
+			defer c.Close()
+
+			pkt, err := c.ReadPacket()
+			if assert.NoError(err) {
+				assert.Equal("request", string(pkt.Body(nil)))
+			}
+
+			// respond in two packets after the client finished writing
+			assert.NoError(c.WritePacket(lob.New([]byte("response-1"))))
+			_, err = c.ReadPacket()
+			assert.Equal(io.EOF, err)
+			assert.NoError(c.WritePacket(lob.New([]byte("response-2"))))
+		}()
+
+		ident, err := A.LocalIdentity()
+		assert.NoError(err)
+
+		c, err := B.Open(ident, "req", true)
+		if !assert.NoError(err) {
+			return
+		}
+
+		assert.NoError(c.WritePacket(lob.New([]byte("request"))))
+		assert.NoError(c.CloseWrite())
+		assert.Equal(io.EOF, c.WritePacket(lob.New([]byte("late"))))
+
+		for _, expected := range []string{"response-1", "response-2"} {
+			pkt, err := c.ReadPacket()
+			if assert.NoError(err) {
+				assert.Equal(expected, string(pkt.Body(nil)))
+			}
+		}
+		_, err = c.ReadPacket()
+		assert.Equal(io.EOF, err)
+
+		assert.NoError(c.Close())
+		<-done
+	})
+}
+
+func TestCloseRead(t *testing.T) {
+	withTwoEndpoints(t, func(A, B *Endpoint) {
+		A.setOptions(DisableLog())
+		B.setOptions(DisableLog())
+
+		var (
+			assert = assert.New(t)
+			done   = make(chan bool)
+		)
+
+		go func() {
+			defer close(done)
+
+			c, err := A.Listen("sink", true).AcceptChannel()
+			if !assert.NoError(err) {
+				return
+			}
+			defer c.Close()
+
+			_, err = c.ReadPacket()
+			assert.NoError(err)
+			assert.NoError(c.WritePacket(lob.New([]byte("go"))))
+
+			assert.NoError(c.CloseRead())
+			_, err = c.ReadPacket()
+			assert.Equal(io.EOF, err)
+
+			// writing still works
+			assert.NoError(c.WritePacket(lob.New([]byte("bye"))))
+		}()
+
+		ident, err := A.LocalIdentity()
+		assert.NoError(err)
+
+		c, err := B.Open(ident, "sink", true)
+		if !assert.NoError(err) {
+			return
+		}
+
+		assert.NoError(c.WritePacket(lob.New([]byte("hello"))))
+		pkt, err := c.ReadPacket()
+		if assert.NoError(err) {
+			assert.Equal("go", string(pkt.Body(nil)))
+		}
+
+		// the discarded packets are still acknowledged
+		for i := 0; i < 500; i++ {
+			assert.NoError(c.WritePacket(lob.New([]byte("discarded"))))
+		}
+
+		pkt, err = c.ReadPacket()
+		if assert.NoError(err) {
+			assert.Equal("bye", string(pkt.Body(nil)))
+		}
+
+		assert.NoError(c.Close())
+		<-done
+	})
+}
+
+func TestChannelPacketHooks(t *testing.T) {
+	withTwoEndpoints(t, func(A, B *Endpoint) {
+		A.setOptions(DisableLog())
+		B.setOptions(DisableLog())
+
+		var (
+			assert  = assert.New(t)
+			done    = make(chan bool)
+			dropped int
+		)
+
+		// B changes the packets it writes
+		B.DefaultChannelHooks().Register(ChannelHook{
+			OnWritePacket: func(e *Endpoint, x *Exchange, c *Channel, pkt *lob.Packet) (*lob.Packet, error) {
+				if pkt.BodyLen() > 0 {
+					pkt.SetBody(bytes.ToUpper(pkt.Body(nil)))
+					pkt.Header().SetBool("audited", true)
+				}
+				return pkt, nil
+			},
+		})
+
+		// A drops the first two received "hello" packets
+		A.DefaultChannelHooks().Register(ChannelHook{
+			OnReceivedPacket: func(e *Endpoint, x *Exchange, c *Channel, pkt *lob.Packet) (*lob.Packet, error) {
+				if string(pkt.Body(nil)) == "HELLO" && dropped < 2 {
+					dropped++
+					pkt.Free()
+					return nil, nil
+				}
+				return pkt, nil
+			},
+		})
+
+		go func() {
+			defer close(done)
+
+			c, err := A.Listen("hooks", true).AcceptChannel()
+			if !assert.NoError(err) {
+				return
+			}
+			defer c.Close()
+
+			pkt, err := c.ReadPacket()
+			if assert.NoError(err) {
+				assert.Equal("HELLO", string(pkt.Body(nil)))
+				audited, _ := pkt.Header().GetBool("audited")
+				assert.True(audited)
+			}
+			assert.NoError(c.WritePacket(lob.New([]byte("world"))))
+		}()
+
+		ident, err := A.LocalIdentity()
+		assert.NoError(err)
+
+		c, err := B.Open(ident, "hooks", true, WithChannelTimeouts(ChannelTimeouts{ResendInterval: 50 * time.Millisecond}))
+		if !assert.NoError(err) {
+			return
+		}
+
+		assert.NoError(c.WritePacket(lob.New([]byte("hello"))))
+		pkt, err := c.ReadPacket()
+		if assert.NoError(err) {
+			assert.Equal("world", string(pkt.Body(nil)))
+		}
+
+		assert.NoError(c.Close())
+		<-done
+		assert.Equal(2, dropped)
+	})
+}
+
+func TestChannelMuxMatch(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		mux    = NewChannelMux()
+		served []string
+	)
+
+	handler := func(name string) Handler {
+		return HandlerFunc(func(c *Channel) { served = append(served, name) })
+	}
+
+	mux.Handle("ping", handler("exact"))
+	mux.Handle("_thtp*", handler("short-prefix"))
+	mux.Handle("_thtp.admin*", handler("long-prefix"))
+	mux.Handle("_?ing", handler("pattern"))
+	mux.Use(func(h Handler) Handler {
+		return HandlerFunc(func(c *Channel) {
+			served = append(served, "mw:"+c.Type())
+			h.ServeChannel(c)
+		})
+	})
+
+	for _, typ := range []string{"ping", "_thtp.get", "_thtp.admin.users", "_ping"} {
+		mux.ServeChannel(&Channel{typ: typ})
+	}
+
+	assert.Equal([]string{
+		"mw:ping", "exact",
+		"mw:_thtp.get", "short-prefix",
+		"mw:_thtp.admin.users", "long-prefix",
+		"mw:_ping", "pattern",
+	}, served)
+
+	assert.Panics(func() { mux.Handle("ping", handler("again")) })
+	assert.Panics(func() { mux.Handle("[", handler("invalid")) })
+}
+
+func TestChannelMux(t *testing.T) {
+	withTwoEndpoints(t, func(A, B *Endpoint) {
+		A.setOptions(DisableLog())
+		B.setOptions(DisableLog())
+
+		var assert = assert.New(t)
+
+		A.HandleFunc("echo", func(c *Channel) {
+			defer c.Close()
+
+			for {
+				pkt, err := c.ReadPacket()
+				if err != nil {
+					return
+				}
+				c.WritePacket(pkt)
+			}
+		})
+
+		ident, err := A.LocalIdentity()
+		assert.NoError(err)
+
+		c, err := B.Open(ident, "echo", true)
+		if assert.NoError(err) {
+			assert.NoError(c.WritePacket(lob.New([]byte("hello"))))
+			pkt, err := c.ReadPacket()
+			if assert.NoError(err) {
+				assert.Equal("hello", string(pkt.Body(nil)))
+			}
+			assert.NoError(c.Close())
+		}
+
+		// unknown types are refused
+		c, err = B.Open(ident, "unknown", true)
+		if assert.NoError(err) {
+			assert.NoError(c.WritePacket(lob.New([]byte("hello"))))
+			pkt, err := c.ReadPacket()
+			if assert.NoError(err) {
+				reason, _ := pkt.Header().GetString("err")
+				assert.Equal(`unknown channel type: "unknown"`, reason)
+			}
+			c.Kill()
+		}
+	})
+}
+
+func TestAcceptRequest(t *testing.T) {
+	withTwoEndpoints(t, func(A, B *Endpoint) {
+		A.setOptions(DisableLog())
+		B.setOptions(DisableLog())
+
+		var assert = assert.New(t)
+
+		l := A.Listen("guarded", true)
+		defer l.Close()
+
+		go func() {
+			for {
+				req, err := l.AcceptRequest()
+				if err != nil {
+					return
+				}
+
+				assert.Equal("guarded", req.Type())
+				assert.True(req.Reliable())
+				assert.Equal(B.LocalHashname(), req.RemoteHashname())
+
+				if token, _ := req.Header().GetString("token"); token != "secret" {
+					assert.NoError(req.Reject(errors.New("access denied")))
+					continue
+				}
+
+				go func(c *Channel) {
+					defer c.Close()
+
+					pkt, err := c.ReadPacket()
+					if assert.NoError(err) {
+						assert.Equal("hello", string(pkt.Body(nil)))
+					}
+					assert.NoError(c.WritePacket(lob.New([]byte("welcome"))))
+				}(req.Accept())
+			}
+		}()
+
+		ident, err := A.LocalIdentity()
+		assert.NoError(err)
+
+		for _, token := range []string{"secret", "wrong"} {
+			c, err := B.Open(ident, "guarded", true)
+			if !assert.NoError(err) {
+				continue
+			}
+
+			pkt := lob.New([]byte("hello"))
+			pkt.Header().SetString("token", token)
+			assert.NoError(c.WritePacket(pkt))
+
+			pkt, err = c.ReadPacket()
+			if !assert.NoError(err) {
+				c.Kill()
+				continue
+			}
+
+			if token == "secret" {
+				assert.Equal("welcome", string(pkt.Body(nil)))
+				assert.NoError(c.Close())
+			} else {
+				reason, _ := pkt.Header().GetString("err")
+				assert.Equal("access denied", reason)
+				c.Kill()
+			}
+		}
+	})
+}
+
+func TestListenerBacklog(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		set     = newListenerSet()
+		dropped []error
+	)
+
+	set.dropChannelFunc = func(c *Channel, reason error) {
+		dropped = append(dropped, reason)
+	}
+
+	l := set.Listen("backlog", true, WithBacklog(1))
+	l.handle(&Channel{typ: "backlog", reliable: true})
+	l.handle(&Channel{typ: "backlog", reliable: true})
+	assert.Equal([]error{ErrListenerBacklogTooLarge}, dropped)
+
+	c, err := l.AcceptChannel()
+	assert.NoError(err)
+	assert.NotNil(c)
+}
+
 func TestFloodReliable(t *testing.T) {
 	if testing.Short() {
 		t.Skip("this is a long running test.")
@@ -229,6 +594,189 @@ func TestFloodReliable(t *testing.T) {
 	})
 }
 
+func TestFloodReliableLossy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("this is a long running test.")
+	}
+
+	var assert = assert.New(t)
+
+	A, err := Open(Transport(inproc.Config{Loss: 0.05}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := Open(Transport(inproc.Config{Loss: 0.05}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	go func() {
+		c, err := A.Listen("flood", true).AcceptChannel()
+		if assert.NoError(err) && assert.NotNil(c) {
+			defer c.Close()
+
+			_, err = c.ReadPacket()
+			assert.NoError(err)
+
+			for i := 0; i < 2000; i++ {
+				pkt := lob.New(nil)
+				pkt.Header().SetInt("flood_id", i)
+				err = c.WritePacket(pkt)
+				assert.NoError(err)
+			}
+		}
+	}()
+
+	ident, err := A.LocalIdentity()
+	assert.NoError(err)
+
+	// a small receive window makes the reader apply backpressure
+	c, err := B.Open(ident, "flood", true, WithWindow(8, 0))
+	if !assert.NoError(err) {
+		return
+	}
+	defer c.Close()
+
+	err = c.WritePacket(lob.New(nil))
+	assert.NoError(err)
+
+	lastID := -1
+	for {
+		pkt, err := c.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(err) {
+			break
+		}
+		id, _ := pkt.Header().GetInt("flood_id")
+		assert.Equal(lastID+1, id)
+		lastID = id
+	}
+	assert.Equal(1999, lastID)
+}
+
+func TestMessages(t *testing.T) {
+	withTwoEndpoints(t, func(A, B *Endpoint) {
+		A.setOptions(DisableLog())
+		B.setOptions(DisableLog())
+
+		var (
+			assert = assert.New(t)
+			blob   = make([]byte, 3<<20)
+			done   = make(chan bool)
+		)
+
+		rand.Read(blob)
+
+		go func() {
+			defer close(done)
+
+			c, err := A.Listen("blob", true).AcceptChannel()
+			if !assert.NoError(err) {
+				return
+			}
+			defer c.Close()
+
+			for _, expected := range [][]byte{blob, nil, []byte("hello")} {
+				r, err := c.ReadMessage()
+				if !assert.NoError(err) {
+					return
+				}
+				msg, err := ioutil.ReadAll(r)
+				assert.NoError(err)
+				assert.True(bytes.Equal(expected, msg))
+			}
+
+			_, err = c.ReadMessage()
+			assert.Equal(io.EOF, err)
+		}()
+
+		ident, err := A.LocalIdentity()
+		assert.NoError(err)
+
+		c, err := B.Open(ident, "blob", true)
+		if !assert.NoError(err) {
+			return
+		}
+
+		assert.NoError(c.WriteMessage(bytes.NewReader(blob)))
+		assert.NoError(c.WriteMessage(bytes.NewReader(nil)))
+		assert.NoError(c.WriteMessage(bytes.NewReader([]byte("hello"))))
+		assert.NoError(c.Close())
+
+		<-done
+	})
+}
+
+func TestMessageLimit(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		c      = &Channel{reliable: true, maxMessage: 2 * cMessageFragmentSize}
+		body   = bytes.Repeat([]byte{'x'}, cMessageFragmentSize)
+	)
+
+	fragment := func(id uint32, offset int, fin bool) *lob.Packet {
+		pkt := lob.New(body)
+		pkt.Header().SetUint32("msg", id)
+		pkt.Header().SetInt("off", offset)
+		if fin {
+			pkt.Header().SetBool("fin", true)
+		}
+		return pkt
+	}
+
+	// message 1 exceeds the limit; its remaining fragments are ignored
+	for i, expected := range []error{nil, nil, ErrMessageTooLarge, nil} {
+		msg, err := c.receivedFragment(fragment(1, i*cMessageFragmentSize, i == 3))
+		assert.Equal(expected, err)
+		assert.Nil(msg)
+	}
+
+	// message 2 fits
+	msg, err := c.receivedFragment(fragment(2, 0, false))
+	assert.NoError(err)
+	assert.Nil(msg)
+	msg, err = c.receivedFragment(fragment(2, cMessageFragmentSize, true))
+	assert.NoError(err)
+	assert.NotNil(msg)
+	assert.Equal(int64(0), c.iMessageBytes)
+	assert.Empty(c.iMessages)
+
+	// fragments must be contiguous
+	_, err = c.receivedFragment(fragment(3, cMessageFragmentSize, false))
+	assert.Equal(ErrInvalidMessage, err)
+
+	// packets without fragment headers are invalid
+	_, err = c.receivedFragment(lob.New(body))
+	assert.Equal(ErrInvalidMessage, err)
+}
+
+func TestWithWindow(t *testing.T) {
+	var assert = assert.New(t)
+
+	c := &Channel{readWindow: cReadBufferSize, writeWindow: cWriteBufferSize}
+	assert.NoError(WithWindow(16, 0)(c))
+	assert.Equal(16, c.readWindow)
+	assert.Equal(cWriteBufferSize, c.writeWindow)
+
+	assert.Equal(ErrInvalidWindow, WithWindow(1, 0)(c))
+	assert.Equal(ErrInvalidWindow, WithWindow(0, cMaxWindow+1)(c))
+}
+
+func TestReadBufferIndexOf(t *testing.T) {
+	var assert = assert.New(t)
+
+	s := readBufferSlice{{seq: 2}, {seq: 3}, {seq: 7}}
+	assert.Equal(0, s.IndexOf(2))
+	assert.Equal(2, s.IndexOf(7))
+	assert.Equal(-1, s.IndexOf(5))
+	assert.Equal(-1, s.IndexOf(8))
+}
+
 func BenchmarkReadWriteReliable(b *testing.B) {
 	defer dumpExpVar(b)
 	logs.ResetLogger()
@@ -302,6 +850,98 @@ func BenchmarkReadWriteReliable(b *testing.B) {
 	})
 }
 
+func BenchmarkReadWriteReliableLossy1(b *testing.B) {
+	benchmarkReadWriteReliableLossy(b, 0.01)
+}
+
+func BenchmarkReadWriteReliableLossy5(b *testing.B) {
+	benchmarkReadWriteReliableLossy(b, 0.05)
+}
+
+// benchmarkReadWriteReliableLossy measures the throughput of a reliable
+// channel over an inproc transport which drops a fraction of the packets.
+func benchmarkReadWriteReliableLossy(b *testing.B, loss float64) {
+	defer dumpExpVar(b)
+	logs.ResetLogger()
+
+	A, err := Open(Transport(inproc.Config{Loss: loss}), Log(nil))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := Open(Transport(inproc.Config{Loss: loss}), Log(nil))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer B.Close()
+
+	var (
+		body = bytes.Repeat([]byte{'x'}, 1300)
+		done = make(chan error, 1)
+	)
+
+	go func() {
+		c, err := A.Listen("flood", true).AcceptChannel()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer c.Close()
+
+		_, err = c.ReadPacket()
+		if err != nil {
+			done <- err
+			return
+		}
+
+		for i := 0; i < b.N; i++ {
+			err = c.WritePacket(lob.New(body))
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	ident, err := A.LocalIdentity()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	c, err := B.Open(ident, "flood", true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.WritePacket(lob.New(nil))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+
+	for {
+		pkt, err := c.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		pkt.Free()
+	}
+
+	b.StopTimer()
+
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
+
 func BenchmarkReadWriteUnreliable(b *testing.B) {
 	defer dumpExpVar(b)
 	logs.ResetLogger()
@@ -71,6 +71,19 @@ type Key interface {
 	CanEncrypt() bool
 }
 
+// Agreer is implemented by keys which can perform the key agreement (ECDH) of
+// their cipher set. Agree combines the private half of the key with the public
+// key of a peer and returns the shared secret.
+//
+// Keys which keep their private half outside of the process (for example keys
+// held by a key agent) return nil from Private() and are only usable with
+// cipher sets which accept an Agreer as their local key (1a and 3a).
+type Agreer interface {
+	Key
+
+	Agree(peer []byte) ([]byte, error)
+}
+
 type Token [16]byte
 
 var ZeroToken Token
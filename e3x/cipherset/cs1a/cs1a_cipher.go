@@ -24,6 +24,7 @@ var (
 	_ cipherset.Cipher    = (*cipher)(nil)
 	_ cipherset.State     = (*state)(nil)
 	_ cipherset.Key       = (*key)(nil)
+	_ cipherset.Agreer    = (*key)(nil)
 	_ cipherset.Handshake = (*handshake)(nil)
 )
 
@@ -61,7 +62,7 @@ func (c *cipher) GenerateKey() (cipherset.Key, error) {
 }
 
 func (c *cipher) NewState(localKey cipherset.Key) (cipherset.State, error) {
-	if k, ok := localKey.(*key); ok && k != nil && k.CanEncrypt() && k.CanSign() {
+	if k := keyFrom(localKey); k != nil && k.CanEncrypt() && k.CanSign() {
 		s := &state{localKey: k}
 		s.update()
 		return s, nil
@@ -75,14 +76,14 @@ func (c *cipher) DecryptMessage(localKey, remoteKey cipherset.Key, p []byte) ([]
 	}
 
 	var (
-		ctLen            = len(p) - (21 + 4 + 4)
-		out              = make([]byte, ctLen)
-		cs1aLocalKey, _  = localKey.(*key)
-		cs1aRemoteKey, _ = remoteKey.(*key)
-		remoteLineKey    = p[:21]
-		iv               = p[21 : 21+4]
-		ciphertext       = p[21+4 : 21+4+ctLen]
-		mac              = p[21+4+ctLen:]
+		ctLen         = len(p) - (21 + 4 + 4)
+		out           = make([]byte, ctLen)
+		cs1aLocalKey  = keyFrom(localKey)
+		cs1aRemoteKey = keyFrom(remoteKey)
+		remoteLineKey = p[:21]
+		iv            = p[21 : 21+4]
+		ciphertext    = p[21+4 : 21+4+ctLen]
+		mac           = p[21+4+ctLen:]
 	)
 
 	if cs1aLocalKey == nil || cs1aRemoteKey == nil {
@@ -90,8 +91,10 @@ func (c *cipher) DecryptMessage(localKey, remoteKey cipherset.Key, p []byte) ([]
 	}
 
 	{ // verify mac
-		macKey := ecdh.ComputeShared(secp160r1.P160(),
-			cs1aRemoteKey.pub.x, cs1aRemoteKey.pub.y, cs1aLocalKey.prv.d)
+		macKey := cs1aLocalKey.computeShared(cs1aRemoteKey.pub.x, cs1aRemoteKey.pub.y)
+		if macKey == nil {
+			return nil, cipherset.ErrInvalidState
+		}
 		macKey = append(macKey, iv...)
 
 		h := hmac.New(sha256.New, macKey)
@@ -107,7 +110,7 @@ func (c *cipher) DecryptMessage(localKey, remoteKey cipherset.Key, p []byte) ([]
 			return nil, cipherset.ErrInvalidMessage
 		}
 
-		shared := ecdh.ComputeShared(secp160r1.P160(), ephemX, ephemY, cs1aLocalKey.prv.d)
+		shared := cs1aLocalKey.computeShared(ephemX, ephemY)
 		if shared == nil {
 			return nil, cipherset.ErrInvalidMessage
 		}
@@ -145,7 +148,7 @@ func (c *cipher) DecryptHandshake(localKey cipherset.Key, p []byte) (cipherset.H
 	var (
 		ctLen             = len(p) - (21 + 4 + 4)
 		out               = bufpool.New()
-		cs1aLocalKey, _   = localKey.(*key)
+		cs1aLocalKey      = keyFrom(localKey)
 		remoteKey         *key
 		remoteLineKey     *key
 		hshake            *handshake
@@ -165,7 +168,7 @@ func (c *cipher) DecryptHandshake(localKey cipherset.Key, p []byte) (cipherset.H
 			return nil, cipherset.ErrInvalidMessage
 		}
 
-		shared := ecdh.ComputeShared(secp160r1.P160(), ephemX, ephemY, cs1aLocalKey.prv.d)
+		shared := cs1aLocalKey.computeShared(ephemX, ephemY)
 		if shared == nil {
 			return nil, cipherset.ErrInvalidMessage
 		}
@@ -234,8 +237,10 @@ func (c *cipher) DecryptHandshake(localKey cipherset.Key, p []byte) (cipherset.H
 		var nonce [16]byte
 		copy(nonce[:], iv)
 
-		macKey := ecdh.ComputeShared(secp160r1.P160(),
-			remoteKey.pub.x, remoteKey.pub.y, cs1aLocalKey.prv.d)
+		macKey := cs1aLocalKey.computeShared(remoteKey.pub.x, remoteKey.pub.y)
+		if macKey == nil {
+			return nil, cipherset.ErrInvalidState
+		}
 		macKey = append(macKey, nonce[:]...)
 
 		h := hmac.New(sha256.New, macKey)
@@ -287,7 +292,7 @@ func (s *state) SetRemoteKey(remoteKey cipherset.Key) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	if k, ok := remoteKey.(*key); ok && k != nil && k.CanEncrypt() {
+	if k := keyFrom(remoteKey); k != nil && k.CanEncrypt() {
 		s.remoteKey = k
 		s.update()
 		return nil
@@ -426,8 +431,11 @@ func (s *state) EncryptMessage(in []byte) ([]byte, error) {
 	}
 
 	{ // compute HMAC
-		macKey := ecdh.ComputeShared(secp160r1.P160(),
-			s.remoteKey.pub.x, s.remoteKey.pub.y, s.localKey.prv.d)
+		macKey := s.localKey.computeShared(s.remoteKey.pub.x, s.remoteKey.pub.y)
+		if macKey == nil {
+			out.Free()
+			return nil, cipherset.ErrInvalidState
+		}
 		macKey = append(macKey, raw[21:21+4]...)
 
 		h := hmac.New(sha256.New, macKey)
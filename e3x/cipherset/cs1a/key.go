@@ -7,6 +7,7 @@ import (
 
 	"github.com/telehash/gogotelehash/e3x/cipherset"
 	"github.com/telehash/gogotelehash/e3x/cipherset/cs1a/eccp"
+	"github.com/telehash/gogotelehash/e3x/cipherset/cs1a/ecdh"
 	"github.com/telehash/gogotelehash/e3x/cipherset/cs1a/secp160r1"
 	"github.com/telehash/gogotelehash/internal/util/base32util"
 )
@@ -14,6 +15,31 @@ import (
 type key struct {
 	pub struct{ x, y *big.Int }
 	prv struct{ d []byte }
+
+	// agreer performs the key agreement when the private key is held
+	// elsewhere (prv.d is nil).
+	agreer cipherset.Agreer
+}
+
+// keyFrom returns k as a cs1a key. Other implementations of a 1a key (like a
+// key agent key) are converted; when they implement cipherset.Agreer the key
+// agreement is delegated to them.
+func keyFrom(k cipherset.Key) *key {
+	if k, ok := k.(*key); ok {
+		return k
+	}
+
+	if k == nil || k.CSID() != 0x1a {
+		return nil
+	}
+
+	converted, err := decodeKeyBytes(k.Public(), nil)
+	if err != nil || !converted.CanEncrypt() {
+		return nil
+	}
+
+	converted.agreer, _ = k.(cipherset.Agreer)
+	return converted
 }
 
 func decodeKeyBytes(pub, prv []byte) (*key, error) {
@@ -74,9 +100,45 @@ func (k *key) String() string {
 }
 
 func (k *key) CanSign() bool {
-	return k != nil && k.prv.d != nil
+	return k != nil && (k.prv.d != nil || k.agreer != nil)
 }
 
 func (k *key) CanEncrypt() bool {
 	return k != nil && k.pub.x != nil && k.pub.y != nil
 }
+
+// Agree returns the ECDH shared secret of the local private key and peer.
+func (k *key) Agree(peer []byte) ([]byte, error) {
+	x, y := eccp.Unmarshal(secp160r1.P160(), peer)
+	if x == nil || y == nil {
+		return nil, cipherset.ErrInvalidKey
+	}
+
+	shared := k.computeShared(x, y)
+	if shared == nil {
+		return nil, cipherset.ErrInvalidKey
+	}
+
+	return shared, nil
+}
+
+func (k *key) computeShared(x, y *big.Int) []byte {
+	if k == nil || x == nil || y == nil {
+		return nil
+	}
+
+	if k.prv.d != nil {
+		return ecdh.ComputeShared(secp160r1.P160(), x, y, k.prv.d)
+	}
+
+	if k.agreer == nil {
+		return nil
+	}
+
+	shared, err := k.agreer.Agree(eccp.Marshal(secp160r1.P160(), x, y))
+	if err != nil || len(shared) == 0 {
+		return nil
+	}
+
+	return shared
+}
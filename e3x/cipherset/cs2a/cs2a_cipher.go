@@ -0,0 +1,582 @@
+package cs2a
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	Cipher "crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/telehash/gogotelehash/e3x/cipherset"
+	"github.com/telehash/gogotelehash/internal/lob"
+	"github.com/telehash/gogotelehash/internal/util/bufpool"
+)
+
+var (
+	_ cipherset.Cipher    = (*cipher)(nil)
+	_ cipherset.State     = (*state)(nil)
+	_ cipherset.Key       = (*key)(nil)
+	_ cipherset.Handshake = (*handshake)(nil)
+)
+
+const (
+	lenKey     = rsaBits / 8
+	lenSig     = rsaBits / 8
+	lenLineKey = 65
+	lenIV      = 12
+	lenAuth    = 16
+	lenToken   = 16
+)
+
+func init() {
+	cipherset.Register(0x2a, &cipher{})
+}
+
+type cipher struct{}
+
+type handshake struct {
+	key     *key
+	lineKey *lineKey
+	token   cipherset.Token
+	parts   cipherset.Parts
+	at      uint32
+}
+
+func (h *handshake) Parts() cipherset.Parts {
+	return h.parts
+}
+
+func (h *handshake) PublicKey() cipherset.Key {
+	return h.key
+}
+
+func (h *handshake) At() uint32 { return h.at }
+func (*handshake) CSID() uint8  { return 0x2a }
+func (*cipher) CSID() uint8     { return 0x2a }
+
+func (c *cipher) DecodeKeyBytes(pub, prv []byte) (cipherset.Key, error) {
+	return decodeKeyBytes(pub, prv)
+}
+
+func (c *cipher) GenerateKey() (cipherset.Key, error) {
+	return generateKey()
+}
+
+func (c *cipher) NewState(localKey cipherset.Key) (cipherset.State, error) {
+	if k, ok := localKey.(*key); ok && k != nil && k.CanEncrypt() && k.CanSign() {
+		s := &state{localKey: k}
+		s.update()
+		return s, nil
+	}
+	return nil, cipherset.ErrInvalidKey
+}
+
+func (c *cipher) DecryptMessage(localKey, remoteKey cipherset.Key, p []byte) ([]byte, error) {
+	var (
+		cs2aLocalKey, _  = localKey.(*key)
+		cs2aRemoteKey, _ = remoteKey.(*key)
+	)
+
+	if !cs2aLocalKey.CanSign() || !cs2aRemoteKey.CanEncrypt() {
+		return nil, cipherset.ErrInvalidState
+	}
+
+	remoteLineKey, inner, err := openMessage(cs2aLocalKey, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if !verifyMessage(cs2aRemoteKey, remoteLineKey, p) {
+		return nil, cipherset.ErrInvalidMessage
+	}
+
+	return inner, nil
+}
+
+func (c *cipher) DecryptHandshake(localKey cipherset.Key, p []byte) (cipherset.Handshake, error) {
+	var (
+		cs2aLocalKey, _ = localKey.(*key)
+		hshake          *handshake
+	)
+
+	if !cs2aLocalKey.CanSign() {
+		return nil, cipherset.ErrInvalidState
+	}
+
+	remoteLineKey, innerData, err := openMessage(cs2aLocalKey, p)
+	if err != nil {
+		return nil, err
+	}
+
+	{ // decode inner
+		buf := bufpool.New().Set(innerData)
+		inner, err := lob.Decode(buf)
+		buf.Free()
+		if err != nil {
+			return nil, cipherset.ErrInvalidMessage
+		}
+
+		at, hasAt := inner.Header().GetUint32("at")
+		if !hasAt {
+			return nil, cipherset.ErrInvalidMessage
+		}
+
+		delete(inner.Header().Extra, "at")
+
+		parts, err := cipherset.PartsFromHeader(inner.Header())
+		if err != nil {
+			return nil, cipherset.ErrInvalidMessage
+		}
+
+		remoteKey, err := decodeKeyBytes(inner.Body(nil), nil)
+		if err != nil || !remoteKey.CanEncrypt() {
+			return nil, cipherset.ErrInvalidMessage
+		}
+
+		hshake = &handshake{}
+		hshake.at = at
+		hshake.key = remoteKey
+		hshake.lineKey = remoteLineKey
+		hshake.token = makeToken(p[:lenToken])
+		hshake.parts = parts
+	}
+
+	if !verifyMessage(hshake.key, hshake.lineKey, p) {
+		return nil, cipherset.ErrInvalidMessage
+	}
+
+	return hshake, nil
+}
+
+// openMessage decrypts the line key and the inner message of p.
+// The signature is not verified.
+func openMessage(localKey *key, p []byte) (*lineKey, []byte, error) {
+	if len(p) < lenKey+lenIV+lenAuth+lenSig+lenAuth {
+		return nil, nil, cipherset.ErrInvalidMessage
+	}
+
+	var (
+		ctLen      = len(p) - (lenKey + lenIV + lenSig + lenAuth)
+		iv         = p[lenKey : lenKey+lenIV]
+		ciphertext = p[lenKey+lenIV : lenKey+lenIV+ctLen]
+	)
+
+	linePub, err := rsa.DecryptOAEP(sha1.New(), nil, localKey.prv, p[:lenKey], nil)
+	if err != nil {
+		return nil, nil, cipherset.ErrInvalidMessage
+	}
+
+	remoteLineKey := decodeLineKey(linePub)
+	if remoteLineKey == nil {
+		return nil, nil, cipherset.ErrInvalidMessage
+	}
+
+	aead, err := newAEAD(messageKey(linePub))
+	if err != nil {
+		return nil, nil, cipherset.ErrInvalidMessage
+	}
+
+	inner, err := aead.Open(nil, iv, ciphertext, nil)
+	if err != nil {
+		return nil, nil, cipherset.ErrInvalidMessage
+	}
+
+	return remoteLineKey, inner, nil
+}
+
+// verifyMessage verifies the sealed signature at the end of p.
+func verifyMessage(remoteKey *key, remoteLineKey *lineKey, p []byte) bool {
+	var (
+		ctLen = len(p) - (lenKey + lenIV + lenSig + lenAuth)
+		iv    = p[lenKey : lenKey+lenIV]
+	)
+
+	aead, err := newAEAD(signatureKey(remoteLineKey.pub, iv))
+	if err != nil {
+		return false
+	}
+
+	sig, err := aead.Open(nil, iv, p[lenKey+lenIV+ctLen:], nil)
+	if err != nil {
+		return false
+	}
+
+	digest := sha256.Sum256(p[:lenKey+lenIV+ctLen])
+	return rsa.VerifyPKCS1v15(remoteKey.pub, crypto.SHA256, digest[:], sig) == nil
+}
+
+type state struct {
+	// pktNonceSuffix is updated atomically and must stay the first field to be
+	// 64-bit aligned on 32-bit platforms.
+	pktNonceSuffix uint64
+
+	mtx               sync.RWMutex
+	localKey          *key
+	remoteKey         *key
+	localLineKey      *lineKey
+	remoteLineKey     *lineKey
+	localLineKeyBox   []byte
+	localToken        *cipherset.Token
+	remoteToken       *cipherset.Token
+	lineEncryptionKey Cipher.AEAD
+	lineDecryptionKey Cipher.AEAD
+	pktNoncePrefix    *[4]byte
+}
+
+func (*state) CSID() uint8 { return 0x2a }
+
+func (s *state) IsHigh() bool {
+	if s.localKey != nil && s.remoteKey != nil {
+		return bytes.Compare(s.remoteKey.Public(), s.localKey.Public()) < 0
+	}
+	return false
+}
+
+func (s *state) LocalToken() cipherset.Token {
+	if s.localToken != nil {
+		return *s.localToken
+	}
+	return cipherset.ZeroToken
+}
+
+func (s *state) RemoteToken() cipherset.Token {
+	if s.remoteToken != nil {
+		return *s.remoteToken
+	}
+	return cipherset.ZeroToken
+}
+
+func (s *state) SetRemoteKey(remoteKey cipherset.Key) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if k, ok := remoteKey.(*key); ok && k != nil && k.CanEncrypt() {
+		s.remoteKey = k
+		s.update()
+		return nil
+	}
+
+	return cipherset.ErrInvalidKey
+}
+
+func (s *state) setRemoteLineKey(k *lineKey, token cipherset.Token) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.remoteLineKey = k
+	s.remoteToken = &token
+	s.update()
+}
+
+func (s *state) update() {
+
+	if s.pktNoncePrefix == nil {
+		s.pktNoncePrefix = new([4]byte)
+		io.ReadFull(rand.Reader, s.pktNoncePrefix[:])
+	}
+
+	// generate a local line Key
+	if s.localLineKey == nil {
+		s.localLineKey, _ = generateLineKey()
+	}
+
+	// encrypt the local line key for the remote key
+	if s.localLineKeyBox == nil && s.localLineKey != nil && s.remoteKey.CanEncrypt() {
+		s.localLineKeyBox, _ = rsa.EncryptOAEP(sha1.New(), rand.Reader, s.remoteKey.pub, s.localLineKey.pub, nil)
+	}
+
+	// make local token
+	if s.localToken == nil && s.localLineKeyBox != nil {
+		token := makeToken(s.localLineKeyBox[:lenToken])
+		s.localToken = &token
+	}
+
+	// generate line keys
+	if s.localToken != nil && s.remoteToken != nil && s.remoteLineKey != nil &&
+		(s.lineEncryptionKey == nil || s.lineDecryptionKey == nil) {
+		sharedKey := computeShared(s.localLineKey, s.remoteLineKey)
+
+		sha := sha256.New()
+		sha.Write(sharedKey)
+		sha.Write(s.localLineKey.pub)
+		sha.Write(s.remoteLineKey.pub)
+		s.lineEncryptionKey, _ = newAEAD(sha.Sum(nil))
+
+		sha.Reset()
+		sha.Write(sharedKey)
+		sha.Write(s.remoteLineKey.pub)
+		sha.Write(s.localLineKey.pub)
+		s.lineDecryptionKey, _ = newAEAD(sha.Sum(nil))
+	}
+}
+
+func (s *state) NeedsRemoteKey() bool {
+	return s.remoteKey == nil
+}
+
+func (s *state) CanEncryptMessage() bool {
+	return s.localKey != nil && s.remoteKey != nil && s.localLineKey != nil && s.localLineKeyBox != nil
+}
+
+func (s *state) CanEncryptHandshake() bool {
+	return s.CanEncryptMessage()
+}
+
+func (s *state) CanEncryptPacket() bool {
+	return s.lineEncryptionKey != nil && s.remoteToken != nil
+}
+
+func (s *state) CanDecryptMessage() bool {
+	return s.localKey != nil && s.remoteKey != nil && s.localLineKey != nil
+}
+
+func (s *state) CanDecryptHandshake() bool {
+	return s.localKey != nil && s.localLineKey != nil
+}
+
+func (s *state) CanDecryptPacket() bool {
+	return s.lineDecryptionKey != nil && s.localToken != nil
+}
+
+func (s *state) EncryptMessage(in []byte) ([]byte, error) {
+	var (
+		ctLen = len(in) + lenAuth
+		out   = make([]byte, lenKey+lenIV+ctLen+lenSig+lenAuth)
+	)
+
+	if !s.CanEncryptMessage() {
+		panic("unable to encrypt message")
+	}
+
+	// copy the encrypted senderLineKey
+	copy(out[:lenKey], s.localLineKeyBox)
+
+	// make the iv
+	_, err := io.ReadFull(rand.Reader, out[lenKey:lenKey+lenIV])
+	if err != nil {
+		return nil, err
+	}
+
+	{ // encrypt inner
+		aead, err := newAEAD(messageKey(s.localLineKey.pub))
+		if err != nil {
+			return nil, err
+		}
+
+		aead.Seal(out[lenKey+lenIV:lenKey+lenIV], out[lenKey:lenKey+lenIV], in, nil)
+	}
+
+	{ // sign message
+		err := s.sign(out[lenKey+lenIV+ctLen:], out[:lenKey+lenIV+ctLen], out[lenKey:lenKey+lenIV])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+func (s *state) sign(sig, p, iv []byte) error {
+	if len(sig) != lenSig+lenAuth {
+		panic("invalid sig buffer len(sig) must be 272")
+	}
+
+	digest := sha256.Sum256(p)
+	rawSig, err := rsa.SignPKCS1v15(rand.Reader, s.localKey.prv, crypto.SHA256, digest[:])
+	if err != nil {
+		return err
+	}
+
+	aead, err := newAEAD(signatureKey(s.localLineKey.pub, iv))
+	if err != nil {
+		return err
+	}
+
+	aead.Seal(sig[:0], iv, rawSig, nil)
+	return nil
+}
+
+func (s *state) EncryptHandshake(at uint32, compact cipherset.Parts) ([]byte, error) {
+	pkt := lob.New(s.localKey.Public())
+	compact.ApplyToHeader(pkt.Header())
+	pkt.Header().SetUint32("at", at)
+	data, err := lob.Encode(pkt)
+	if err != nil {
+		return nil, err
+	}
+	return s.EncryptMessage(data.Get(nil))
+}
+
+func (s *state) ApplyHandshake(h cipherset.Handshake) bool {
+	var (
+		hs, _ = h.(*handshake)
+	)
+
+	if hs == nil {
+		return false
+	}
+
+	if s.remoteKey != nil && !s.remoteKey.equal(hs.key) {
+		return false
+	}
+
+	if s.remoteLineKey != nil && !bytes.Equal(s.remoteLineKey.pub, hs.lineKey.pub) {
+		s.remoteLineKey = nil
+		s.remoteToken = nil
+		s.lineDecryptionKey = nil
+		s.lineEncryptionKey = nil
+	}
+
+	if s.remoteKey == nil {
+		s.SetRemoteKey(hs.key)
+	}
+	s.setRemoteLineKey(hs.lineKey, hs.token)
+	return true
+}
+
+func (s *state) EncryptPacket(pkt *lob.Packet) (*lob.Packet, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	var (
+		outer   *lob.Packet
+		inner   *bufpool.Buffer
+		body    *bufpool.Buffer
+		bodyRaw []byte
+		nonce   [lenIV]byte
+		ctLen   int
+		err     error
+	)
+
+	if !s.CanEncryptPacket() {
+		return nil, cipherset.ErrInvalidState
+	}
+	if pkt == nil {
+		return nil, nil
+	}
+
+	// encode inner packet
+	inner, err = lob.Encode(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	// make nonce
+	copy(nonce[:], s.pktNoncePrefix[:])
+	nonceSuffix := atomic.AddUint64(&s.pktNonceSuffix, 1)
+	binary.BigEndian.PutUint64(nonce[4:], nonceSuffix)
+
+	// alloc enough space
+	body = bufpool.New().SetLen(lenToken + lenIV + inner.Len() + lenAuth)
+	bodyRaw = body.RawBytes()
+
+	// copy token
+	copy(bodyRaw[:lenToken], s.remoteToken[:])
+
+	// copy nonce
+	copy(bodyRaw[lenToken:lenToken+lenIV], nonce[:])
+
+	// encrypt inner packet
+	ctLen = len(s.lineEncryptionKey.Seal(
+		bodyRaw[lenToken+lenIV:lenToken+lenIV], nonce[:], inner.RawBytes(), nil))
+	body.SetLen(lenToken + lenIV + ctLen)
+
+	outer = lob.New(body.RawBytes())
+	inner.Free()
+	body.Free()
+
+	return outer, nil
+}
+
+func (s *state) DecryptPacket(pkt *lob.Packet) (*lob.Packet, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if !s.CanDecryptPacket() {
+		return nil, cipherset.ErrInvalidState
+	}
+	if pkt == nil {
+		return nil, nil
+	}
+
+	if !pkt.Header().IsZero() || pkt.BodyLen() < lenToken+lenIV+lenAuth {
+		return nil, cipherset.ErrInvalidPacket
+	}
+
+	var (
+		bodyRaw  []byte
+		innerRaw []byte
+		innerPkt *lob.Packet
+		body     = bufpool.New()
+		inner    = bufpool.New()
+		err      error
+	)
+
+	pkt.Body(body.SetLen(pkt.BodyLen()).RawBytes()[:0])
+	bodyRaw = body.RawBytes()
+	innerRaw = inner.RawBytes()
+
+	// compare token
+	if !bytes.Equal(bodyRaw[:lenToken], (*s.localToken)[:]) {
+		inner.Free()
+		body.Free()
+		return nil, cipherset.ErrInvalidPacket
+	}
+
+	// decrypt inner packet
+	innerRaw, err = s.lineDecryptionKey.Open(
+		innerRaw[:0], bodyRaw[lenToken:lenToken+lenIV], bodyRaw[lenToken+lenIV:], nil)
+	if err != nil {
+		inner.Free()
+		body.Free()
+		return nil, cipherset.ErrInvalidPacket
+	}
+	inner.SetLen(len(innerRaw))
+
+	innerPkt, err = lob.Decode(inner)
+	if err != nil {
+		inner.Free()
+		body.Free()
+		return nil, err
+	}
+
+	inner.Free()
+	body.Free()
+
+	return innerPkt, nil
+}
+
+func makeToken(p []byte) cipherset.Token {
+	var token cipherset.Token
+	sha := sha256.Sum256(p[:lenToken])
+	copy(token[:], sha[:lenToken])
+	return token
+}
+
+func messageKey(linePub []byte) []byte {
+	sum := sha256.Sum256(linePub)
+	return sum[:]
+}
+
+func signatureKey(linePub, iv []byte) []byte {
+	sha := sha256.New()
+	sha.Write(linePub)
+	sha.Write(iv)
+	return sha.Sum(nil)
+}
+
+func newAEAD(k []byte) (Cipher.AEAD, error) {
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return Cipher.NewGCM(block)
+}
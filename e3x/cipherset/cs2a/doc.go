@@ -0,0 +1,23 @@
+// Package cs2a implements Cipher Set 2a.
+//
+// Hashname keys are RSA-2048 keys (PKCS#1 DER encoded), line keys are
+// ephemeral ECC P-256 keys and all payloads are sealed with AES-256-GCM.
+//
+// Message layout:
+//
+//   KEY   (256 bytes) RSA-OAEP encrypted ephemeral line key of the sender
+//   IV    ( 12 bytes)
+//   INNER (n+16 bytes) AES-256-GCM sealed inner message
+//   SIG   (256+16 bytes) AES-256-GCM sealed RSA signature of KEY+IV+INNER
+//
+// Packet layout:
+//
+//   TOKEN (16 bytes)
+//   IV    (12 bytes)
+//   INNER (n+16 bytes) AES-256-GCM sealed inner packet
+//
+// Reference
+//
+// Cipher Sets: https://github.com/telehash/telehash.org/blob/v3/v3/e3x/cs/README.md
+// CS2a: https://github.com/telehash/telehash.org/blob/v3/v3/e3x/cs/2a.md
+package cs2a
@@ -0,0 +1,141 @@
+package cs2a
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"math/big"
+
+	"github.com/telehash/gogotelehash/e3x/cipherset"
+	"github.com/telehash/gogotelehash/internal/util/base32util"
+)
+
+const rsaBits = 2048
+
+type key struct {
+	pub *rsa.PublicKey
+	prv *rsa.PrivateKey
+}
+
+func decodeKeyBytes(pub, prv []byte) (*key, error) {
+	var (
+		k = &key{}
+	)
+
+	if len(pub) != 0 {
+		pubKey, err := x509.ParsePKCS1PublicKey(pub)
+		if err != nil || pubKey.N.BitLen() != rsaBits {
+			return nil, cipherset.ErrInvalidKey
+		}
+		k.pub = pubKey
+	}
+
+	if len(prv) != 0 {
+		prvKey, err := x509.ParsePKCS1PrivateKey(prv)
+		if err != nil || prvKey.N.BitLen() != rsaBits {
+			return nil, cipherset.ErrInvalidKey
+		}
+		if k.pub != nil && (k.pub.N.Cmp(prvKey.N) != 0 || k.pub.E != prvKey.E) {
+			return nil, cipherset.ErrInvalidKey
+		}
+		k.prv = prvKey
+		k.pub = &prvKey.PublicKey
+	}
+
+	return k, nil
+}
+
+func generateKey() (*key, error) {
+	prv, err := rsa.GenerateKey(rand.Reader, rsaBits)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key{pub: &prv.PublicKey, prv: prv}, nil
+}
+
+func (k *key) CSID() uint8 { return 0x2a }
+
+func (k *key) Public() []byte {
+	if k == nil || k.pub == nil {
+		return nil
+	}
+
+	return x509.MarshalPKCS1PublicKey(k.pub)
+}
+
+func (k *key) Private() []byte {
+	if k == nil || k.prv == nil {
+		return nil
+	}
+
+	return x509.MarshalPKCS1PrivateKey(k.prv)
+}
+
+func (k *key) String() string {
+	return base32util.EncodeToString(k.Public())
+}
+
+func (k *key) CanSign() bool {
+	return k != nil && k.prv != nil
+}
+
+func (k *key) CanEncrypt() bool {
+	return k != nil && k.pub != nil
+}
+
+func (k *key) equal(o *key) bool {
+	if k == nil || o == nil || k.pub == nil || o.pub == nil {
+		return false
+	}
+	return k.pub.E == o.pub.E && k.pub.N.Cmp(o.pub.N) == 0
+}
+
+// lineKey is an ephemeral ECC P-256 key.
+type lineKey struct {
+	pub  []byte // uncompressed point
+	x, y *big.Int
+	prv  []byte
+}
+
+func generateLineKey() (*lineKey, error) {
+	prv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lineKey{
+		pub: elliptic.Marshal(elliptic.P256(), x, y),
+		x:   x,
+		y:   y,
+		prv: prv,
+	}, nil
+}
+
+func decodeLineKey(pub []byte) *lineKey {
+	if len(pub) != lenLineKey {
+		return nil
+	}
+
+	x, y := elliptic.Unmarshal(elliptic.P256(), pub)
+	if x == nil || y == nil {
+		return nil
+	}
+
+	buf := make([]byte, lenLineKey)
+	copy(buf, pub)
+	return &lineKey{pub: buf, x: x, y: y}
+}
+
+// computeShared computes the ECDH shared secret for the local private line key
+// and the remote public line key.
+func computeShared(local, remote *lineKey) []byte {
+	x, _ := elliptic.P256().ScalarMult(remote.x, remote.y, local.prv)
+
+	// left pad to the field size
+	shared := make([]byte, 32)
+	xBytes := x.Bytes()
+	copy(shared[32-len(xBytes):], xBytes)
+	return shared
+}
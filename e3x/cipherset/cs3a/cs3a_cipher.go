@@ -22,6 +22,7 @@ var (
 	_ cipherset.Cipher    = (*cipher)(nil)
 	_ cipherset.State     = (*state)(nil)
 	_ cipherset.Key       = (*key)(nil)
+	_ cipherset.Agreer    = (*key)(nil)
 	_ cipherset.Handshake = (*handshake)(nil)
 )
 
@@ -87,7 +88,7 @@ func (c *cipher) GenerateKey() (cipherset.Key, error) {
 }
 
 func (c *cipher) NewState(localKey cipherset.Key) (cipherset.State, error) {
-	if k, ok := localKey.(*key); ok && k != nil && k.CanEncrypt() && k.CanSign() {
+	if k := keyFrom(localKey); k != nil && k.CanEncrypt() && k.CanSign() {
 		s := &state{localKey: k}
 		s.update()
 		return s, nil
@@ -101,17 +102,17 @@ func (c *cipher) DecryptMessage(localKey, remoteKey cipherset.Key, p []byte) ([]
 	}
 
 	var (
-		ctLen            = len(p) - (lenKey + lenNonce + lenAuth)
-		out              = make([]byte, ctLen)
-		cs3aLocalKey, _  = localKey.(*key)
-		cs3aRemoteKey, _ = remoteKey.(*key)
-		mac              [lenAuth]byte
-		nonce            [lenNonce]byte
-		macKey           [lenKey]byte
-		agreedKey        [lenKey]byte
-		remoteLineKey    [lenKey]byte
-		ciphertext       []byte
-		ok               bool
+		ctLen         = len(p) - (lenKey + lenNonce + lenAuth)
+		out           = make([]byte, ctLen)
+		cs3aLocalKey  = keyFrom(localKey)
+		cs3aRemoteKey = keyFrom(remoteKey)
+		mac           [lenAuth]byte
+		nonce         [lenNonce]byte
+		macKey        [lenKey]byte
+		agreedKey     [lenKey]byte
+		remoteLineKey [lenKey]byte
+		ciphertext    []byte
+		ok            bool
 	)
 
 	if cs3aLocalKey == nil || cs3aRemoteKey == nil {
@@ -124,7 +125,9 @@ func (c *cipher) DecryptMessage(localKey, remoteKey cipherset.Key, p []byte) ([]
 	ciphertext = p[lenKey+lenNonce : lenKey+lenNonce+ctLen]
 
 	{ // make macKey
-		box.Precompute(&macKey, cs3aRemoteKey.pub, cs3aLocalKey.prv)
+		if !cs3aLocalKey.precompute(&macKey, cs3aRemoteKey.pub) {
+			return nil, cipherset.ErrInvalidState
+		}
 
 		var (
 			sha = sha256.New()
@@ -140,7 +143,9 @@ func (c *cipher) DecryptMessage(localKey, remoteKey cipherset.Key, p []byte) ([]
 	}
 
 	// make agreedKey
-	box.Precompute(&agreedKey, &remoteLineKey, cs3aLocalKey.prv)
+	if !cs3aLocalKey.precompute(&agreedKey, &remoteLineKey) {
+		return nil, cipherset.ErrInvalidState
+	}
 
 	// decode BODY
 	out, ok = box.OpenAfterPrecomputation(out[:0], ciphertext, &nonce, &agreedKey)
@@ -157,20 +162,20 @@ func (c *cipher) DecryptHandshake(localKey cipherset.Key, p []byte) (cipherset.H
 	}
 
 	var (
-		ctLen           = len(p) - (lenKey + lenNonce + lenAuth)
-		out             = bufpool.New()
-		handshake       = &handshake{}
-		cs3aLocalKey, _ = localKey.(*key)
-		at              uint32
-		hasAt           bool
-		mac             [lenAuth]byte
-		nonce           [lenNonce]byte
-		macKey          [lenKey]byte
-		agreedKey       [lenKey]byte
-		remoteKey       [lenKey]byte
-		remoteLineKey   [lenKey]byte
-		ciphertext      []byte
-		ok              bool
+		ctLen         = len(p) - (lenKey + lenNonce + lenAuth)
+		out           = bufpool.New()
+		handshake     = &handshake{}
+		cs3aLocalKey  = keyFrom(localKey)
+		at            uint32
+		hasAt         bool
+		mac           [lenAuth]byte
+		nonce         [lenNonce]byte
+		macKey        [lenKey]byte
+		agreedKey     [lenKey]byte
+		remoteKey     [lenKey]byte
+		remoteLineKey [lenKey]byte
+		ciphertext    []byte
+		ok            bool
 	)
 
 	if cs3aLocalKey == nil {
@@ -183,7 +188,9 @@ func (c *cipher) DecryptHandshake(localKey cipherset.Key, p []byte) (cipherset.H
 	ciphertext = p[lenKey+lenNonce : lenKey+lenNonce+ctLen]
 
 	// make agreedKey
-	box.Precompute(&agreedKey, &remoteLineKey, cs3aLocalKey.prv)
+	if !cs3aLocalKey.precompute(&agreedKey, &remoteLineKey) {
+		return nil, cipherset.ErrInvalidState
+	}
 
 	// decode BODY
 	outBuf, ok := box.OpenAfterPrecomputation(out.RawBytes(), ciphertext, &nonce, &agreedKey)
@@ -222,7 +229,9 @@ func (c *cipher) DecryptHandshake(localKey cipherset.Key, p []byte) (cipherset.H
 	}
 
 	{ // make macKey
-		box.Precompute(&macKey, &remoteKey, cs3aLocalKey.prv)
+		if !cs3aLocalKey.precompute(&macKey, &remoteKey) {
+			return nil, cipherset.ErrInvalidState
+		}
 
 		var (
 			sha = sha256.New()
@@ -241,6 +250,10 @@ func (c *cipher) DecryptHandshake(localKey cipherset.Key, p []byte) (cipherset.H
 }
 
 type state struct {
+	// pktNonceSuffix is updated atomically and must stay the first field to be
+	// 64-bit aligned on 32-bit platforms.
+	pktNonceSuffix uint64
+
 	mtx               sync.RWMutex
 	localKey          *key
 	remoteKey         *key
@@ -253,7 +266,6 @@ type state struct {
 	lineDecryptionKey *[lenKey]byte
 	nonce             *[lenNonce]byte
 	pktNoncePrefix    *[16]byte
-	pktNonceSuffix    uint64
 }
 
 func (*state) CSID() uint8 { return 0x3a }
@@ -283,7 +295,7 @@ func (s *state) SetRemoteKey(remoteKey cipherset.Key) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	if k, ok := remoteKey.(*key); ok && k != nil && k.CanEncrypt() {
+	if k := keyFrom(remoteKey); k != nil && k.CanEncrypt() {
 		s.remoteKey = k
 		s.update()
 		return nil
@@ -319,8 +331,10 @@ func (s *state) update() {
 
 	// generate mac key base
 	if s.macKeyBase == nil && s.localKey.CanSign() && s.remoteKey.CanEncrypt() {
-		s.macKeyBase = new([lenKey]byte)
-		box.Precompute(s.macKeyBase, s.remoteKey.pub, s.localKey.prv)
+		macKeyBase := new([lenKey]byte)
+		if s.localKey.precompute(macKeyBase, s.remoteKey.pub) {
+			s.macKeyBase = macKeyBase
+		}
 	}
 
 	// make local token
@@ -454,6 +468,18 @@ func (s *state) EncryptMessage(in []byte) ([]byte, error) {
 		panic("unable to encrypt message")
 	}
 
+	if s.macKeyBase == nil {
+		// the key agreement failed earlier (the key agent may have been unreachable)
+		s.mtx.Lock()
+		s.update()
+		s.mtx.Unlock()
+
+		if s.macKeyBase == nil {
+			out.Free()
+			return nil, cipherset.ErrInvalidState
+		}
+	}
+
 	// copy public senderLineKey
 	copy(raw[:lenKey], (*s.localLineKey.pub)[:])
 
@@ -631,6 +657,35 @@ func (s *state) DecryptPacket(pkt *lob.Packet) (*lob.Packet, error) {
 type key struct {
 	pub *[32]byte
 	prv *[32]byte
+
+	// agreer performs the key agreement when the private key is held
+	// elsewhere (prv is nil).
+	agreer cipherset.Agreer
+}
+
+// keyFrom returns k as a cs3a key. Other implementations of a 3a key (like a
+// key agent key) are converted; when they implement cipherset.Agreer the key
+// agreement is delegated to them.
+func keyFrom(k cipherset.Key) *key {
+	if k, ok := k.(*key); ok {
+		return k
+	}
+
+	if k == nil || k.CSID() != 0x3a {
+		return nil
+	}
+
+	pub := k.Public()
+	if len(pub) != lenKey {
+		return nil
+	}
+
+	var pubKey [lenKey]byte
+	copy(pubKey[:], pub)
+
+	converted := makeKey(nil, &pubKey)
+	converted.agreer, _ = k.(cipherset.Agreer)
+	return converted
 }
 
 func makeKey(prv, pub *[lenKey]byte) *key {
@@ -685,9 +740,51 @@ func (k *key) String() string {
 }
 
 func (k *key) CanSign() bool {
-	return k != nil && k.prv != nil
+	return k != nil && (k.prv != nil || k.agreer != nil)
 }
 
 func (k *key) CanEncrypt() bool {
 	return k != nil && k.pub != nil
 }
+
+// Agree returns the precomputed box key for the local private key and peer.
+func (k *key) Agree(peer []byte) ([]byte, error) {
+	var (
+		peerKey [lenKey]byte
+		shared  [lenKey]byte
+	)
+
+	if len(peer) != lenKey {
+		return nil, cipherset.ErrInvalidKey
+	}
+	copy(peerKey[:], peer)
+
+	if !k.precompute(&shared, &peerKey) {
+		return nil, cipherset.ErrInvalidKey
+	}
+
+	return shared[:], nil
+}
+
+func (k *key) precompute(shared, peer *[lenKey]byte) bool {
+	if k == nil || peer == nil {
+		return false
+	}
+
+	if k.prv != nil {
+		box.Precompute(shared, peer, k.prv)
+		return true
+	}
+
+	if k.agreer == nil {
+		return false
+	}
+
+	out, err := k.agreer.Agree((*peer)[:])
+	if err != nil || len(out) != lenKey {
+		return false
+	}
+
+	copy((*shared)[:], out)
+	return true
+}
@@ -0,0 +1,571 @@
+package cs3b
+
+import (
+	"bytes"
+	Cipher "crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/golang.org/x/crypto/chacha20poly1305"
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/golang.org/x/crypto/hkdf"
+
+	"github.com/telehash/gogotelehash/e3x/cipherset"
+	"github.com/telehash/gogotelehash/internal/lob"
+	"github.com/telehash/gogotelehash/internal/util/bufpool"
+)
+
+var (
+	_ cipherset.Cipher    = (*cipher)(nil)
+	_ cipherset.State     = (*state)(nil)
+	_ cipherset.Key       = (*key)(nil)
+	_ cipherset.Handshake = (*handshake)(nil)
+)
+
+const (
+	lenKey   = 32
+	lenNonce = chacha20poly1305.NonceSize
+	lenAuth  = chacha20poly1305.Overhead
+	lenToken = 16
+)
+
+const (
+	infoMessage = "telehash cs3b message"
+	infoAuth    = "telehash cs3b auth"
+	infoLine    = "telehash cs3b line"
+)
+
+func init() {
+	cipherset.Register(0x3b, &cipher{})
+}
+
+type cipher struct{}
+
+type handshake struct {
+	key     *key
+	lineKey *key
+	parts   cipherset.Parts
+	at      uint32
+}
+
+func (h *handshake) Parts() cipherset.Parts {
+	return h.parts
+}
+
+func (h *handshake) PublicKey() cipherset.Key {
+	return h.key
+}
+
+func (h *handshake) At() uint32 { return h.at }
+func (*handshake) CSID() uint8  { return 0x3b }
+func (*cipher) CSID() uint8     { return 0x3b }
+
+func (c *cipher) DecodeKeyBytes(pub, prv []byte) (cipherset.Key, error) {
+	return decodeKeyBytes(pub, prv)
+}
+
+func (c *cipher) GenerateKey() (cipherset.Key, error) {
+	return generateKey()
+}
+
+func (c *cipher) NewState(localKey cipherset.Key) (cipherset.State, error) {
+	if k, ok := localKey.(*key); ok && k != nil && k.CanEncrypt() && k.CanSign() {
+		s := &state{localKey: k}
+		s.update()
+		return s, nil
+	}
+	return nil, cipherset.ErrInvalidKey
+}
+
+func (c *cipher) DecryptMessage(localKey, remoteKey cipherset.Key, p []byte) ([]byte, error) {
+	var (
+		cs3bLocalKey, _  = localKey.(*key)
+		cs3bRemoteKey, _ = remoteKey.(*key)
+	)
+
+	if !cs3bLocalKey.CanSign() || !cs3bRemoteKey.CanEncrypt() {
+		return nil, cipherset.ErrInvalidState
+	}
+
+	_, inner, err := openMessage(cs3bLocalKey, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if !verifyMessage(cs3bLocalKey, cs3bRemoteKey, p) {
+		return nil, cipherset.ErrInvalidMessage
+	}
+
+	return inner, nil
+}
+
+func (c *cipher) DecryptHandshake(localKey cipherset.Key, p []byte) (cipherset.Handshake, error) {
+	var (
+		cs3bLocalKey, _ = localKey.(*key)
+		hshake          *handshake
+		remoteKey       [lenKey]byte
+	)
+
+	if !cs3bLocalKey.CanSign() {
+		return nil, cipherset.ErrInvalidState
+	}
+
+	remoteLineKey, innerData, err := openMessage(cs3bLocalKey, p)
+	if err != nil {
+		return nil, err
+	}
+
+	{ // decode inner
+		buf := bufpool.New().Set(innerData)
+		inner, err := lob.Decode(buf)
+		buf.Free()
+		if err != nil {
+			return nil, cipherset.ErrInvalidMessage
+		}
+
+		at, hasAt := inner.Header().GetUint32("at")
+		if !hasAt {
+			return nil, cipherset.ErrInvalidMessage
+		}
+
+		delete(inner.Header().Extra, "at")
+
+		parts, err := cipherset.PartsFromHeader(inner.Header())
+		if err != nil {
+			return nil, cipherset.ErrInvalidMessage
+		}
+
+		if inner.BodyLen() != lenKey {
+			return nil, cipherset.ErrInvalidMessage
+		}
+		inner.Body(remoteKey[:0])
+
+		hshake = &handshake{}
+		hshake.at = at
+		hshake.key = makeKey(nil, &remoteKey)
+		hshake.lineKey = remoteLineKey
+		hshake.parts = parts
+	}
+
+	if !verifyMessage(cs3bLocalKey, hshake.key, p) {
+		return nil, cipherset.ErrInvalidMessage
+	}
+
+	return hshake, nil
+}
+
+// sealMessage encrypts in for the receiver using the line key and nonce and
+// authenticates the result with the sender key.
+func sealMessage(sender, receiver, line *key, nonce, in []byte) ([]byte, error) {
+	out := make([]byte, lenKey+lenNonce, lenKey+lenNonce+len(in)+lenAuth+lenAuth)
+	copy(out[:lenKey], (*line.pub)[:])
+	copy(out[lenKey:], nonce)
+
+	{ // encrypt inner
+		shared := x25519(line, receiver)
+		if shared == nil {
+			return nil, cipherset.ErrInvalidKey
+		}
+
+		aead, err := newAEAD(shared, concat(line.pub[:], receiver.pub[:]), infoMessage)
+		if err != nil {
+			return nil, err
+		}
+
+		out = aead.Seal(out, nonce, in, nil)
+	}
+
+	{ // authenticate message
+		shared := x25519(sender, receiver)
+		if shared == nil {
+			return nil, cipherset.ErrInvalidKey
+		}
+
+		aead, err := newAEAD(shared, nonce, infoAuth)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, aead.Seal(nil, nonce, nil, out)...)
+	}
+
+	return out, nil
+}
+
+// openMessage decrypts the inner message of p. The sender is not verified.
+func openMessage(receiver *key, p []byte) (*key, []byte, error) {
+	if len(p) < lenKey+lenNonce+lenAuth+lenAuth {
+		return nil, nil, cipherset.ErrInvalidMessage
+	}
+
+	var (
+		ctLen         = len(p) - (lenKey + lenNonce + lenAuth)
+		nonce         = p[lenKey : lenKey+lenNonce]
+		ciphertext    = p[lenKey+lenNonce : lenKey+lenNonce+ctLen]
+		remoteLineKey [lenKey]byte
+	)
+
+	copy(remoteLineKey[:], p[:lenKey])
+	line := makeKey(nil, &remoteLineKey)
+
+	shared := x25519(receiver, line)
+	if shared == nil {
+		return nil, nil, cipherset.ErrInvalidMessage
+	}
+
+	aead, err := newAEAD(shared, concat(line.pub[:], receiver.pub[:]), infoMessage)
+	if err != nil {
+		return nil, nil, cipherset.ErrInvalidMessage
+	}
+
+	inner, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, nil, cipherset.ErrInvalidMessage
+	}
+
+	return line, inner, nil
+}
+
+// verifyMessage verifies that p was authenticated by sender.
+func verifyMessage(receiver, sender *key, p []byte) bool {
+	var (
+		ctLen = len(p) - (lenKey + lenNonce + lenAuth)
+		nonce = p[lenKey : lenKey+lenNonce]
+	)
+
+	shared := x25519(receiver, sender)
+	if shared == nil {
+		return false
+	}
+
+	aead, err := newAEAD(shared, nonce, infoAuth)
+	if err != nil {
+		return false
+	}
+
+	_, err = aead.Open(nil, nonce, p[lenKey+lenNonce+ctLen:], p[:lenKey+lenNonce+ctLen])
+	return err == nil
+}
+
+type state struct {
+	// pktNonceSuffix is updated atomically and must stay the first field to be
+	// 64-bit aligned on 32-bit platforms.
+	pktNonceSuffix uint64
+
+	mtx               sync.RWMutex
+	localKey          *key
+	remoteKey         *key
+	localLineKey      *key
+	remoteLineKey     *key
+	localToken        *cipherset.Token
+	remoteToken       *cipherset.Token
+	lineEncryptionKey Cipher.AEAD
+	lineDecryptionKey Cipher.AEAD
+	pktNoncePrefix    *[4]byte
+}
+
+func (*state) CSID() uint8 { return 0x3b }
+
+func (s *state) IsHigh() bool {
+	if s.localKey != nil && s.remoteKey != nil {
+		return bytes.Compare((*s.remoteKey.pub)[:], (*s.localKey.pub)[:]) < 0
+	}
+	return false
+}
+
+func (s *state) LocalToken() cipherset.Token {
+	if s.localToken != nil {
+		return *s.localToken
+	}
+	return cipherset.ZeroToken
+}
+
+func (s *state) RemoteToken() cipherset.Token {
+	if s.remoteToken != nil {
+		return *s.remoteToken
+	}
+	return cipherset.ZeroToken
+}
+
+func (s *state) SetRemoteKey(remoteKey cipherset.Key) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if k, ok := remoteKey.(*key); ok && k != nil && k.CanEncrypt() {
+		s.remoteKey = k
+		s.update()
+		return nil
+	}
+
+	return cipherset.ErrInvalidKey
+}
+
+func (s *state) setRemoteLineKey(k *key) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.remoteLineKey = k
+	s.update()
+}
+
+func (s *state) update() {
+
+	if s.pktNoncePrefix == nil {
+		s.pktNoncePrefix = new([4]byte)
+		io.ReadFull(rand.Reader, s.pktNoncePrefix[:])
+	}
+
+	// generate a local line Key
+	if s.localLineKey == nil {
+		s.localLineKey, _ = generateKey()
+	}
+
+	// make local token
+	if s.localToken == nil && s.localLineKey != nil {
+		token := makeToken(s.localLineKey)
+		s.localToken = &token
+	}
+
+	// make remote token
+	if s.remoteToken == nil && s.remoteLineKey != nil {
+		token := makeToken(s.remoteLineKey)
+		s.remoteToken = &token
+	}
+
+	// generate line keys
+	if s.localToken != nil && s.remoteToken != nil &&
+		(s.lineEncryptionKey == nil || s.lineDecryptionKey == nil) {
+		s.lineEncryptionKey, s.lineDecryptionKey = lineKeys(s.localLineKey, s.remoteLineKey)
+	}
+}
+
+// lineKeys derives the directional packet keys for a pair of line keys.
+func lineKeys(local, remote *key) (enc, dec Cipher.AEAD) {
+	shared := x25519(local, remote)
+	if shared == nil {
+		return nil, nil
+	}
+
+	enc, _ = newAEAD(shared, concat(local.pub[:], remote.pub[:]), infoLine)
+	dec, _ = newAEAD(shared, concat(remote.pub[:], local.pub[:]), infoLine)
+	if enc == nil || dec == nil {
+		return nil, nil
+	}
+
+	return enc, dec
+}
+
+func (s *state) NeedsRemoteKey() bool {
+	return s.remoteKey == nil
+}
+
+func (s *state) CanEncryptMessage() bool {
+	return s.localKey != nil && s.remoteKey != nil && s.localLineKey != nil
+}
+
+func (s *state) CanEncryptHandshake() bool {
+	return s.CanEncryptMessage()
+}
+
+func (s *state) CanEncryptPacket() bool {
+	return s.lineEncryptionKey != nil && s.remoteToken != nil
+}
+
+func (s *state) CanDecryptMessage() bool {
+	return s.localKey != nil && s.remoteKey != nil && s.localLineKey != nil
+}
+
+func (s *state) CanDecryptHandshake() bool {
+	return s.localKey != nil && s.localLineKey != nil
+}
+
+func (s *state) CanDecryptPacket() bool {
+	return s.lineDecryptionKey != nil && s.localToken != nil
+}
+
+func (s *state) EncryptMessage(in []byte) ([]byte, error) {
+	var (
+		nonce [lenNonce]byte
+	)
+
+	if !s.CanEncryptMessage() {
+		panic("unable to encrypt message")
+	}
+
+	_, err := io.ReadFull(rand.Reader, nonce[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return sealMessage(s.localKey, s.remoteKey, s.localLineKey, nonce[:], in)
+}
+
+func (s *state) EncryptHandshake(at uint32, compact cipherset.Parts) ([]byte, error) {
+	pkt := lob.New(s.localKey.Public())
+	compact.ApplyToHeader(pkt.Header())
+	pkt.Header().SetUint32("at", at)
+	data, err := lob.Encode(pkt)
+	if err != nil {
+		return nil, err
+	}
+	return s.EncryptMessage(data.Get(nil))
+}
+
+func (s *state) ApplyHandshake(h cipherset.Handshake) bool {
+	var (
+		hs, _ = h.(*handshake)
+	)
+
+	if hs == nil {
+		return false
+	}
+
+	if s.remoteKey != nil && *s.remoteKey.pub != *hs.key.pub {
+		return false
+	}
+
+	if s.remoteLineKey != nil && *s.remoteLineKey.pub != *hs.lineKey.pub {
+		s.remoteLineKey = nil
+		s.remoteToken = nil
+		s.lineDecryptionKey = nil
+		s.lineEncryptionKey = nil
+	}
+
+	s.setRemoteLineKey(hs.lineKey)
+	if s.remoteKey == nil {
+		s.SetRemoteKey(hs.key)
+	}
+	return true
+}
+
+func (s *state) EncryptPacket(pkt *lob.Packet) (*lob.Packet, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	var (
+		outer *lob.Packet
+		inner *bufpool.Buffer
+		body  *bufpool.Buffer
+		nonce [lenNonce]byte
+		err   error
+	)
+
+	if !s.CanEncryptPacket() {
+		return nil, cipherset.ErrInvalidState
+	}
+	if pkt == nil {
+		return nil, nil
+	}
+
+	// encode inner packet
+	inner, err = lob.Encode(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	// make nonce
+	copy(nonce[:], s.pktNoncePrefix[:])
+	nonceSuffix := atomic.AddUint64(&s.pktNonceSuffix, 1)
+	binary.BigEndian.PutUint64(nonce[4:], nonceSuffix)
+
+	body = bufpool.New()
+	body.SetLen(len(sealPacket(body.RawBytes(), s.lineEncryptionKey, *s.remoteToken, nonce[:], inner.RawBytes())))
+
+	outer = lob.New(body.RawBytes())
+	inner.Free()
+	body.Free()
+
+	return outer, nil
+}
+
+// sealPacket appends the sealed packet body to dst.
+func sealPacket(dst []byte, aead Cipher.AEAD, token cipherset.Token, nonce, inner []byte) []byte {
+	dst = append(dst[:0], token[:]...)
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, inner, nil)
+}
+
+func (s *state) DecryptPacket(pkt *lob.Packet) (*lob.Packet, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if !s.CanDecryptPacket() {
+		return nil, cipherset.ErrInvalidState
+	}
+	if pkt == nil {
+		return nil, nil
+	}
+
+	if !pkt.Header().IsZero() || pkt.BodyLen() < lenToken+lenNonce+lenAuth {
+		return nil, cipherset.ErrInvalidPacket
+	}
+
+	var (
+		bodyRaw  []byte
+		innerRaw []byte
+		innerPkt *lob.Packet
+		body     = bufpool.New()
+		inner    = bufpool.New()
+		err      error
+	)
+
+	pkt.Body(body.SetLen(pkt.BodyLen()).RawBytes()[:0])
+	bodyRaw = body.RawBytes()
+	innerRaw = inner.RawBytes()
+
+	// compare token
+	if !bytes.Equal(bodyRaw[:lenToken], (*s.localToken)[:]) {
+		inner.Free()
+		body.Free()
+		return nil, cipherset.ErrInvalidPacket
+	}
+
+	// decrypt inner packet
+	innerRaw, err = s.lineDecryptionKey.Open(
+		innerRaw[:0], bodyRaw[lenToken:lenToken+lenNonce], bodyRaw[lenToken+lenNonce:], nil)
+	if err != nil {
+		inner.Free()
+		body.Free()
+		return nil, cipherset.ErrInvalidPacket
+	}
+	inner.SetLen(len(innerRaw))
+
+	innerPkt, err = lob.Decode(inner)
+	if err != nil {
+		inner.Free()
+		body.Free()
+		return nil, err
+	}
+
+	inner.Free()
+	body.Free()
+
+	return innerPkt, nil
+}
+
+func makeToken(lineKey *key) cipherset.Token {
+	var token cipherset.Token
+	sha := sha256.Sum256((*lineKey.pub)[:lenToken])
+	copy(token[:], sha[:lenToken])
+	return token
+}
+
+func newAEAD(secret, salt []byte, info string) (Cipher.AEAD, error) {
+	var k [chacha20poly1305.KeySize]byte
+
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), k[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return chacha20poly1305.New(k[:])
+}
+
+func concat(a, b []byte) []byte {
+	buf := make([]byte, 0, len(a)+len(b))
+	buf = append(buf, a...)
+	return append(buf, b...)
+}
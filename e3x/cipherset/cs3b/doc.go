@@ -0,0 +1,22 @@
+// Package cs3b implements Cipher Set 3b.
+//
+// CS3b is the AEAD successor of CS3a. Hashname keys and line keys are X25519
+// keys, all payloads are sealed with ChaCha20-Poly1305 and every symmetric key
+// is derived with HKDF-SHA256.
+//
+// Message layout:
+//
+//   KEY   (32 bytes) ephemeral line key of the sender
+//   NONCE (12 bytes)
+//   INNER (n+16 bytes) sealed with HKDF(X25519(line key, receiver key))
+//   AUTH  (16 bytes) tag over KEY+NONCE+INNER keyed with HKDF(X25519(sender key, receiver key))
+//
+// Packet layout:
+//
+//   TOKEN (16 bytes)
+//   NONCE (12 bytes)
+//   INNER (n+16 bytes) sealed with the directional line key
+//
+// The MessageVectors and PacketVectors can be used to verify other
+// implementations of this cipher set.
+package cs3b
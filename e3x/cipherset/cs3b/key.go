@@ -0,0 +1,129 @@
+package cs3b
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"io"
+
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/golang.org/x/crypto/curve25519"
+
+	"github.com/telehash/gogotelehash/e3x/cipherset"
+	"github.com/telehash/gogotelehash/internal/util/base32util"
+)
+
+type key struct {
+	pub *[lenKey]byte
+	prv *[lenKey]byte
+}
+
+func decodeKeyBytes(pub, prv []byte) (*key, error) {
+	var (
+		pubKey *[lenKey]byte
+		prvKey *[lenKey]byte
+	)
+
+	if len(pub) != 0 {
+		if len(pub) != lenKey {
+			return nil, cipherset.ErrInvalidKey
+		}
+		pubKey = new([lenKey]byte)
+		copy((*pubKey)[:], pub)
+	}
+
+	if len(prv) != 0 {
+		if len(prv) != lenKey {
+			return nil, cipherset.ErrInvalidKey
+		}
+		prvKey = new([lenKey]byte)
+		copy((*prvKey)[:], prv)
+
+		if pubKey == nil {
+			pubKey = new([lenKey]byte)
+			curve25519.ScalarBaseMult(pubKey, prvKey)
+		}
+	}
+
+	return &key{pub: pubKey, prv: prvKey}, nil
+}
+
+func makeKey(prv, pub *[lenKey]byte) *key {
+	if prv != nil {
+		prvCopy := new([lenKey]byte)
+		copy((*prvCopy)[:], (*prv)[:])
+		prv = prvCopy
+	}
+
+	if pub != nil {
+		pubCopy := new([lenKey]byte)
+		copy((*pubCopy)[:], (*pub)[:])
+		pub = pubCopy
+	}
+
+	return &key{pub: pub, prv: prv}
+}
+
+func generateKey() (*key, error) {
+	var (
+		pub = new([lenKey]byte)
+		prv = new([lenKey]byte)
+	)
+
+	_, err := io.ReadFull(rand.Reader, prv[:])
+	if err != nil {
+		return nil, err
+	}
+
+	curve25519.ScalarBaseMult(pub, prv)
+	return &key{pub: pub, prv: prv}, nil
+}
+
+// x25519 computes the shared secret for the private key of a and the public
+// key of b. It returns nil when the result is the all-zero value (b is a low
+// order point).
+func x25519(a, b *key) []byte {
+	var (
+		shared [lenKey]byte
+		zero   [lenKey]byte
+	)
+
+	curve25519.ScalarMult(&shared, a.prv, b.pub)
+	if subtle.ConstantTimeCompare(shared[:], zero[:]) == 1 {
+		return nil
+	}
+
+	return shared[:]
+}
+
+func (k *key) CSID() uint8 { return 0x3b }
+
+func (k *key) Public() []byte {
+	if k == nil || k.pub == nil {
+		return nil
+	}
+
+	buf := make([]byte, lenKey)
+	copy(buf, (*k.pub)[:])
+	return buf
+}
+
+func (k *key) Private() []byte {
+	if k == nil || k.prv == nil {
+		return nil
+	}
+
+	buf := make([]byte, lenKey)
+	copy(buf, (*k.prv)[:])
+	return buf
+}
+
+func (k *key) String() string {
+	return base32util.EncodeToString((*k.pub)[:])
+}
+
+func (k *key) CanSign() bool {
+	return k != nil && k.prv != nil
+}
+
+func (k *key) CanEncrypt() bool {
+	return k != nil && k.pub != nil
+}
@@ -0,0 +1,68 @@
+package cs3b
+
+// MessageVector is a known answer test for message encryption.
+// All fields are hex encoded.
+type MessageVector struct {
+	SenderKey   string // private key of the sender
+	ReceiverKey string // private key of the receiver
+	LineKey     string // private line key of the sender
+	Nonce       string
+	Plaintext   string
+	Message     string // the expected message
+}
+
+// PacketVector is a known answer test for packet encryption.
+// All fields are hex encoded.
+type PacketVector struct {
+	LocalLineKey  string // private line key of the sender
+	RemoteLineKey string // private line key of the receiver
+	Nonce         string
+	Inner         string // the encoded inner packet
+	Packet        string // the expected body of the outer packet
+}
+
+// MessageVectors contains the known answer tests for message encryption.
+var MessageVectors = []MessageVector{
+	{
+		SenderKey:   "c00099868130c8e23dbdf1f741b3518c3209c167a7c584814e4a948b6953b488",
+		ReceiverKey: "4425a333a5447b3ce020b1db3976870a0a316cad9335933264158ec381b4320f",
+		LineKey:     "52f2a50ae36aeeef1dcbafc55c7e862f5fefff5002a4c6708d69a60d1da55fe0",
+		Nonce:       "e66503d2839a35dd26de0ff7",
+		Plaintext:   "",
+		Message:     "2ae74185ed60cc1d8682aba953fc5840b60748be44a524f47e1964bac12a753ce66503d2839a35dd26de0ff7056674f248d95bb8ed31f89cb9d001d0cab0da4a98b6e3c38ac906decd37f679",
+	},
+	{
+		SenderKey:   "a20873deda9de2d5d1a057bb06ca6b478af1613fe47e4b89c814152042d346a5",
+		ReceiverKey: "f4d40192c3e2c1a176bb7d46f7715501ff1fc9b5dc04588dcaa252cae71d8990",
+		LineKey:     "3cf5244d3f7b535430ac9233932b3740aeab6e4080b3bf90f23e1241839bfc68",
+		Nonce:       "1b7de4164a8ae68fdf6b4401",
+		Plaintext:   "48656c6c6f20576f726c6421",
+		Message:     "4cd7e55509722cd83e4b115debc1547525b37f56d1de3ded4bf7337420d194101b7de4164a8ae68fdf6b44019778e5178371708ad1692c621c8eccfce6d2f2e10dac5d36175d60768a6fcc0de15ac808131feb9d1b0d9888",
+	},
+	{
+		SenderKey:   "ddf64da9570e59828f9ec1a8294554e5a90b0b76ff04756016eae56d3a066129",
+		ReceiverKey: "bc55d84eb0464679dead4aae21df9aa7a061dc7a6c7ea8d980dfee3486a274c7",
+		LineKey:     "80b9cbe22901e7f73a22d6dd0b4a7e26bb6cc21d19aaa841090e2d5bf7fcb562",
+		Nonce:       "e2fc672f022d478a2d4e3085",
+		Plaintext:   "00000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000",
+		Message:     "24f17a99f233325e3c8ed5a10a48f199caa14197053501db618eafbbe31fa642e2fc672f022d478a2d4e3085b1eba93a4129fb2206ef33b788a15bd871cbaf7dadf76b9d88eacce33897ac3f91f1f7d75f9f633264af78e93a0f70693ea6fb3b427004ca9eb911f1904c48ae0ce48e4db91a41393e4d708668645542776e3976c21a7c3e7c65ee6cc8bfaa6ebb88ea221ab5cd5aa427b3139208a96fb10430f53b0aa6678dedbf88bf462f7126ec5f62",
+	},
+}
+
+// PacketVectors contains the known answer tests for packet encryption.
+var PacketVectors = []PacketVector{
+	{
+		LocalLineKey:  "d476529cc85a18592848d193609ed14f1810849203106f879925dbc4326b7405",
+		RemoteLineKey: "776ecdbf997f88225939753b7f81d1004706e0ea920c8337bf7fcb1c6382796d",
+		Nonce:         "b793749a39d4934a538bef2e",
+		Inner:         "00077b2263223a317d",
+		Packet:        "e2b49514c49eed85a8835af1bfe76c42b793749a39d4934a538bef2eb8d9fe367ca2f52185a83025a5a53b1439f8bc37c73eb6bd91",
+	},
+	{
+		LocalLineKey:  "cd1aef935c89b08c62a573a698002953afb7bf3be505320336a98b91eccd92f5",
+		RemoteLineKey: "bad383768f99cb3a837f8544ce3e021c1b4e89c9ab4da24a4522bd82ebeec9e5",
+		Nonce:         "ea7344e5ccef1c198aae4d27",
+		Inner:         "00077b2263223a327d48656c6c6f20576f726c6421",
+		Packet:        "407f3578a905e9d4c851cb966dfcf7d0ea7344e5ccef1c198aae4d270b8c4349d102bfe20e7ef774b6ef56b325a413cd327125597db87cee09ea21ddcf1ac34526",
+	},
+}
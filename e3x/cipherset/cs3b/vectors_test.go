@@ -0,0 +1,74 @@
+package cs3b
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func TestMessageVectors(t *testing.T) {
+	assert := assert.New(t)
+
+	for i, v := range MessageVectors {
+		var (
+			sender   = mustDecodeVectorKey(t, v.SenderKey)
+			receiver = mustDecodeVectorKey(t, v.ReceiverKey)
+			line     = mustDecodeVectorKey(t, v.LineKey)
+		)
+
+		msg, err := sealMessage(sender, receiver, line, mustDecodeHex(t, v.Nonce), mustDecodeHex(t, v.Plaintext))
+		if assert.NoError(err, "vector %d", i) {
+			assert.Equal(v.Message, hex.EncodeToString(msg), "vector %d", i)
+		}
+
+		plaintext, err := (&cipher{}).DecryptMessage(receiver, makeKey(nil, sender.pub), mustDecodeHex(t, v.Message))
+		if assert.NoError(err, "vector %d", i) {
+			assert.Equal(v.Plaintext, hex.EncodeToString(plaintext), "vector %d", i)
+		}
+	}
+}
+
+func TestPacketVectors(t *testing.T) {
+	assert := assert.New(t)
+
+	for i, v := range PacketVectors {
+		var (
+			local  = mustDecodeVectorKey(t, v.LocalLineKey)
+			remote = mustDecodeVectorKey(t, v.RemoteLineKey)
+			nonce  = mustDecodeHex(t, v.Nonce)
+			inner  = mustDecodeHex(t, v.Inner)
+		)
+
+		enc, _ := lineKeys(local, remote)
+		if assert.NotNil(enc, "vector %d", i) {
+			body := sealPacket(nil, enc, makeToken(remote), nonce, inner)
+			assert.Equal(v.Packet, hex.EncodeToString(body), "vector %d", i)
+		}
+
+		_, dec := lineKeys(remote, local)
+		if assert.NotNil(dec, "vector %d", i) {
+			body := mustDecodeHex(t, v.Packet)
+			plaintext, err := dec.Open(nil, body[lenToken:lenToken+lenNonce], body[lenToken+lenNonce:], nil)
+			if assert.NoError(err, "vector %d", i) {
+				assert.Equal(v.Inner, hex.EncodeToString(plaintext), "vector %d", i)
+			}
+		}
+	}
+}
+
+func mustDecodeVectorKey(t *testing.T, s string) *key {
+	k, err := decodeKeyBytes(nil, mustDecodeHex(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -16,14 +16,9 @@ type Keys map[uint8]Key
 type PrivateKeys Keys
 type Parts map[uint8]string
 
+// SelectCSID returns the highest CSID for which both a and b have a key.
 func SelectCSID(a, b Keys) uint8 {
-	var max uint8
-	for csid := range a {
-		if _, f := b[csid]; f && csid > max {
-			max = csid
-		}
-	}
-	return max
+	return (*Policy)(nil).SelectCSID(a, b)
 }
 
 func KeysFromJSON(i interface{}) (Keys, error) {
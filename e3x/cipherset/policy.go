@@ -0,0 +1,119 @@
+package cipherset
+
+import (
+	"errors"
+)
+
+var ErrInvalidPolicy = errors.New("cipherset: invalid policy")
+
+// Policy restricts and orders the cipher sets used by an endpoint.
+// A nil *Policy allows all registered cipher sets and prefers the highest
+// CSID (like SelectCSID).
+type Policy struct {
+	// Allowed lists the CSIDs which may be used. When empty all registered
+	// cipher sets are allowed.
+	Allowed []uint8
+
+	// Preferred lists CSIDs from most to least preferred. Allowed CSIDs which
+	// are not listed rank below the listed ones, highest CSID first.
+	Preferred []uint8
+}
+
+// Validate checks that p allows at least one registered cipher set and only
+// prefers allowed cipher sets.
+func (p *Policy) Validate() error {
+	if p == nil {
+		return nil
+	}
+
+	var registered bool
+	for csid := range ciphers {
+		if p.Allows(csid) {
+			registered = true
+			break
+		}
+	}
+	if !registered {
+		return ErrInvalidPolicy
+	}
+
+	for _, csid := range p.Preferred {
+		if !p.Allows(csid) {
+			return ErrInvalidPolicy
+		}
+	}
+
+	return nil
+}
+
+// Allows returns true when csid may be used.
+func (p *Policy) Allows(csid uint8) bool {
+	if p == nil || len(p.Allowed) == 0 {
+		return true
+	}
+
+	for _, allowed := range p.Allowed {
+		if allowed == csid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Filter returns the keys in keys which may be used.
+func (p *Policy) Filter(keys Keys) Keys {
+	if p == nil || len(p.Allowed) == 0 {
+		return keys
+	}
+
+	filtered := make(Keys, len(keys))
+	for csid, key := range keys {
+		if p.Allows(csid) {
+			filtered[csid] = key
+		}
+	}
+
+	return filtered
+}
+
+// SelectCSID returns the most preferred allowed CSID for which both a and b
+// have a key. It returns 0 when there is no such CSID.
+func (p *Policy) SelectCSID(a, b Keys) uint8 {
+	if p != nil {
+		for _, csid := range p.Preferred {
+			if a[csid] != nil && b[csid] != nil && p.Allows(csid) {
+				return csid
+			}
+		}
+	}
+
+	var max uint8
+	for csid := range a {
+		if _, f := b[csid]; f && csid > max && p.Allows(csid) {
+			max = csid
+		}
+	}
+	return max
+}
+
+// GenerateKeys generates a key for each registered cipher set which may be
+// used.
+func (p *Policy) GenerateKeys() (Keys, error) {
+	keys := make(Keys)
+
+	for csid, cipher := range ciphers {
+		if !p.Allows(csid) {
+			continue
+		}
+
+		key, err := cipher.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+
+		keys[csid] = key
+	}
+
+	return keys, nil
+}
@@ -2,6 +2,7 @@ package e3x
 
 import (
 	_ "github.com/telehash/gogotelehash/e3x/cipherset/cs1a"
-	// _ "github.com/telehash/gogotelehash/e3x/cipherset/cs2a"
+	_ "github.com/telehash/gogotelehash/e3x/cipherset/cs2a"
 	_ "github.com/telehash/gogotelehash/e3x/cipherset/cs3a"
+	_ "github.com/telehash/gogotelehash/e3x/cipherset/cs3b"
 )
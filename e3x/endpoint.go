@@ -1,14 +1,18 @@
 package e3x
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/telehash/gogotelehash/e3x/cipherset"
+	"github.com/telehash/gogotelehash/e3x/keyfile"
 	"github.com/telehash/gogotelehash/internal/hashname"
 	"github.com/telehash/gogotelehash/internal/util/bufpool"
 	"github.com/telehash/gogotelehash/internal/util/logs"
@@ -19,6 +23,10 @@ import (
 	"github.com/telehash/gogotelehash/transports/udp"
 )
 
+// ErrCipherSetRefused is reported (through EndpointHooks.DropPacket) for
+// handshakes which use a cipher set the endpoint policy does not allow.
+var ErrCipherSetRefused = errors.New("e3x: cipher set refused by policy")
+
 type endpointState uint8
 
 const (
@@ -50,6 +58,22 @@ type Endpoint struct {
 	tokens      map[cipherset.Token]*Exchange
 	hashnames   map[hashname.H]*Exchange
 	listenerSet *listenerSet
+	mux         *ChannelMux // see ChannelMux
+
+	rekeyInterval time.Duration
+	rekeyBytes    uint64
+	cipherSets    *cipherset.Policy
+
+	handshakeGuard *handshakeGuard
+
+	peerStore PeerStore
+	peers     map[hashname.H]*PeerRecord
+
+	exchangeTimeouts ExchangeTimeouts
+	channelTimeouts  ChannelTimeouts
+	peerTimeouts     map[hashname.H]peerTimeouts
+
+	draining bool // see Shutdown
 }
 
 type EndpointOption func(e *Endpoint) error
@@ -60,6 +84,12 @@ func Open(options ...EndpointOption) (*Endpoint, error) {
 		modules:   make(map[interface{}]Module),
 		tokens:    make(map[cipherset.Token]*Exchange),
 		hashnames: make(map[hashname.H]*Exchange),
+
+		rekeyInterval: defaultRekeyInterval,
+		rekeyBytes:    defaultRekeyBytes,
+
+		exchangeTimeouts: defaultExchangeTimeouts,
+		channelTimeouts:  defaultChannelTimeouts,
 	}
 
 	e.listenerSet = newListenerSet()
@@ -240,12 +270,53 @@ func Keys(keys cipherset.Keys) EndpointOption {
 	}
 }
 
+// KeyFile loads the keys from the key file at path (see package keyfile).
+// passphrase is called when the key file is encrypted.
+func KeyFile(path string, passphrase keyfile.PassphraseFunc) EndpointOption {
+	return func(e *Endpoint) error {
+		f, err := keyfile.Load(path, passphrase)
+		if err != nil {
+			return err
+		}
+
+		return Keys(cipherset.Keys(f.Keys))(e)
+	}
+}
+
+// CipherSets restricts the cipher sets used by the endpoint to policy. Keys
+// are only generated and advertised for allowed cipher sets, exchanges use the
+// most preferred cipher set both sides support and handshakes for other cipher
+// sets are dropped with ErrCipherSetRefused.
+//
+// The parts of disallowed keys passed with Keys are still advertised as the
+// hashname is derived from them.
+func CipherSets(policy cipherset.Policy) EndpointOption {
+	return func(e *Endpoint) error {
+		p := &cipherset.Policy{
+			Allowed:   append([]uint8(nil), policy.Allowed...),
+			Preferred: append([]uint8(nil), policy.Preferred...),
+		}
+
+		err := p.Validate()
+		if err != nil {
+			return err
+		}
+
+		e.cipherSets = p
+		return nil
+	}
+}
+
 func defaultRandomKeys(e *Endpoint) error {
 	if e.keys != nil && len(e.keys) > 0 {
+		// the keys must include at least one allowed cipher set
+		if len(e.usableKeys()) == 0 {
+			return ErrNoKeys
+		}
 		return nil
 	}
 
-	keys, err := cipherset.GenerateKeys()
+	keys, err := e.cipherSets.GenerateKeys()
 	if err != nil {
 		return err
 	}
@@ -285,6 +356,22 @@ func Transport(config transports.Config) EndpointOption {
 	}
 }
 
+// Rekey configures when exchanges replace their line keys. A new set of line
+// keys is negotiated after interval has passed or after bytes have been
+// transferred, whichever comes first. A zero value disables that threshold.
+// By default exchanges are rekeyed every hour or after 1GiB.
+func Rekey(interval time.Duration, bytes uint64) EndpointOption {
+	return func(e *Endpoint) error {
+		if interval < 0 {
+			return fmt.Errorf("e3x: invalid rekey interval %s", interval)
+		}
+
+		e.rekeyInterval = interval
+		e.rekeyBytes = bytes
+		return nil
+	}
+}
+
 func defaultTransport(e *Endpoint) error {
 	if e.transportConfig != nil {
 		return nil
@@ -299,8 +386,8 @@ func defaultTransport(e *Endpoint) error {
 }
 
 // Listen makes a new channel listener.
-func (e *Endpoint) Listen(typ string, reliable bool) *Listener {
-	return e.listenerSet.Listen(typ, reliable)
+func (e *Endpoint) Listen(typ string, reliable bool, options ...ListenerOption) *Listener {
+	return e.listenerSet.Listen(typ, reliable, options...)
 }
 
 func (e *Endpoint) LocalHashname() hashname.H {
@@ -308,7 +395,20 @@ func (e *Endpoint) LocalHashname() hashname.H {
 }
 
 func (e *Endpoint) LocalIdentity() (*Identity, error) {
-	return NewIdentity(e.keys, nil, e.transport.Addrs())
+	return NewIdentity(e.usableKeys(), hashname.PartsFromKeys(e.keys), e.transport.Addrs())
+}
+
+// usableKeys returns the allowed keys which can be used in handshakes. Public
+// keys (like the keys a key agent can't agree on) only contribute their parts
+// to the hashname.
+func (e *Endpoint) usableKeys() cipherset.Keys {
+	keys := make(cipherset.Keys, len(e.keys))
+	for csid, key := range e.cipherSets.Filter(e.keys) {
+		if key.CanSign() {
+			keys[csid] = key
+		}
+	}
+	return keys
 }
 
 func (e *Endpoint) start() error {
@@ -402,10 +502,11 @@ func (e *Endpoint) acceptConnections() {
 
 func (e *Endpoint) accept(conn net.Conn) {
 	var (
-		token cipherset.Token
-		msg   = bufpool.New()
-		err   error
-		n     int
+		token  cipherset.Token
+		msg    = bufpool.New()
+		cookie []byte
+		err    error
+		n      int
 	)
 	n, err = conn.Read(msg.RawBytes()[:1500])
 	if err != nil {
@@ -428,6 +529,19 @@ func (e *Endpoint) accept(conn net.Conn) {
 		return // to short
 	}
 
+	if isCookieHandshake(msg.RawBytes()) {
+		cookie = stripCookie(msg)
+	}
+
+	if raw := msg.RawBytes(); len(raw) >= 3 && raw[0] == 0 && raw[1] == 1 && !e.cipherSets.Allows(raw[2]) {
+		if e.endpointHooks.DropPacket(msg.Get(nil), conn, ErrCipherSetRefused) != ErrStopPropagation {
+			conn.Close()
+		}
+		e.traceDroppedPacket(msg.Get(nil), conn, ErrCipherSetRefused.Error())
+		msg.Free()
+		return // cipher set is not allowed
+	}
+
 	token = cipherset.ExtractToken(msg.RawBytes())
 	e.mtx.Lock()
 	exchange := e.tokens[token]
@@ -456,9 +570,21 @@ func (e *Endpoint) accept(conn net.Conn) {
 		return // drop
 	}
 
+	// protect the expensive handshake decryption
+	if err = e.handshakeGuard.admit(conn.RemoteAddr(), msg.RawBytes()[2], cookie); err != nil {
+		if err == ErrHandshakeChallenged {
+			e.handshakeGuard.challenge(conn, msg.RawBytes()[2])
+		}
+		if e.endpointHooks.DropPacket(msg.Get(nil), conn, err) != ErrStopPropagation {
+			conn.Close()
+		}
+		e.traceDroppedPacket(msg.Get(nil), conn, err.Error())
+		msg.Free()
+		return // drop
+	}
+
 	// handle handshakes
 	e.mtx.Lock()
-	defer e.mtx.Unlock()
 
 	var (
 		csid = msg.RawBytes()[2]
@@ -468,6 +594,7 @@ func (e *Endpoint) accept(conn net.Conn) {
 		if e.endpointHooks.DropPacket(msg.Get(nil), conn, nil) != ErrStopPropagation {
 			conn.Close()
 		}
+		e.mtx.Unlock()
 		msg.Free()
 		return // no key for csid
 	}
@@ -478,6 +605,7 @@ func (e *Endpoint) accept(conn net.Conn) {
 			conn.Close()
 		}
 		e.traceDroppedPacket(msg.Get(nil), conn, err.Error())
+		e.mtx.Unlock()
 		msg.Free()
 		return // drop
 	}
@@ -489,37 +617,50 @@ func (e *Endpoint) accept(conn net.Conn) {
 			conn.Close()
 		}
 		e.traceDroppedPacket(msg.Get(nil), conn, err.Error())
+		e.mtx.Unlock()
 		msg.Free()
 		return // drop
 	}
 
+	// the exchange registers its new tokens when the handshake is applied
 	exchange = e.hashnames[hn]
 	if exchange != nil {
-		oldLocalToken := exchange.LocalToken()
-		oldRemoteToken := exchange.RemoteToken()
+		e.mtx.Unlock()
 		exchange.received(newMessage(msg, newPipe(e.transport, conn, nil, exchange)))
-		newLocalToken := exchange.LocalToken()
-		newRemoteToken := exchange.RemoteToken()
-
-		if oldLocalToken != newLocalToken {
-			delete(e.tokens, oldLocalToken)
-			e.tokens[newLocalToken] = exchange
-		}
+		return
+	}
+	e.mtx.Unlock()
 
-		if oldRemoteToken != newRemoteToken {
-			delete(e.tokens, oldRemoteToken)
-			e.tokens[newRemoteToken] = exchange
+	err = e.admitHandshake(handshake, conn)
+	if err != nil {
+		if e.endpointHooks.DropPacket(msg.Get(nil), conn, err) != ErrStopPropagation {
+			conn.Close()
 		}
+		e.traceDroppedPacket(msg.Get(nil), conn, err.Error())
+		msg.Free()
+		return // drop (rejected)
+	}
 
+	e.mtx.Lock()
+	exchange = e.hashnames[hn]
+	if exchange != nil {
+		e.mtx.Unlock()
+		exchange.received(newMessage(msg, newPipe(e.transport, conn, nil, exchange)))
 		return
 	}
 
-	exchange, err = newExchange(localIdent, nil, handshake, e.log, registerEndpoint(e))
+	if e.draining {
+		err = ErrShuttingDown
+	} else {
+		exchange, err = newExchange(localIdent, nil, handshake, e.log,
+			append([]ExchangeOption{registerEndpoint(e)}, e.peerOptions(hn)...)...)
+	}
 	if err != nil {
 		if e.endpointHooks.DropPacket(msg.Get(nil), conn, err) != ErrStopPropagation {
 			conn.Close()
 		}
 		e.traceDroppedPacket(msg.Get(nil), conn, err.Error())
+		e.mtx.Unlock()
 		msg.Free()
 		return // drop
 	}
@@ -528,9 +669,53 @@ func (e *Endpoint) accept(conn net.Conn) {
 	e.tokens[exchange.LocalToken()] = exchange
 	e.tokens[exchange.RemoteToken()] = exchange
 	exchange.state = ExchangeDialing
+	e.mtx.Unlock()
+
 	exchange.received(newMessage(msg, newPipe(e.transport, conn, nil, exchange)))
 }
 
+// admitHandshake asks the OnAcceptHandshake hooks whether the handshake of an
+// unknown peer may open an exchange.
+func (e *Endpoint) admitHandshake(handshake cipherset.Handshake, conn net.Conn) error {
+	var (
+		csid  = handshake.CSID()
+		parts = make(cipherset.Parts, len(handshake.Parts()))
+	)
+
+	for id, part := range handshake.Parts() {
+		parts[id] = part
+	}
+
+	ident, err := NewIdentity(
+		cipherset.Keys{csid: handshake.PublicKey()},
+		parts,
+		[]net.Addr{conn.RemoteAddr()})
+	if err != nil {
+		return err
+	}
+
+	// the pipe is only used to describe the source; it does not read from conn
+	pipe := &Pipe{transport: e.transport, conn: conn, raddr: conn.RemoteAddr()}
+
+	return e.endpointHooks.AcceptHandshake(handshake, ident, pipe)
+}
+
+// updateTokens replaces the tokens of x in the token table.
+func (e *Endpoint) updateTokens(x *Exchange, oldTokens, tokens []cipherset.Token) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	for _, token := range oldTokens {
+		if e.tokens[token] == x {
+			delete(e.tokens, token)
+		}
+	}
+
+	for _, token := range tokens {
+		e.tokens[token] = x
+	}
+}
+
 func (e *Endpoint) onExchangeClosed(_ *Endpoint, x *Exchange, reason error) error {
 	e.mtx.Lock()
 	defer e.mtx.Unlock()
@@ -539,8 +724,15 @@ func (e *Endpoint) onExchangeClosed(_ *Endpoint, x *Exchange, reason error) erro
 		delete(e.hashnames, x.remoteIdent.Hashname())
 	}
 
-	delete(e.tokens, x.LocalToken())
-	delete(e.tokens, x.RemoteToken())
+	x.mtx.Lock()
+	tokens := x.tokens()
+	x.mtx.Unlock()
+
+	for _, token := range tokens {
+		if e.tokens[token] == x {
+			delete(e.tokens, token)
+		}
+	}
 
 	return nil
 }
@@ -682,10 +874,20 @@ func (e *Endpoint) Identify(i Identifier) (*Identity, error) {
 // Dial will lookup the identity of identifier, get the exchange for the identity
 // and dial the exchange.
 func (e *Endpoint) Dial(identifier Identifier) (*Exchange, error) {
+	return e.DialContext(context.Background(), identifier)
+}
+
+// DialContext is like Dial but gives up when ctx is done before the handshake
+// completes.
+func (e *Endpoint) DialContext(ctx context.Context, identifier Identifier) (*Exchange, error) {
 	if identifier == nil || e == nil {
 		return nil, os.ErrInvalid
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	var (
 		identity *Identity
 		x        *Exchange
@@ -702,7 +904,7 @@ func (e *Endpoint) Dial(identifier Identifier) (*Exchange, error) {
 		return nil, err
 	}
 
-	err = x.Dial()
+	err = x.DialContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -741,6 +943,10 @@ func (e *Endpoint) CreateExchange(identity *Identity) (*Exchange, error) {
 		return x, nil
 	}
 
+	if e.draining {
+		return nil, ErrShuttingDown
+	}
+
 	var (
 		localIdent *Identity
 		x          *Exchange
@@ -755,11 +961,14 @@ func (e *Endpoint) CreateExchange(identity *Identity) (*Exchange, error) {
 	}
 
 	// Make a new exchange struct
-	x, err = newExchange(localIdent, identity, nil, e.log, registerEndpoint(e))
+	x, err = newExchange(localIdent, identity, nil, e.log,
+		append([]ExchangeOption{registerEndpoint(e)}, e.peerOptions(identity.hashname)...)...)
 	if err != nil {
 		return nil, err
 	}
 
+	e.restorePeerLatency(x)
+
 	// register the new exchange
 	e.tokens[x.LocalToken()] = x
 	e.hashnames[identity.hashname] = x
@@ -0,0 +1,193 @@
+package e3x
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/telehash/gogotelehash/e3x/cipherset"
+	"github.com/telehash/gogotelehash/internal/hashname"
+)
+
+const (
+	modAllowFileKey = pivateModKey("allowfile")
+	modDenyFileKey  = pivateModKey("denyfile")
+
+	peerListReloadInterval = 1 * time.Second
+)
+
+// ErrHandshakeRejected is the reason used when a handshake is refused by an
+// allowlist or denylist.
+var ErrHandshakeRejected = errors.New("e3x: handshake rejected")
+
+var (
+	_ Module = (*modPeerList)(nil)
+)
+
+// AllowFile only accepts handshakes from the hashnames listed in the file at
+// path. The file lists one hashname per line; empty lines and lines starting
+// with # are ignored. The file is reloaded when it changes and exchanges with
+// peers which are no longer allowed are closed.
+func AllowFile(path string) EndpointOption {
+	return peerListFile(modAllowFileKey, path, false)
+}
+
+// DenyFile refuses handshakes from the hashnames listed in the file at path.
+// The file uses the same format as AllowFile and is reloaded when it changes.
+func DenyFile(path string) EndpointOption {
+	return peerListFile(modDenyFileKey, path, true)
+}
+
+func peerListFile(key pivateModKey, path string, deny bool) EndpointOption {
+	return func(e *Endpoint) error {
+		mod := &modPeerList{endpoint: e, path: path, deny: deny}
+
+		err := mod.load()
+		if err != nil {
+			return err
+		}
+
+		e.endpointHooks.Register(EndpointHook{OnAcceptHandshake: mod.onAcceptHandshake})
+		return RegisterModule(key, mod)(e)
+	}
+}
+
+type modPeerList struct {
+	endpoint *Endpoint
+	path     string
+	deny     bool
+
+	mtx       sync.RWMutex
+	timer     *time.Timer
+	stopped   bool
+	modTime   time.Time
+	hashnames map[hashname.H]bool
+}
+
+func (mod *modPeerList) Init() error {
+	return nil
+}
+
+func (mod *modPeerList) Start() error {
+	mod.mtx.Lock()
+	mod.timer = time.AfterFunc(peerListReloadInterval, mod.reload)
+	mod.mtx.Unlock()
+	return nil
+}
+
+func (mod *modPeerList) Stop() error {
+	mod.mtx.Lock()
+	mod.stopped = true
+	if mod.timer != nil {
+		mod.timer.Stop()
+	}
+	mod.mtx.Unlock()
+	return nil
+}
+
+// admits returns true when handshakes from hn are accepted.
+func (mod *modPeerList) admits(hn hashname.H) bool {
+	mod.mtx.RLock()
+	listed := mod.hashnames[hn]
+	mod.mtx.RUnlock()
+
+	return listed != mod.deny
+}
+
+func (mod *modPeerList) onAcceptHandshake(e *Endpoint, handshake cipherset.Handshake, ident *Identity, pipe *Pipe) error {
+	if !mod.admits(ident.Hashname()) {
+		return ErrHandshakeRejected
+	}
+	return nil
+}
+
+func (mod *modPeerList) reload() {
+	defer func() {
+		mod.mtx.Lock()
+		if !mod.stopped {
+			mod.timer.Reset(peerListReloadInterval)
+		}
+		mod.mtx.Unlock()
+	}()
+
+	fi, err := os.Stat(mod.path)
+	if err != nil {
+		mod.endpoint.log.Printf("failed to reload %s: %s", mod.path, err)
+		return
+	}
+
+	mod.mtx.RLock()
+	changed := !fi.ModTime().Equal(mod.modTime)
+	mod.mtx.RUnlock()
+	if !changed {
+		return
+	}
+
+	err = mod.load()
+	if err != nil {
+		mod.endpoint.log.Printf("failed to reload %s: %s", mod.path, err)
+		return
+	}
+
+	var refused []*Exchange
+	mod.endpoint.mtx.Lock()
+	for hn, x := range mod.endpoint.hashnames {
+		if !mod.admits(hn) {
+			refused = append(refused, x)
+		}
+	}
+	mod.endpoint.mtx.Unlock()
+
+	for _, x := range refused {
+		x.Close(ErrHandshakeRejected)
+	}
+}
+
+func (mod *modPeerList) load() error {
+	f, err := os.Open(mod.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var (
+		hashnames = make(map[hashname.H]bool)
+		scanner   = bufio.NewScanner(f)
+		lineno    int
+	)
+
+	for scanner.Scan() {
+		lineno++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		hn := hashname.H(line)
+		if !hn.Valid() {
+			return fmt.Errorf("e3x: invalid hashname at %s:%d", mod.path, lineno)
+		}
+
+		hashnames[hn] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	mod.mtx.Lock()
+	mod.hashnames = hashnames
+	mod.modTime = fi.ModTime()
+	mod.mtx.Unlock()
+
+	return nil
+}
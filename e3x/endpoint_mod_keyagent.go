@@ -0,0 +1,63 @@
+package e3x
+
+import (
+	"errors"
+
+	"github.com/telehash/gogotelehash/e3x/keyagent"
+)
+
+// ErrKeyAgentWithKeys is returned by Open when KeyAgent is combined with an
+// option which already set the keys (like Keys or KeyFile).
+var ErrKeyAgentWithKeys = errors.New("e3x: KeyAgent cannot be combined with Keys")
+
+const modKeyAgentKey = pivateModKey("keyagent")
+
+var (
+	_ Module = (*modKeyAgent)(nil)
+)
+
+// KeyAgent uses the keys held by the key agent listening on the unix socket at
+// path (see package keyagent). The private keys never enter the endpoint
+// process; only cipher sets 1a and 3a can be used with agent keys. The other
+// keys of the key file still make up the hashname.
+// KeyAgent fails with ErrKeyAgentWithKeys when the keys were already set.
+func KeyAgent(path string) EndpointOption {
+	return func(e *Endpoint) error {
+		if e.keys != nil && len(e.keys) > 0 {
+			return ErrKeyAgentWithKeys
+		}
+
+		agent, err := keyagent.Dial(path)
+		if err != nil {
+			return err
+		}
+
+		keys, err := agent.Keys()
+		if err != nil {
+			agent.Close()
+			return err
+		}
+
+		err = e.setOptions(
+			Keys(keys),
+			RegisterModule(modKeyAgentKey, &modKeyAgent{agent}))
+		if err != nil {
+			agent.Close()
+			return err
+		}
+
+		return nil
+	}
+}
+
+// modKeyAgent closes the agent connection when the endpoint is closed.
+type modKeyAgent struct {
+	agent *keyagent.Agent
+}
+
+func (mod *modKeyAgent) Init() error  { return nil }
+func (mod *modKeyAgent) Start() error { return nil }
+
+func (mod *modKeyAgent) Stop() error {
+	return mod.agent.Close()
+}
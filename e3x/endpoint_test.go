@@ -1,12 +1,22 @@
 package e3x
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/telehash/gogotelehash/Godeps/_workspace/src/github.com/stretchr/testify/assert"
 
 	"github.com/telehash/gogotelehash/e3x/cipherset"
+	"github.com/telehash/gogotelehash/e3x/keyagent"
+	"github.com/telehash/gogotelehash/e3x/keyfile"
+	"github.com/telehash/gogotelehash/internal/lob"
 	"github.com/telehash/gogotelehash/internal/util/logs"
 	"github.com/telehash/gogotelehash/transports/inproc"
 	"github.com/telehash/gogotelehash/transports/mux"
@@ -66,3 +76,692 @@ func TestSimpleEndpoint(t *testing.T) {
 	err = eb.Close()
 	assert.NoError(err)
 }
+
+func TestKeyAgent(t *testing.T) {
+	logs.ResetLogger()
+
+	assert := assert.New(t)
+
+	keys, err := cipherset.GenerateKeys(0x1a, 0x2a, 0x3a, 0x3b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "e3x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := keyfile.New(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := f.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "keys.json"), data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent, err := keyagent.NewServer(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go agent.Serve(l)
+
+	A, err := Open(Transport(inproc.Config{}), KeyAgent(filepath.Join(dir, "agent.sock")), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	for _, key := range A.keys {
+		assert.Nil(key.Private())
+	}
+
+	// the agent endpoint has the hashname of the key file
+	K, err := Open(Transport(inproc.Config{}), KeyFile(filepath.Join(dir, "keys.json"), nil), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer K.Close()
+	assert.Equal(K.LocalHashname(), A.LocalHashname())
+
+	identA, err := A.LocalIdentity()
+	if assert.NoError(err) {
+		assert.Equal(K.LocalHashname(), identA.Hashname())
+		assert.Nil(identA.Keys()[0x2a])
+		assert.Nil(identA.Keys()[0x3b])
+	}
+
+	go func() {
+		c, err := A.Listen("ping", false).AcceptChannel()
+		if !assert.NoError(err) {
+			return
+		}
+		defer c.Close()
+
+		pkt, err := c.ReadPacket()
+		if assert.NoError(err) {
+			assert.Equal("ping", string(pkt.Body(nil)))
+			assert.NoError(c.WritePacket(lob.New([]byte("pong"))))
+		}
+	}()
+
+	ident, err := A.LocalIdentity()
+	assert.NoError(err)
+
+	c, err := B.Open(ident, "ping", false)
+	if !assert.NoError(err) {
+		return
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	assert.NoError(c.WritePacket(lob.New([]byte("ping"))))
+
+	pkt, err := c.ReadPacket()
+	if assert.NoError(err) {
+		assert.Equal("pong", string(pkt.Body(nil)))
+	}
+
+	// the agent keys can not replace keys which were already set
+	_, err = Open(Transport(inproc.Config{}), Keys(keys), KeyAgent(filepath.Join(dir, "agent.sock")), Log(nil))
+	assert.Equal(ErrKeyAgentWithKeys, err)
+}
+
+func TestCipherSetPolicy(t *testing.T) {
+	logs.ResetLogger()
+
+	assert := assert.New(t)
+
+	_, err := Open(CipherSets(cipherset.Policy{Allowed: []uint8{0xff}}))
+	assert.Equal(cipherset.ErrInvalidPolicy, err)
+
+	_, err = Open(CipherSets(cipherset.Policy{Allowed: []uint8{0x3a}, Preferred: []uint8{0x1a}}))
+	assert.Equal(cipherset.ErrInvalidPolicy, err)
+
+	keys, err := cipherset.GenerateKeys(0x1a, 0x3a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(Keys(cipherset.Keys{0x1a: keys[0x1a]}), CipherSets(cipherset.Policy{Allowed: []uint8{0x3a}}))
+	assert.Equal(ErrNoKeys, err)
+
+	A, err := Open(Transport(inproc.Config{}), Log(nil),
+		CipherSets(cipherset.Policy{Allowed: []uint8{0x1a, 0x3a}, Preferred: []uint8{0x1a}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	C, err := Open(Transport(inproc.Config{}), Log(nil), Keys(keys),
+		CipherSets(cipherset.Policy{Allowed: []uint8{0x3a}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer C.Close()
+
+	// only allowed keys are generated and advertised
+	assert.Len(A.keys, 2)
+	identA, err := A.LocalIdentity()
+	assert.NoError(err)
+	assert.Len(identA.keys, 2)
+
+	identC, err := C.LocalIdentity()
+	assert.NoError(err)
+	assert.Len(identC.keys, 1)
+	assert.Len(identC.parts, 2)
+	assert.Equal(C.LocalHashname(), identC.Hashname())
+
+	// B prefers the highest shared cipher set, A prefers 1a
+	x, err := B.Dial(identA)
+	if assert.NoError(err) {
+		assert.Equal(uint8(0x3a), x.csid)
+	}
+
+	D, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer D.Close()
+
+	identD, err := D.LocalIdentity()
+	assert.NoError(err)
+
+	x, err = A.Dial(identD)
+	if assert.NoError(err) {
+		assert.Equal(uint8(0x1a), x.csid)
+	}
+
+	// C drops handshakes for 1a
+	refused := make(chan error, 1)
+	C.Hooks().Register(EndpointHook{OnDropPacket: func(e *Endpoint, msg []byte, conn net.Conn, reason error) error {
+		select {
+		case refused <- reason:
+		default:
+		}
+		return nil
+	}})
+
+	identC, err = NewIdentity(cipherset.Keys{0x1a: keys[0x1a]}, identC.parts, identC.addrs)
+	if !assert.NoError(err) {
+		return
+	}
+
+	go A.Dial(identC)
+
+	select {
+	case reason := <-refused:
+		assert.Equal(ErrCipherSetRefused, reason)
+	case <-time.After(10 * time.Second):
+		t.Fatal("handshake was not refused")
+	}
+}
+
+func TestAcceptHandshakeHook(t *testing.T) {
+	logs.ResetLogger()
+
+	var (
+		assert    = assert.New(t)
+		errDenied = errors.New("denied")
+		dropped   = make(chan error, 10)
+	)
+
+	A, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	var seen *Identity
+	B.Hooks().Register(EndpointHook{
+		OnAcceptHandshake: func(e *Endpoint, handshake cipherset.Handshake, ident *Identity, pipe *Pipe) error {
+			seen = ident
+			assert.NotNil(pipe.RemoteAddr())
+			return errDenied
+		},
+		OnDropPacket: func(e *Endpoint, msg []byte, conn net.Conn, reason error) error {
+			dropped <- reason
+			return nil
+		},
+	})
+
+	identB, err := B.LocalIdentity()
+	assert.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	_, err = A.DialContext(ctx, identB)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.Equal(errDenied, <-dropped)
+	if assert.NotNil(seen) {
+		assert.Equal(A.LocalHashname(), seen.Hashname())
+	}
+	assert.Nil(B.GetExchange(A.LocalHashname()))
+}
+
+func TestAllowFile(t *testing.T) {
+	logs.ResetLogger()
+
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "e3x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	A, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	C, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer C.Close()
+
+	path := filepath.Join(dir, "allow")
+	err = ioutil.WriteFile(path, []byte("# peers\n\n"+string(A.LocalHashname())+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "invalid"), []byte("not-a-hashname\n"), 0600))
+	_, err = Open(AllowFile(filepath.Join(dir, "invalid")))
+	assert.Error(err)
+
+	_, err = Open(AllowFile(filepath.Join(dir, "missing")))
+	assert.Error(err)
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil), AllowFile(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	identB, err := B.LocalIdentity()
+	assert.NoError(err)
+
+	_, err = A.Dial(identB)
+	if !assert.NoError(err) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = C.DialContext(ctx, identB)
+	assert.Equal(context.DeadlineExceeded, err)
+
+	// removing A from the list closes its exchange
+	assert.NoError(ioutil.WriteFile(path, []byte(string(C.LocalHashname())+"\n"), 0600))
+	future := time.Now().Add(time.Hour)
+	assert.NoError(os.Chtimes(path, future, future))
+
+	for i := 0; i < 50 && B.GetExchange(A.LocalHashname()) != nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Nil(B.GetExchange(A.LocalHashname()))
+
+	_, err = C.Dial(identB)
+	assert.NoError(err)
+}
+
+func TestHandshakeCookies(t *testing.T) {
+	logs.ResetLogger()
+
+	assert := assert.New(t)
+
+	A, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil),
+		LimitHandshakes(HandshakeLimits{CookieThreshold: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	// pretend B is under load
+	B.handshakeGuard.mtx.Lock()
+	B.handshakeGuard.window = time.Now().Add(time.Hour)
+	B.handshakeGuard.windowCount = 1
+	B.handshakeGuard.mtx.Unlock()
+
+	challenged := statHandshakeChallenged.Value()
+
+	identB, err := B.LocalIdentity()
+	assert.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = A.DialContext(ctx, identB)
+	assert.NoError(err)
+	assert.True(statHandshakeChallenged.Value() > challenged)
+	assert.NotNil(B.GetExchange(A.LocalHashname()))
+}
+
+func TestHandshakeGuard(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		addrA = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+		addrB = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 4000}
+		addrC = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	)
+
+	e := &Endpoint{}
+	assert.Error(LimitHandshakes(HandshakeLimits{SourceRate: -1})(e))
+	assert.NoError(LimitHandshakes(HandshakeLimits{SourceRate: 1, SourceBurst: 2})(e))
+	g := e.handshakeGuard
+
+	// per source token buckets
+	assert.NoError(g.admit(addrA, 0x3a, nil))
+	assert.NoError(g.admit(addrC, 0x3a, nil))
+	assert.Equal(ErrHandshakeRateLimited, g.admit(addrA, 0x3a, nil))
+	assert.NoError(g.admit(addrB, 0x3a, nil))
+
+	// cookies are bound to the source host, the csid and a time window
+	now := time.Now()
+	cookie := g.makeCookie(addrA, 0x3a, now)
+	assert.True(g.verifyCookie(cookie, addrA, 0x3a, now))
+	assert.True(g.verifyCookie(cookie, addrC, 0x3a, now))
+	assert.False(g.verifyCookie(cookie, addrB, 0x3a, now))
+	assert.False(g.verifyCookie(cookie, addrA, 0x1a, now))
+	assert.False(g.verifyCookie(cookie, addrA, 0x3a, now.Add(time.Minute)))
+	cookie[len(cookie)-1] ^= 1
+	assert.False(g.verifyCookie(cookie, addrA, 0x3a, now))
+}
+
+func TestHandshakeCookieFallback(t *testing.T) {
+	assert := assert.New(t)
+
+	e := &Endpoint{}
+	assert.NoError(LimitHandshakes(HandshakeLimits{CookieThreshold: 2})(e))
+	g := e.handshakeGuard
+
+	now := time.Now()
+	g.window = now
+
+	// a source which doesn't answer its challenge is rate limited instead
+	assert.False(g.fallback("10.0.0.1", now))
+	assert.False(g.fallback("10.0.0.1", now.Add(time.Second)))
+	assert.True(g.fallback("10.0.0.1", now.Add(cookieFallbackDelay)))
+	assert.False(g.fallback("10.0.0.1", now.Add(cookieFallbackDelay+100*time.Millisecond)))
+
+	// at most CookieThreshold fallback handshakes per second
+	assert.False(g.fallback("10.0.0.2", now))
+	assert.False(g.fallback("10.0.0.3", now))
+	assert.True(g.fallback("10.0.0.2", now.Add(cookieFallbackDelay)))
+	assert.False(g.fallback("10.0.0.3", now.Add(cookieFallbackDelay)))
+	g.windowFallback = 0
+	assert.True(g.fallback("10.0.0.3", now.Add(cookieFallbackDelay)))
+	assert.True(g.fallback("10.0.0.1", now.Add(cookieFallbackDelay+time.Second)))
+}
+
+func TestPeerStore(t *testing.T) {
+	logs.ResetLogger()
+
+	dir, err := ioutil.TempDir("", "e3x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]func() PeerStore{
+		"memory": func() func() PeerStore {
+			store := NewMemoryPeerStore()
+			return func() PeerStore { return store }
+		}(),
+		"file": func() PeerStore {
+			return NewFilePeerStore(filepath.Join(dir, "peers.json"))
+		},
+	}
+
+	for name, newStore := range stores {
+		assert := assert.New(t)
+
+		keys, err := cipherset.GenerateKeys(0x3a)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		B, err := Open(Transport(inproc.Config{}), Log(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		A, err := Open(Transport(inproc.Config{}), Log(nil), Keys(keys), Peers(newStore()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		identB, err := B.LocalIdentity()
+		assert.NoError(err)
+
+		_, err = A.Dial(HashnameIdentifier(B.LocalHashname()))
+		assert.Equal(ErrUnidentifiable, err, name)
+
+		_, err = A.Dial(identB)
+		assert.NoError(err, name)
+		A.Close()
+
+		// a restarted endpoint can dial B by its hashname
+		A, err = Open(Transport(inproc.Config{}), Log(nil), Keys(keys), Peers(newStore()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ident, err := A.Identify(HashnameIdentifier(B.LocalHashname()))
+		if assert.NoError(err, name) {
+			assert.Equal(B.LocalHashname(), ident.Hashname())
+			assert.NotEmpty(ident.Addresses(), name)
+		}
+
+		_, err = A.Dial(HashnameIdentifier(B.LocalHashname()))
+		assert.NoError(err, name)
+
+		A.Close()
+		B.Close()
+	}
+}
+
+func TestPeerStoreLatency(t *testing.T) {
+	logs.ResetLogger()
+
+	assert := assert.New(t)
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	identB, err := B.LocalIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemoryPeerStore()
+	assert.NoError(store.Save(&PeerRecord{Identity: identB, Latency: 300 * time.Millisecond}))
+
+	A, err := Open(Transport(inproc.Config{}), Log(nil), Peers(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	ident, err := A.Identify(HashnameIdentifier(B.LocalHashname()))
+	if !assert.NoError(err) {
+		return
+	}
+
+	x, err := A.CreateExchange(ident)
+	if !assert.NoError(err) {
+		return
+	}
+
+	addrs, latency := x.addressBook.WorkingAddresses()
+	assert.NotEmpty(addrs)
+	assert.Equal(300*time.Millisecond, latency)
+}
+
+func TestFilePeerStoreSkipsBadRecords(t *testing.T) {
+	logs.ResetLogger()
+
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "e3x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	identB, err := B.LocalIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good, err := json.Marshal(&PeerRecord{Identity: identB})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bad := []byte(`{"identity":{"hashname":"x","paths":[{"type":"carrier-pigeon"}]}}`)
+	data := []byte("[" + string(bad) + "," + string(good) + "]")
+
+	path := filepath.Join(dir, "peers.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := NewFilePeerStore(path).Load()
+	if assert.NoError(err) && assert.Len(records, 1) {
+		assert.Equal(B.LocalHashname(), records[0].Identity.Hashname())
+	}
+
+	A, err := Open(Transport(inproc.Config{}), Log(nil), Peers(NewFilePeerStore(path)))
+	if assert.NoError(err) {
+		A.Close()
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	logs.ResetLogger()
+
+	assert := assert.New(t)
+
+	A, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := A.Listen("stream", true)
+	defer l.Close()
+
+	received := make(chan int, 1)
+	go func() {
+		c, err := l.AcceptChannel()
+		if err != nil {
+			received <- -1
+			return
+		}
+		n := 0
+		if _, err := c.ReadPacket(); err == nil {
+			n++
+			c.WritePacket(lob.New([]byte("welcome")))
+		}
+		for {
+			_, err := c.ReadPacket()
+			if err != nil {
+				break
+			}
+			n++
+		}
+		received <- n
+	}()
+
+	identA, err := A.LocalIdentity()
+	assert.NoError(err)
+
+	c, err := B.Open(identA, "stream", true)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(c.WritePacket(lob.New([]byte("hello"))))
+	_, err = c.ReadPacket()
+	assert.NoError(err)
+	for i := 1; i < 10; i++ {
+		assert.NoError(c.WritePacket(lob.New([]byte("hello"))))
+	}
+
+	// all packets and the end are delivered before B is closed
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(B.Shutdown(ctx))
+	assert.Equal(10, <-received)
+	assert.Equal(0, B.Stats().Channels)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	logs.ResetLogger()
+
+	assert := assert.New(t)
+
+	A, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	A.Listen("stream", true)
+
+	identA, err := A.LocalIdentity()
+	assert.NoError(err)
+
+	x, err := B.Dial(identA)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// A is gone; the channel can never be flushed
+	A.Close()
+	c, err := x.Open("stream", true)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(c.WritePacket(lob.New([]byte("hello"))))
+
+	done := make(chan error, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go func() { done <- B.Shutdown(ctx) }()
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = x.Open("stream", true)
+	assert.Equal(ErrShuttingDown, err)
+
+	C, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer C.Close()
+	identC, err := C.LocalIdentity()
+	assert.NoError(err)
+	_, err = B.Dial(identC)
+	assert.Equal(ErrShuttingDown, err)
+
+	assert.Equal(context.DeadlineExceeded, <-done)
+}
@@ -1,6 +1,7 @@
 package e3x
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -20,6 +21,27 @@ import (
 
 var ErrInvalidHandshake = errors.New("e3x: invalid handshake")
 
+// ErrExchangeClosed is the reason used by (*Exchange).Close when no reason is
+// given and the error returned when the exchange was already closed.
+var ErrExchangeClosed = errors.New("e3x: exchange closed")
+
+var (
+	// ErrPayloadTooLarge is returned by OpenWithPayload when the payload does
+	// not fit in the initial packet.
+	ErrPayloadTooLarge = errors.New("e3x: payload too large")
+
+	// ErrReservedHeader is returned by OpenWithPayload when a header is one of
+	// the channel headers (c, type, seq, ack, miss and end).
+	ErrReservedHeader = errors.New("e3x: reserved header")
+)
+
+const (
+	defaultRekeyInterval = 1 * time.Hour
+	defaultRekeyBytes    = 1 << 30
+	rekeyOverlap         = 1 * time.Minute
+	cMaxOpenPayload      = cMessageFragmentSize
+)
+
 type BrokenExchangeError hashname.H
 
 func (err BrokenExchangeError) Error() string {
@@ -66,23 +88,38 @@ func (s ExchangeState) String() string {
 }
 
 type Exchange struct {
+	// counters is updated with 64-bit atomic operations and must stay the
+	// first field to be 64-bit aligned on 32-bit platforms.
+	counters exchangeCounters
+
 	TID tracer.ID
 
 	mtx      sync.Mutex
 	cndState *sync.Cond
 
-	state         ExchangeState
-	lastLocalSeq  uint32
-	lastRemoteSeq uint32
-	nextSeq       uint32
-	localIdent    *Identity
-	remoteIdent   *Identity
-	csid          uint8
-	cipher        cipherset.State
-	nextChannelID uint32
-	channels      *channelSet
-	addressBook   *addressBook
-	err           error
+	state           ExchangeState
+	lastLocalSeq    uint32
+	lastRemoteSeq   uint32
+	nextSeq         uint32
+	localIdent      *Identity
+	remoteIdent     *Identity
+	csid            uint8
+	cipherSets      *cipherset.Policy
+	cipher          cipherset.State
+	nextCipher      cipherset.State // pending locally initiated rekey
+	prevCipher      cipherset.State // replaced by a rekey; only used for decryption
+	rekeyInterval   time.Duration
+	rekeyBytes      uint64
+	bytesSinceKey   uint64
+	timeouts        ExchangeTimeouts
+	channelTimeouts ChannelTimeouts
+	nextChannelID   uint32
+	dialers         int  // number of DialContext calls waiting for the handshake
+	draining        bool // see Endpoint.Shutdown
+	lastCookieReply time.Time
+	channels        *channelSet
+	addressBook     *addressBook
+	err             error
 
 	endpoint      endpointI
 	listenerSet   *listenerSet
@@ -94,6 +131,8 @@ type Exchange struct {
 	tExpire           *time.Timer
 	tBreak            *time.Timer
 	tDeliverHandshake *time.Timer
+	tRekey            *time.Timer
+	tDropPrevCipher   *time.Timer
 }
 
 type ExchangeOption func(e *Exchange) error
@@ -121,10 +160,25 @@ func newExchange(
 	x.tBreak = time.AfterFunc(2*60*time.Second, x.onBreak)
 	x.tExpire = time.AfterFunc(60*time.Second, x.onExpire)
 	x.tDeliverHandshake = time.AfterFunc(60*time.Second, x.onDeliverHandshake)
-	x.resetExpire()
+	x.tRekey = time.AfterFunc(defaultRekeyInterval, x.onRekey)
+	x.tDropPrevCipher = time.AfterFunc(rekeyOverlap, x.onDropPrevCipher)
+	x.tRekey.Stop()
+	x.tDropPrevCipher.Stop()
+	x.rekeyInterval = defaultRekeyInterval
+	x.rekeyBytes = defaultRekeyBytes
+	x.timeouts = defaultExchangeTimeouts
+	x.channelTimeouts = defaultChannelTimeouts
 	x.rescheduleHandshake()
 
-	x.setOptions(options...)
+	err := x.setOptions(options...)
+	if err != nil {
+		x.tBreak.Stop()
+		x.tExpire.Stop()
+		x.tDeliverHandshake.Stop()
+		return nil, x.traceError(err)
+	}
+	x.tBreak.Reset(x.timeouts.BreakTimeout)
+	x.resetExpire()
 	x.channelHooks.Register(ChannelHook{OnClosed: x.unregisterChannel})
 
 	if localIdent == nil {
@@ -134,7 +188,7 @@ func newExchange(
 	if remoteIdent != nil {
 		x.log = log.To(remoteIdent.Hashname())
 
-		csid := cipherset.SelectCSID(localIdent.keys, remoteIdent.keys)
+		csid := x.cipherSets.SelectCSID(localIdent.keys, remoteIdent.keys)
 		cipher, err := cipherset.NewState(csid, localIdent.keys[csid])
 		if err != nil {
 			return nil, x.traceError(err)
@@ -190,12 +244,24 @@ func (x *Exchange) setOptions(options ...ExchangeOption) error {
 	return nil
 }
 
+// SetOptions applies options to a running exchange.
+func (x *Exchange) SetOptions(options ...ExchangeOption) error {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	return x.setOptions(options...)
+}
+
 func registerEndpoint(e *Endpoint) ExchangeOption {
 	return func(x *Exchange) error {
 		x.endpoint = e
 		x.listenerSet = e.listenerSet.Inherit()
 		x.exchangeHooks = e.exchangeHooks
 		x.channelHooks = e.channelHooks
+		x.rekeyInterval = e.rekeyInterval
+		x.rekeyBytes = e.rekeyBytes
+		x.cipherSets = e.cipherSets
+		x.timeouts = e.exchangeTimeouts
+		x.channelTimeouts = e.channelTimeouts
 		x.exchangeHooks.exchange = x
 		x.channelHooks.exchange = x
 		return nil
@@ -323,8 +389,13 @@ func (x *Exchange) traceReceivedPacket(msg message, pkt *lob.Packet) {
 
 // Dial exchanges the initial handshakes. It will timeout after 2 minutes.
 func (x *Exchange) Dial() error {
+	return x.DialContext(context.Background())
+}
+
+// DialContext is like Dial but gives up when ctx is done. When no other dialer
+// is waiting for the handshake, the exchange is closed with ctx.Err().
+func (x *Exchange) DialContext(ctx context.Context) error {
 	x.mtx.Lock()
-	defer x.mtx.Unlock()
 
 	if x.state == 0 {
 		x.state = ExchangeDialing
@@ -332,17 +403,46 @@ func (x *Exchange) Dial() error {
 		x.rescheduleHandshake()
 	}
 
-	for x.state == ExchangeDialing {
-		x.cndState.Wait()
+	if x.state == ExchangeDialing {
+		stop := context.AfterFunc(ctx, x.broadcastState)
+		defer stop()
+
+		x.dialers++
+		for x.state == ExchangeDialing && ctx.Err() == nil {
+			x.cndState.Wait()
+		}
+		x.dialers--
+
+		if x.state == ExchangeDialing {
+			err := ctx.Err()
+			if x.dialers > 0 {
+				x.mtx.Unlock()
+				return err
+			}
+
+			// abort the pending handshake
+			x.terminateLocked(err, err)
+			return err
+		}
 	}
 
-	if !x.state.IsOpen() {
+	state := x.state
+	x.mtx.Unlock()
+
+	if !state.IsOpen() {
 		return BrokenExchangeError(x.remoteIdent.Hashname())
 	}
 
 	return nil
 }
 
+// broadcastState wakes all goroutines waiting for a state change.
+func (x *Exchange) broadcastState() {
+	x.mtx.Lock()
+	x.cndState.Broadcast()
+	x.mtx.Unlock()
+}
+
 // RemoteHashname returns the hashname of the remote peer.
 func (x *Exchange) RemoteHashname() hashname.H {
 	hn := x.remoteIdent.Hashname()
@@ -382,8 +482,18 @@ func (x *Exchange) dialDialerAddr(addr dialerAddr) (net.Conn, error) {
 }
 
 func (x *Exchange) received(msg message) {
-	if msg.IsHandshake {
+	if isCookieChallenge(msg.Data.RawBytes()) {
+		x.mtx.Lock()
+		x.receivedCookieChallenge(msg)
+		x.mtx.Unlock()
+	} else if msg.IsHandshake {
+		x.mtx.Lock()
+		oldTokens := x.tokens()
 		x.receivedHandshake(msg)
+		tokens := x.tokens()
+		x.mtx.Unlock()
+
+		x.updateTokens(oldTokens, tokens)
 	} else {
 		x.receivedPacket(msg)
 	}
@@ -391,6 +501,26 @@ func (x *Exchange) received(msg message) {
 	msg.Data.Free()
 }
 
+// receivedCookieChallenge resends the current handshake with the cookie the
+// peer sent us. Challenges are answered at most once per second.
+func (x *Exchange) receivedCookieChallenge(msg message) {
+	if x.state.IsClosed() || time.Since(x.lastCookieReply) < time.Second {
+		return
+	}
+	x.lastCookieReply = time.Now()
+
+	pktData, err := x.generateHandshake(x.handshakeCipher(), 0)
+	if err != nil {
+		return
+	}
+
+	pktData = withCookie(pktData, msg.Data.Get(nil)[4:])
+	if _, err := msg.Pipe.Write(pktData); err == nil {
+		x.counters.sentHandshake()
+	}
+	pktData.Free()
+}
+
 func (x *Exchange) onDeliverHandshake() {
 	x.mtx.Lock()
 	defer x.mtx.Unlock()
@@ -407,7 +537,7 @@ func (x *Exchange) deliverHandshake() error {
 
 	x.addressBook.NextHandshakeEpoch()
 
-	pktData, err = x.generateHandshake(0)
+	pktData, err = x.generateHandshake(x.handshakeCipher(), 0)
 	if err != nil {
 		return err
 	}
@@ -416,6 +546,7 @@ func (x *Exchange) deliverHandshake() error {
 		_, err := pipe.Write(pktData)
 		if err == nil {
 			x.addressBook.SentHandshake(pipe)
+			x.counters.sentHandshake()
 		}
 	}
 
@@ -450,9 +581,12 @@ func (x *Exchange) receivedPacket(msg message) {
 		dropMissingChannelHandler = "missing channel handler"
 	)
 
+	var cipher cipherset.State
+
 	{
 		x.mtx.Lock()
 		state := x.state
+		cipher = x.packetCipher(cipherset.ExtractToken(msg.Data.RawBytes()))
 		x.mtx.Unlock()
 
 		if !state.IsOpen() {
@@ -469,13 +603,15 @@ func (x *Exchange) receivedPacket(msg message) {
 		return // drop
 	}
 
-	pkt2, err := x.cipher.DecryptPacket(pkt)
+	pkt2, err := cipher.DecryptPacket(pkt)
 	pkt.Free()
 	if err != nil {
 		x.exchangeHooks.DropPacket(msg.Data.Get(nil), msg.Pipe, nil)
 		x.traceDroppedPacket(msg, nil, err.Error())
 		return // drop
 	}
+	x.countBytes(msg.Data.Len())
+	x.counters.received(msg.Data.Len())
 	pkt2.TID = msg.TID
 	var (
 		hdr          = pkt2.Header()
@@ -503,15 +639,26 @@ func (x *Exchange) receivedPacket(msg message) {
 				return // drop (missing typ)
 			}
 
+			x.mtx.Lock()
+			draining := x.draining
+			x.mtx.Unlock()
+			if draining {
+				addPromise.Cancel()
+				x.exchangeHooks.DropPacket(msg.Data.Get(nil), msg.Pipe, ErrShuttingDown)
+				x.traceDroppedPacket(msg, pkt2, ErrShuttingDown.Error())
+				return // drop (shutting down)
+			}
+
 			listener := x.listenerSet.Get(typ)
-			if listener == nil {
+			handler := x.listenerSet.Handler()
+			if listener == nil && handler == nil {
 				addPromise.Cancel()
 				x.exchangeHooks.DropPacket(msg.Data.Get(nil), msg.Pipe, nil)
 				x.traceDroppedPacket(msg, pkt2, dropMissingChannelHandler)
 				return // drop (no handler)
 			}
 
-			c = newChannel(
+			c, err = newChannel(
 				x.remoteIdent.Hashname(),
 				typ,
 				hasSeq,
@@ -519,6 +666,12 @@ func (x *Exchange) receivedPacket(msg message) {
 				x,
 				registerExchange(x),
 			)
+			if err != nil {
+				addPromise.Cancel()
+				x.exchangeHooks.DropPacket(msg.Data.Get(nil), msg.Pipe, err)
+				x.traceDroppedPacket(msg, pkt2, err.Error())
+				return // drop
+			}
 			c.id = cid
 			addPromise.Add(c)
 
@@ -529,7 +682,11 @@ func (x *Exchange) receivedPacket(msg message) {
 			x.log.Printf("\x1B[32mOpened channel\x1B[0m %q %d", typ, cid)
 			c.channelHooks.Opened()
 
-			listener.handle(c)
+			if listener != nil {
+				listener.handle(c)
+			} else {
+				go handler.ServeChannel(c)
+			}
 		}
 	}
 
@@ -543,15 +700,17 @@ func (x *Exchange) deliverPacket(pkt *lob.Packet, p *Pipe) error {
 		x.cndState.Wait()
 	}
 	if !x.state.IsOpen() {
+		x.mtx.Unlock()
 		return BrokenExchangeError(x.remoteIdent.Hashname())
 	}
+	cipher := x.cipher
 	x.mtx.Unlock()
 
 	if p == nil {
 		p = x.addressBook.ActiveConnection()
 	}
 
-	pkt2, err := x.cipher.EncryptPacket(pkt)
+	pkt2, err := cipher.EncryptPacket(pkt)
 	if err != nil {
 		return err
 	}
@@ -562,23 +721,57 @@ func (x *Exchange) deliverPacket(pkt *lob.Packet, p *Pipe) error {
 		return err
 	}
 
+	n := msg.Len()
 	_, err = p.Write(msg)
 	msg.Free()
+	if err == nil {
+		x.countBytes(n)
+		x.counters.sent(n)
+	}
 
 	return err
 }
 
+// Close closes the exchange on purpose. All channels are closed with reason
+// (their reads and writes return reason), all pipes are closed,
+// ExchangeHooks.Closed is fired and the exchange is removed from the endpoint.
+// When reason is nil ErrExchangeClosed is used.
+func (x *Exchange) Close(reason error) error {
+	if reason == nil {
+		reason = ErrExchangeClosed
+	}
+
+	if !x.terminate(reason, reason) {
+		return ErrExchangeClosed
+	}
+
+	return nil
+}
+
 func (x *Exchange) expire(err error) {
+	x.terminate(err, nil)
+}
+
+// terminate stops the exchange. Channels are closed with channelErr or, when
+// it is nil, as if their close deadline was reached. terminate returns false
+// when the exchange was already stopped.
+func (x *Exchange) terminate(err, channelErr error) bool {
 	x.mtx.Lock()
+	return x.terminateLocked(err, channelErr)
+}
+
+// terminateLocked is like terminate but must be called with x.mtx held. It
+// releases x.mtx.
+func (x *Exchange) terminateLocked(err, channelErr error) bool {
 	if x.state == ExchangeExpired || x.state == ExchangeBroken {
 		x.mtx.Unlock()
-		return
+		return false
 	}
 
 	if err == nil {
 		x.state = ExchangeExpired
 	} else {
-		if x.err != nil {
+		if x.err == nil {
 			x.err = err
 		}
 		x.state = ExchangeBroken
@@ -588,11 +781,17 @@ func (x *Exchange) expire(err error) {
 	x.tBreak.Stop()
 	x.tExpire.Stop()
 	x.tDeliverHandshake.Stop()
+	x.tRekey.Stop()
+	x.tDropPrevCipher.Stop()
 
 	x.mtx.Unlock()
 
 	for _, c := range x.channels.All() {
-		c.onCloseDeadlineReached()
+		if channelErr != nil {
+			c.closeWithError(channelErr)
+		} else {
+			c.onCloseDeadlineReached()
+		}
 	}
 
 	for _, p := range x.addressBook.KnownPipes() {
@@ -601,6 +800,7 @@ func (x *Exchange) expire(err error) {
 
 	x.traceStopped()
 	x.exchangeHooks.Closed(err)
+	return true
 }
 
 func (x *Exchange) getNextSeq() uint32 {
@@ -664,7 +864,7 @@ func (x *Exchange) resetExpire() {
 		x.tExpire.Stop()
 	} else {
 		if x.state.IsOpen() {
-			x.tExpire.Reset(2 * 60 * time.Second)
+			x.tExpire.Reset(x.timeouts.IdleTimeout)
 		}
 	}
 
@@ -682,7 +882,7 @@ func (x *Exchange) resetExpire() {
 }
 
 func (x *Exchange) resetBreak() {
-	x.tBreak.Reset(2 * 60 * time.Second)
+	x.tBreak.Reset(x.timeouts.BreakTimeout)
 }
 
 func (x *Exchange) unregisterChannel(_ *Endpoint, _ *Exchange, c *Channel) error {
@@ -730,28 +930,52 @@ func (x *Exchange) waitDone() {
 }
 
 // Open a channel.
-func (x *Exchange) Open(typ string, reliable bool) (*Channel, error) {
+func (x *Exchange) Open(typ string, reliable bool, options ...ChannelOption) (*Channel, error) {
+	return x.OpenContext(context.Background(), typ, reliable, options...)
+}
+
+// OpenContext is like Open but gives up when ctx is done before the exchange
+// is open.
+func (x *Exchange) OpenContext(ctx context.Context, typ string, reliable bool, options ...ChannelOption) (*Channel, error) {
 	var (
-		c *Channel
+		c   *Channel
+		err error
 	)
 
-	c = newChannel(
+	c, err = newChannel(
 		x.remoteIdent.Hashname(),
 		typ,
 		reliable,
 		false,
 		x,
-		registerExchange(x),
+		append([]ChannelOption{registerExchange(x)}, options...)...,
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := context.AfterFunc(ctx, x.broadcastState)
+	defer stop()
 
 	x.mtx.Lock()
-	for x.state == ExchangeDialing {
+	for x.state == ExchangeDialing && ctx.Err() == nil {
 		x.cndState.Wait()
 	}
+	if x.state == ExchangeDialing {
+		x.mtx.Unlock()
+		c.discard()
+		return nil, ctx.Err()
+	}
 	if !x.state.IsOpen() {
 		x.mtx.Unlock()
+		c.discard()
 		return nil, BrokenExchangeError(x.remoteIdent.Hashname())
 	}
+	if x.draining {
+		x.mtx.Unlock()
+		c.discard()
+		return nil, ErrShuttingDown
+	}
 
 	c.id = x.getNextChannelID()
 	x.channels.Add(c.id, c)
@@ -763,6 +987,58 @@ func (x *Exchange) Open(typ string, reliable bool) (*Channel, error) {
 	return c, nil
 }
 
+// OpenWithPayload opens a channel and writes body and headers in the initial
+// packet (the packet which opens the channel on the remote side). The
+// accepting side reads the payload as its first packet.
+//
+// A channel opened with Open can not write a second packet before the peer
+// responded to the first one. A reliable channel opened with OpenWithPayload
+// does not wait for the response; it keeps writing (up to its window) which
+// saves a round trip. Packets which reach the peer before the initial packet
+// are dropped by the peer and resent like lost packets. The initial packet is
+// resent until it is acknowledged.
+func (x *Exchange) OpenWithPayload(typ string, reliable bool, body []byte, headers map[string]interface{}, options ...ChannelOption) (*Channel, error) {
+	if len(body) > cMaxOpenPayload {
+		return nil, ErrPayloadTooLarge
+	}
+	for k := range headers {
+		if isChannelHeader(k) {
+			return nil, ErrReservedHeader
+		}
+	}
+
+	c, err := x.Open(typ, reliable, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mtx.Lock()
+	c.pipelined = reliable
+	c.mtx.Unlock()
+
+	pkt := lob.New(body)
+	for k, v := range headers {
+		pkt.Header().Set(k, v)
+	}
+
+	err = c.WritePacket(pkt)
+	if err != nil {
+		c.Kill()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func isChannelHeader(k string) bool {
+	switch k {
+	case "c", "type", "seq", "ack", "miss", "end":
+		return true
+	default:
+		return false
+	}
+}
+
 // LocalToken returns the token identifying the local side of the exchange.
 func (x *Exchange) LocalToken() cipherset.Token {
 	return x.cipher.LocalToken()
@@ -773,6 +1049,173 @@ func (x *Exchange) RemoteToken() cipherset.Token {
 	return x.cipher.RemoteToken()
 }
 
+// tokens returns all the tokens which currently identify the exchange. This
+// includes the tokens of a pending rekey and the tokens of the previous line
+// keys during the overlap window.
+func (x *Exchange) tokens() []cipherset.Token {
+	var l []cipherset.Token
+
+	for _, cipher := range []cipherset.State{x.cipher, x.nextCipher, x.prevCipher} {
+		if cipher == nil {
+			continue
+		}
+		if token := cipher.LocalToken(); token != cipherset.ZeroToken {
+			l = append(l, token)
+		}
+		if token := cipher.RemoteToken(); token != cipherset.ZeroToken {
+			l = append(l, token)
+		}
+	}
+
+	return l
+}
+
+func (x *Exchange) updateTokens(oldTokens, tokens []cipherset.Token) {
+	if e, ok := x.endpoint.(*Endpoint); ok && e != nil {
+		e.updateTokens(x, oldTokens, tokens)
+	}
+}
+
+// Rekey replaces the line keys of the exchange with new ephemeral keys. Packets
+// encrypted with the old line keys can still be decrypted for a short while.
+// Rekeying also happens automatically (see the Rekey EndpointOption).
+func (x *Exchange) Rekey() {
+	x.mtx.Lock()
+	oldTokens := x.tokens()
+	x.rekey()
+	tokens := x.tokens()
+	x.mtx.Unlock()
+
+	x.updateTokens(oldTokens, tokens)
+}
+
+func (x *Exchange) onRekey() {
+	if x == nil {
+		return
+	}
+	x.Rekey()
+}
+
+// rekey starts a new rekey. The new line keys are used once the remote
+// endpoint has responded to the rekey handshake.
+func (x *Exchange) rekey() {
+	if !x.state.IsOpen() || x.nextCipher != nil {
+		return
+	}
+
+	cipher, err := x.newCipherState()
+	if err != nil {
+		x.traceError(err)
+		return
+	}
+
+	x.nextCipher = cipher
+
+	// The rekey handshake is sent over the active path right away; the regular
+	// handshakes will retry it on all paths until the remote endpoint responds.
+	pktData, err := x.generateHandshake(cipher, 0)
+	if err != nil {
+		x.traceError(err)
+		return
+	}
+	if p := x.addressBook.ActiveConnection(); p != nil {
+		if _, err := p.Write(pktData); err == nil {
+			x.counters.sentHandshake()
+		}
+	}
+	pktData.Free()
+}
+
+func (x *Exchange) newCipherState() (cipherset.State, error) {
+	cipher, err := cipherset.NewState(x.csid, x.localIdent.keys[x.csid])
+	if err != nil {
+		return nil, err
+	}
+
+	err = cipher.SetRemoteKey(x.remoteIdent.keys[x.csid])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher, nil
+}
+
+// promoteCipher replaces the current cipher with the pending cipher. The
+// replaced cipher is kept around to decrypt packets that are still in flight.
+func (x *Exchange) promoteCipher() {
+	x.prevCipher = x.cipher
+	x.cipher = x.nextCipher
+	x.nextCipher = nil
+	x.bytesSinceKey = 0
+
+	x.tDropPrevCipher.Reset(rekeyOverlap)
+	x.resetRekey()
+
+	statExchangeRekey.Add(1)
+	x.log.Printf("\x1B[33mRekeyed exchange\x1B[0m")
+}
+
+func (x *Exchange) onDropPrevCipher() {
+	if x == nil {
+		return
+	}
+
+	x.mtx.Lock()
+	oldTokens := x.tokens()
+	x.prevCipher = nil
+	tokens := x.tokens()
+	x.mtx.Unlock()
+
+	x.updateTokens(oldTokens, tokens)
+}
+
+func (x *Exchange) resetRekey() {
+	if x.rekeyInterval > 0 {
+		x.tRekey.Reset(x.rekeyInterval)
+	} else {
+		x.tRekey.Stop()
+	}
+}
+
+// countBytes keeps track of the number of bytes that were transferred with the
+// current line keys and starts a rekey when the threshold is reached.
+func (x *Exchange) countBytes(n int) {
+	x.mtx.Lock()
+	x.bytesSinceKey += uint64(n)
+	if x.rekeyBytes == 0 || x.bytesSinceKey < x.rekeyBytes || x.nextCipher != nil {
+		x.mtx.Unlock()
+		return
+	}
+
+	oldTokens := x.tokens()
+	x.rekey()
+	tokens := x.tokens()
+	x.mtx.Unlock()
+
+	x.updateTokens(oldTokens, tokens)
+}
+
+// handshakeCipher returns the cipher which is used to generate (request)
+// handshakes.
+func (x *Exchange) handshakeCipher() cipherset.State {
+	if x.nextCipher != nil {
+		return x.nextCipher
+	}
+	return x.cipher
+}
+
+// packetCipher returns the cipher which must be used to decrypt a packet with
+// token.
+func (x *Exchange) packetCipher(token cipherset.Token) cipherset.State {
+	if x.prevCipher != nil && x.prevCipher.LocalToken() == token {
+		return x.prevCipher
+	}
+	if x.nextCipher != nil && x.nextCipher.LocalToken() == token && x.nextCipher.CanDecryptPacket() {
+		return x.nextCipher
+	}
+	return x.cipher
+}
+
 // AddPathCandidate adds a new path tto the exchange. The path is
 // only used when it performs better than any other paths.
 func (x *Exchange) AddPathCandidate(addr net.Addr) {
@@ -791,10 +1234,10 @@ func (x *Exchange) GenerateHandshake() (*bufpool.Buffer, error) {
 	x.mtx.Lock()
 	defer x.mtx.Unlock()
 
-	return x.generateHandshake(0)
+	return x.generateHandshake(x.handshakeCipher(), 0)
 }
 
-func (x *Exchange) generateHandshake(seq uint32) (*bufpool.Buffer, error) {
+func (x *Exchange) generateHandshake(cipher cipherset.State, seq uint32) (*bufpool.Buffer, error) {
 	var (
 		pkt     *lob.Packet
 		pktData *bufpool.Buffer
@@ -805,7 +1248,7 @@ func (x *Exchange) generateHandshake(seq uint32) (*bufpool.Buffer, error) {
 		seq = x.getNextSeq()
 	}
 
-	body, err := x.cipher.EncryptHandshake(seq, x.localIdent.parts)
+	body, err := cipher.EncryptHandshake(seq, x.localIdent.parts)
 	if err != nil {
 		return nil, err
 	}
@@ -847,15 +1290,23 @@ func (x *Exchange) AddPipeConnection(conn net.Conn, addr net.Addr) (p *Pipe, add
 // and it is accepted response will contain a response-handshake packet.
 func (x *Exchange) ApplyHandshake(handshake cipherset.Handshake, pipe *Pipe) (response *bufpool.Buffer, ok bool) {
 	x.mtx.Lock()
-	defer x.mtx.Unlock()
+	oldTokens := x.tokens()
+	response, ok = x.applyHandshake(handshake, cipherset.ZeroToken, pipe)
+	tokens := x.tokens()
+	x.mtx.Unlock()
 
-	return x.applyHandshake(handshake, pipe)
+	x.updateTokens(oldTokens, tokens)
+	return response, ok
 }
 
-func (x *Exchange) applyHandshake(handshake cipherset.Handshake, pipe *Pipe) (response *bufpool.Buffer, ok bool) {
+// applyHandshake applies handshake to the exchange. token identifies the line
+// key of the remote endpoint (when it is known). A request-handshake with a new
+// line key is treated as a rekey initiated by the remote endpoint.
+func (x *Exchange) applyHandshake(handshake cipherset.Handshake, token cipherset.Token, pipe *Pipe) (response *bufpool.Buffer, ok bool) {
 	var (
-		seq uint32
-		err error
+		seq    uint32
+		cipher cipherset.State
+		err    error
 	)
 
 	if handshake == nil {
@@ -873,11 +1324,38 @@ func (x *Exchange) applyHandshake(handshake cipherset.Handshake, pipe *Pipe) (re
 		return nil, false
 	}
 
-	if !x.cipher.ApplyHandshake(handshake) {
+	cipher = x.cipher
+	if x.state.IsOpen() {
+		if x.isLocalSeq(seq) {
+			if x.nextCipher != nil {
+				// response to our rekey
+				cipher = x.nextCipher
+			}
+		} else if token != cipherset.ZeroToken && token != x.cipher.RemoteToken() {
+			// the remote endpoint is rekeying
+			if x.nextCipher == nil {
+				x.nextCipher, err = x.newCipherState()
+				if err != nil {
+					return nil, false
+				}
+			}
+			cipher = x.nextCipher
+		}
+	}
+
+	if !cipher.ApplyHandshake(handshake) {
 		// drop; handshake was rejected by the cipherset
 		return nil, false
 	}
 
+	if cipher == x.nextCipher {
+		if !cipher.CanEncryptPacket() {
+			// drop; incomplete rekey
+			return nil, false
+		}
+		x.promoteCipher()
+	}
+
 	if x.remoteIdent == nil {
 		ident, err := NewIdentity(
 			cipherset.Keys{handshake.CSID(): handshake.PublicKey()},
@@ -898,7 +1376,7 @@ func (x *Exchange) applyHandshake(handshake cipherset.Handshake, pipe *Pipe) (re
 	} else {
 		x.addressBook.AddPipe(pipe)
 
-		response, err = x.generateHandshake(seq)
+		response, err = x.generateHandshake(cipher, seq)
 		if err != nil {
 			// drop; invalid identity
 			return nil, false
@@ -910,6 +1388,7 @@ func (x *Exchange) applyHandshake(handshake cipherset.Handshake, pipe *Pipe) (re
 
 		x.state = ExchangeIdle
 		x.resetExpire()
+		x.resetRekey()
 		x.cndState.Broadcast()
 
 		go x.exchangeHooks.Opened()
@@ -918,10 +1397,8 @@ func (x *Exchange) applyHandshake(handshake cipherset.Handshake, pipe *Pipe) (re
 	return response, true
 }
 
+// receivedHandshake must be called with x.mtx locked.
 func (x *Exchange) receivedHandshake(msg message) bool {
-	x.mtx.Lock()
-	defer x.mtx.Unlock()
-
 	var (
 		pkt       *lob.Packet
 		handshake cipherset.Handshake
@@ -943,13 +1420,13 @@ func (x *Exchange) receivedHandshake(msg message) bool {
 		return false
 	}
 
-	hdr := pkt.Header()
-	if !hdr.IsBinary() && len(hdr.Bytes) != 1 {
+	head := pkt.Header().Binary()
+	if len(head) != 1 {
 		x.exchangeHooks.DropPacket(msg.Data.Get(nil), msg.Pipe, nil)
 		x.traceDroppedHandshake(msg, nil, "invalid header")
 		return false
 	}
-	csid = uint8(hdr.Bytes[0])
+	csid = uint8(head[0])
 
 	handshake, err = cipherset.DecryptHandshake(csid, x.localIdent.keys[csid], pkt.Body(buf[:0]))
 	if err != nil {
@@ -958,7 +1435,7 @@ func (x *Exchange) receivedHandshake(msg message) bool {
 		return false
 	}
 
-	resp, ok := x.applyHandshake(handshake, msg.Pipe)
+	resp, ok := x.applyHandshake(handshake, cipherset.ExtractToken(msg.Data.RawBytes()), msg.Pipe)
 	if !ok {
 		x.exchangeHooks.DropPacket(msg.Data.Get(nil), msg.Pipe, nil)
 		x.traceDroppedHandshake(msg, handshake, "failed to apply")
@@ -966,9 +1443,12 @@ func (x *Exchange) receivedHandshake(msg message) bool {
 	}
 
 	x.lastRemoteSeq = handshake.At()
+	x.counters.receivedHandshake()
 
 	if resp != nil {
-		msg.Pipe.Write(resp)
+		if _, err := msg.Pipe.Write(resp); err == nil {
+			x.counters.sentHandshake()
+		}
 	}
 
 	x.traceReceivedHandshake(msg, handshake)
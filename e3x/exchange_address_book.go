@@ -70,6 +70,31 @@ func (book *addressBook) KnownAddresses() []net.Addr {
 	return s
 }
 
+// WorkingAddresses returns the active address followed by the other reachable
+// addresses, and the latency of the active address.
+func (book *addressBook) WorkingAddresses() ([]net.Addr, time.Duration) {
+	book.mtx.RLock()
+	defer book.mtx.RUnlock()
+
+	var (
+		s       []net.Addr
+		latency time.Duration
+	)
+
+	if book.active != nil {
+		s = append(s, book.active.Address)
+		latency = book.active.ewma
+	}
+
+	for _, e := range book.known {
+		if e != book.active && e.Reachable {
+			s = append(s, e.Address)
+		}
+	}
+
+	return s, latency
+}
+
 func (book *addressBook) KnownPipes() []*Pipe {
 	book.mtx.RLock()
 	defer book.mtx.RUnlock()
@@ -222,6 +247,22 @@ func (book *addressBook) AddPipe(p *Pipe) {
 	}
 }
 
+// SeedLatency sets the latency of the path to addr before it was measured
+// (for example the latency remembered by a PeerStore).
+func (book *addressBook) SeedLatency(addr net.Addr, d time.Duration) {
+	book.mtx.Lock()
+	defer book.mtx.Unlock()
+
+	idx := book.indexOf(addr)
+	if idx < 0 {
+		return
+	}
+
+	e := book.known[idx]
+	e.latency = d
+	e.ewma = d
+}
+
 func (book *addressBook) SentHandshake(pipe *Pipe) {
 	book.mtx.Lock()
 	defer book.mtx.Unlock()
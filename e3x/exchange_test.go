@@ -0,0 +1,570 @@
+package e3x
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+
+	"github.com/telehash/gogotelehash/internal/lob"
+	"github.com/telehash/gogotelehash/internal/util/logs"
+	"github.com/telehash/gogotelehash/transports/inproc"
+)
+
+func TestRekey(t *testing.T) {
+	logs.ResetLogger()
+	resetStats()
+
+	var (
+		assert = assert.New(t)
+		body   = make([]byte, 256)
+	)
+
+	A, err := Open(Transport(inproc.Config{}), Rekey(0, 8<<10), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := Open(Transport(inproc.Config{}), Rekey(0, 8<<10), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	go func() {
+		c, err := A.Listen("rekey", true).AcceptChannel()
+		if !assert.NoError(err) {
+			return
+		}
+		defer c.Close()
+
+		_, err = c.ReadPacket()
+		assert.NoError(err)
+
+		for i := 0; i < 1000; i++ {
+			pkt := lob.New(body)
+			pkt.Header().SetInt("id", i)
+			assert.NoError(c.WritePacket(pkt))
+		}
+	}()
+
+	ident, err := A.LocalIdentity()
+	assert.NoError(err)
+
+	c, err := B.Open(ident, "rekey", true)
+	if !assert.NoError(err) {
+		return
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	assert.NoError(c.WritePacket(lob.New(nil)))
+
+	for i := 0; i < 1000; i++ {
+		pkt, err := c.ReadPacket()
+		if !assert.NoError(err) {
+			break
+		}
+		id, _ := pkt.Header().GetInt("id")
+		assert.Equal(i, id)
+	}
+
+	assert.True(statExchangeRekey.Value() > 0, "expected at least one rekey")
+	dumpExpVar(t)
+}
+
+func TestExchangeClose(t *testing.T) {
+	logs.ResetLogger()
+
+	var (
+		assert = assert.New(t)
+		reason = errors.New("revoked")
+		closed = make(chan error, 1)
+	)
+
+	A, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	B.exchangeHooks.Register(ExchangeHook{OnClosed: func(e *Endpoint, x *Exchange, err error) error {
+		closed <- err
+		return nil
+	}})
+
+	l := A.Listen("ping", true)
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.AcceptChannel()
+			if err != nil {
+				return
+			}
+			c.ReadPacket()
+			c.WritePacket(lob.New([]byte("pong")))
+		}
+	}()
+
+	ident, err := A.LocalIdentity()
+	assert.NoError(err)
+
+	x, err := B.Dial(ident)
+	if !assert.NoError(err) {
+		return
+	}
+
+	c, err := x.Open("ping", true)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(c.WritePacket(lob.New([]byte("ping"))))
+	_, err = c.ReadPacket()
+	assert.NoError(err)
+
+	assert.NoError(x.Close(reason))
+	assert.Equal(ErrExchangeClosed, x.Close(nil))
+	assert.Equal(ExchangeBroken, x.State())
+	assert.Equal(reason, <-closed)
+
+	_, err = c.ReadPacket()
+	assert.Equal(reason, err)
+	assert.Equal(reason, c.WritePacket(lob.New(nil)))
+
+	_, err = x.Open("ping", true)
+	assert.Error(err)
+
+	B.mtx.Lock()
+	assert.Nil(B.hashnames[ident.Hashname()])
+	assert.Len(B.tokens, 0)
+	B.mtx.Unlock()
+
+	// dialing again makes a new exchange
+	y, err := B.Dial(ident)
+	if assert.NoError(err) {
+		assert.True(x != y)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	logs.ResetLogger()
+
+	var (
+		assert = assert.New(t)
+		closed = make(chan error, 1)
+	)
+
+	_, err := Open(Transport(inproc.Config{}), Log(nil),
+		Timeouts(ExchangeTimeouts{IdleTimeout: -1}, ChannelTimeouts{}))
+	assert.Equal(ErrInvalidTimeout, err)
+
+	_, err = Open(Transport(inproc.Config{}), Log(nil),
+		Timeouts(ExchangeTimeouts{}, ChannelTimeouts{ResendInterval: time.Millisecond}))
+	assert.Equal(ErrInvalidTimeout, err)
+
+	A, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil),
+		PeerTimeouts(A.LocalHashname(),
+			ExchangeTimeouts{IdleTimeout: 1 * time.Second},
+			ChannelTimeouts{ReadTimeout: 200 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	B.exchangeHooks.Register(ExchangeHook{OnClosed: func(e *Endpoint, x *Exchange, err error) error {
+		closed <- err
+		return nil
+	}})
+
+	l := A.Listen("silent", true)
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.AcceptChannel()
+			if err != nil {
+				return
+			}
+			c.ReadPacket()
+		}
+	}()
+
+	ident, err := A.LocalIdentity()
+	assert.NoError(err)
+
+	x, err := B.Dial(ident)
+	if !assert.NoError(err) {
+		return
+	}
+
+	_, err = x.Open("silent", true, WithChannelTimeouts(ChannelTimeouts{AckInterval: -1}))
+	assert.Equal(ErrInvalidTimeout, err)
+
+	// the peer never answers; the read timeout breaks the read
+	c, err := x.Open("silent", true)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(c.WritePacket(lob.New([]byte("ping"))))
+
+	start := time.Now()
+	_, err = c.ReadPacket()
+	assert.Equal(ErrTimeout, err)
+	assert.True(time.Since(start) < 5*time.Second)
+	c.Kill()
+
+	// the idle exchange expires after a second
+	select {
+	case err = <-closed:
+		assert.NoError(err)
+		assert.Equal(ExchangeExpired, x.State())
+	case <-time.After(10 * time.Second):
+		t.Fatal("exchange did not expire")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	logs.ResetLogger()
+
+	var (
+		assert = assert.New(t)
+		closed = make(chan error, 1)
+	)
+
+	A, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil),
+		Timeouts(ExchangeTimeouts{IdleTimeout: 1 * time.Second}, ChannelTimeouts{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	B.exchangeHooks.Register(ExchangeHook{OnClosed: func(e *Endpoint, x *Exchange, err error) error {
+		closed <- err
+		return nil
+	}})
+
+	ident, err := A.LocalIdentity()
+	assert.NoError(err)
+
+	start := time.Now()
+
+	// no channel is ever opened on the exchange
+	x, err := B.Dial(ident)
+	if !assert.NoError(err) {
+		return
+	}
+
+	select {
+	case err = <-closed:
+		assert.NoError(err)
+		assert.Equal(ExchangeExpired, x.State())
+		assert.True(time.Since(start) < 5*time.Second)
+	case <-time.After(10 * time.Second):
+		t.Fatal("exchange did not expire")
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	logs.ResetLogger()
+
+	assert := assert.New(t)
+
+	A, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	C, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	identC, err := C.LocalIdentity()
+	assert.NoError(err)
+	C.Close()
+
+	// C is gone; the handshake is aborted when the context expires
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	_, err = B.DialContext(ctx, identC)
+	cancel()
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.Nil(B.GetExchange(identC.Hashname()))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	_, err = B.OpenContext(ctx, identC, "ping", true)
+	cancel()
+	assert.Equal(context.DeadlineExceeded, err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = B.DialContext(ctx, identC)
+	assert.Equal(context.Canceled, err)
+
+	// accepting gives up when the context is cancelled
+	l := A.Listen("ping", true)
+	defer l.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, err = l.AcceptChannelContext(ctx)
+	cancel()
+	assert.Equal(context.DeadlineExceeded, err)
+
+	go func() {
+		c, err := l.AcceptChannelContext(context.Background())
+		if err != nil {
+			return
+		}
+		c.ReadPacket()
+		c.WritePacket(lob.New([]byte("pong")))
+		c.Close()
+	}()
+
+	identA, err := A.LocalIdentity()
+	assert.NoError(err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, err := B.OpenContext(ctx, identA, "ping", true)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(c.WritePacket(lob.New([]byte("ping"))))
+	_, err = c.ReadPacket()
+	assert.NoError(err)
+	c.Close()
+}
+
+func TestExchangeStats(t *testing.T) {
+	logs.ResetLogger()
+
+	assert := assert.New(t)
+
+	A, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	l := A.Listen("ping", true)
+	defer l.Close()
+
+	go func() {
+		c, err := l.AcceptChannel()
+		if err != nil {
+			return
+		}
+		c.ReadPacket()
+		c.WritePacket(lob.New([]byte("pong")))
+		c.Close()
+	}()
+
+	identA, err := A.LocalIdentity()
+	assert.NoError(err)
+
+	x, err := B.Dial(identA)
+	if !assert.NoError(err) {
+		return
+	}
+
+	c, err := x.Open("ping", true)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(c.WritePacket(lob.New([]byte("ping"))))
+	_, err = c.ReadPacket()
+	assert.NoError(err)
+
+	stats := x.Stats()
+	assert.Equal(A.LocalHashname(), stats.Hashname)
+	assert.Equal(ExchangeActive, stats.State)
+	assert.NotEqual(uint8(0), stats.CSID)
+	assert.True(stats.PacketsSent > 0)
+	assert.True(stats.PacketsReceived > 0)
+	assert.True(stats.BytesSent > stats.PacketsSent)
+	assert.True(stats.BytesReceived > stats.PacketsReceived)
+	assert.True(stats.HandshakesSent > 0)
+	assert.True(stats.HandshakesReceived > 0)
+	assert.Equal(1, stats.Channels)
+	assert.NotNil(stats.ActivePath)
+	if assert.NotEmpty(stats.Paths) {
+		assert.True(stats.Paths[0].Active)
+		assert.Equal(stats.ActivePath, stats.Paths[0].Address)
+	}
+
+	estats := B.Stats()
+	if assert.Len(estats.Exchanges, 1) {
+		assert.Equal(A.LocalHashname(), estats.Exchanges[0].Hashname)
+	}
+	assert.True(estats.PacketsSent >= stats.PacketsSent)
+	assert.True(estats.HandshakesReceived >= stats.HandshakesReceived)
+	assert.Equal(1, estats.Channels)
+
+	c.Close()
+}
+
+func TestOpenWithPayload(t *testing.T) {
+	logs.ResetLogger()
+
+	var (
+		assert  = assert.New(t)
+		dropped int
+	)
+
+	A, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	// A loses the first open packet; it must be resent with its payload
+	A.DefaultChannelHooks().Register(ChannelHook{
+		OnReceivedPacket: func(e *Endpoint, x *Exchange, c *Channel, pkt *lob.Packet) (*lob.Packet, error) {
+			if hdr := pkt.Header(); hdr.HasType && hdr.HasSeq && hdr.Seq == 1 {
+				assert.Equal("request", string(pkt.Body(nil)))
+				if dropped == 0 {
+					dropped++
+					pkt.Free()
+					return nil, nil
+				}
+			}
+			return pkt, nil
+		},
+	})
+
+	go func() {
+		c, err := A.Listen("zrtt", true).AcceptChannel()
+		if !assert.NoError(err) {
+			return
+		}
+		defer c.Close()
+
+		pkt, err := c.ReadPacket()
+		if assert.NoError(err) {
+			assert.Equal("request", string(pkt.Body(nil)))
+			method, _ := pkt.Header().GetString("method")
+			assert.Equal("GET", method)
+		}
+		assert.NoError(c.WritePacket(lob.New([]byte("response"))))
+	}()
+
+	identA, err := A.LocalIdentity()
+	assert.NoError(err)
+
+	x, err := B.Dial(identA)
+	if !assert.NoError(err) {
+		return
+	}
+
+	_, err = x.OpenWithPayload("zrtt", true, nil, map[string]interface{}{"seq": 5})
+	assert.Equal(ErrReservedHeader, err)
+	_, err = x.OpenWithPayload("zrtt", true, make([]byte, cMaxOpenPayload+1), nil)
+	assert.Equal(ErrPayloadTooLarge, err)
+
+	c, err := x.OpenWithPayload("zrtt", true, []byte("request"), map[string]interface{}{"method": "GET"},
+		WithChannelTimeouts(ChannelTimeouts{ResendInterval: 50 * time.Millisecond}))
+	if !assert.NoError(err) {
+		return
+	}
+
+	pkt, err := c.ReadPacket()
+	if assert.NoError(err) {
+		assert.Equal("response", string(pkt.Body(nil)))
+	}
+	assert.NoError(c.Close())
+	assert.Equal(1, dropped)
+}
+
+func TestOpenWithPayloadPipelining(t *testing.T) {
+	logs.ResetLogger()
+
+	assert := assert.New(t)
+
+	A, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := Open(Transport(inproc.Config{}), Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	identA, err := A.LocalIdentity()
+	assert.NoError(err)
+
+	x, err := B.Dial(identA)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// A has no listener for "void" so it never responds to the channels.
+
+	// Open: the second write waits for a response (until the deadline)
+	c, err := x.Open("void", true)
+	if assert.NoError(err) {
+		assert.NoError(c.WritePacket(lob.New([]byte("first"))))
+		c.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+		assert.Equal(ErrTimeout, c.WritePacket(lob.New([]byte("second"))))
+		c.Kill()
+	}
+
+	// OpenWithPayload (unreliable): the same
+	c, err = x.OpenWithPayload("void", false, []byte("first"), nil)
+	if assert.NoError(err) {
+		c.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+		assert.Equal(ErrTimeout, c.WritePacket(lob.New([]byte("second"))))
+		c.Kill()
+	}
+
+	// OpenWithPayload (reliable): the following writes don't wait
+	c, err = x.OpenWithPayload("void", true, []byte("first"), nil)
+	if assert.NoError(err) {
+		c.SetWriteDeadline(time.Now().Add(time.Minute))
+		assert.NoError(c.WritePacket(lob.New([]byte("second"))))
+		assert.NoError(c.WritePacket(lob.New([]byte("third"))))
+		c.Kill()
+	}
+}
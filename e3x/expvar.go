@@ -13,6 +13,12 @@ var (
 	statChannelSndPkt       *expvar.Int
 	statChannelSndAckInline *expvar.Int
 	statChannelSndAckAdHoc  *expvar.Int
+	statExchangeRekey       *expvar.Int
+
+	statHandshakeRateLimited *expvar.Int
+	statHandshakeChallenged  *expvar.Int
+	statHandshakeBadCookie   *expvar.Int
+	statHandshakeFallback    *expvar.Int
 )
 
 func init() {
@@ -29,6 +35,11 @@ func resetStats() {
 	statChannelSndPkt = new(expvar.Int)
 	statChannelSndAckInline = new(expvar.Int)
 	statChannelSndAckAdHoc = new(expvar.Int)
+	statExchangeRekey = new(expvar.Int)
+	statHandshakeRateLimited = new(expvar.Int)
+	statHandshakeChallenged = new(expvar.Int)
+	statHandshakeBadCookie = new(expvar.Int)
+	statHandshakeFallback = new(expvar.Int)
 
 	statsMap.Set("channel.rcv.pkt", statChannelRcvPkt)
 	statsMap.Set("channel.rcv.pkt.drop", statChannelRcvPktDrop)
@@ -37,4 +48,9 @@ func resetStats() {
 	statsMap.Set("channel.snd.pkt", statChannelSndPkt)
 	statsMap.Set("channel.snd.ack.inline", statChannelSndAckInline)
 	statsMap.Set("channel.snd.ack.ad-hoc", statChannelSndAckAdHoc)
+	statsMap.Set("exchange.rekey", statExchangeRekey)
+	statsMap.Set("handshake.drop.rate-limited", statHandshakeRateLimited)
+	statsMap.Set("handshake.drop.challenged", statHandshakeChallenged)
+	statsMap.Set("handshake.drop.bad-cookie", statHandshakeBadCookie)
+	statsMap.Set("handshake.cookie-fallback", statHandshakeFallback)
 }
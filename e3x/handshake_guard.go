@@ -0,0 +1,359 @@
+package e3x
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/telehash/gogotelehash/internal/lob"
+	"github.com/telehash/gogotelehash/internal/util/bufpool"
+)
+
+// Handshake cookies
+//
+// When an endpoint is under load it answers handshakes from unknown sources
+// with a cookie challenge instead of decrypting them. The challenge is a
+// packet with the binary head {0x00, 'C'} and the cookie as its body. The peer
+// echoes the cookie by resending its handshake with the binary head
+// {CSID, 'C'} and the cookie prepended to the handshake body. A cookie is a 4
+// byte timestamp followed by a truncated HMAC of the timestamp, the CSID and
+// the source host, so no state is kept for the cookies themselves.
+//
+// The challenge is specific to this implementation; other telehash
+// implementations ignore it. A source which keeps sending plain handshakes
+// longer than cookieFallbackDelay after it was challenged is assumed to not
+// support cookies. Its handshakes are admitted at fallbackSourceRate and, in
+// total, at most CookieThreshold of them per second.
+
+const (
+	cookieMarker   = 'C'
+	cookieSize     = 4 + 16
+	cookieLifetime = 30 * time.Second
+
+	cookieFallbackDelay = 2 * time.Second
+	fallbackSourceRate  = 1 // handshakes per second
+	fallbackLifetime    = 2 * time.Minute
+
+	maxHandshakeBuckets = 4096
+)
+
+var (
+	// ErrHandshakeRateLimited is the reason used when a handshake is dropped
+	// because its source sent too many handshakes.
+	ErrHandshakeRateLimited = errors.New("e3x: handshake rate limited")
+
+	// ErrHandshakeChallenged is the reason used when a handshake is dropped
+	// after the source was sent a cookie challenge.
+	ErrHandshakeChallenged = errors.New("e3x: handshake challenged")
+)
+
+// HandshakeLimits configures the handshake flood protection of an endpoint.
+type HandshakeLimits struct {
+	// CookieThreshold is the number of handshakes per second above which new
+	// handshakes must echo a cookie before they are decrypted. Zero disables
+	// cookie challenges.
+	//
+	// Cookie challenges are not part of the telehash protocol; only this
+	// implementation answers them. Sources which don't answer are rate
+	// limited instead (one handshake per second each, CookieThreshold per
+	// second in total), so peers of other implementations connect slowly
+	// while the threshold is exceeded.
+	CookieThreshold int
+
+	// SourceRate is the number of handshakes per second accepted from a
+	// single source (IP address). Zero disables the per-source limit.
+	SourceRate float64
+
+	// SourceBurst is the number of handshakes a source may send at once.
+	// (default: SourceRate rounded up, at least 1)
+	SourceBurst int
+}
+
+// LimitHandshakes protects the endpoint against handshake floods. See
+// HandshakeLimits.CookieThreshold for peers which don't support cookie
+// challenges.
+func LimitHandshakes(limits HandshakeLimits) EndpointOption {
+	return func(e *Endpoint) error {
+		if limits.CookieThreshold < 0 || limits.SourceRate < 0 || limits.SourceBurst < 0 {
+			return errors.New("e3x: invalid handshake limits")
+		}
+
+		if limits.SourceRate > 0 && limits.SourceBurst == 0 {
+			limits.SourceBurst = int(limits.SourceRate + 0.999)
+			if limits.SourceBurst < 1 {
+				limits.SourceBurst = 1
+			}
+		}
+
+		guard := &handshakeGuard{
+			limits:     limits,
+			buckets:    make(map[string]*tokenBucket),
+			challenged: make(map[string]*challengedSource),
+		}
+
+		_, err := rand.Read(guard.secret[:])
+		if err != nil {
+			return err
+		}
+
+		e.handshakeGuard = guard
+		return nil
+	}
+}
+
+type handshakeGuard struct {
+	limits HandshakeLimits
+	secret [32]byte
+
+	mtx            sync.Mutex
+	window         time.Time
+	windowCount    int
+	windowFallback int
+	buckets        map[string]*tokenBucket
+	challenged     map[string]*challengedSource
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// challengedSource is a source which was sent a cookie challenge.
+type challengedSource struct {
+	since  time.Time
+	bucket tokenBucket
+}
+
+// admit decides what to do with a handshake (or cookie handshake) from addr.
+// It returns nil when the handshake may be decrypted.
+func (g *handshakeGuard) admit(addr net.Addr, csid uint8, cookie []byte) error {
+	if g == nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if g.limits.SourceRate > 0 && !g.take(sourceKey(addr), now) {
+		statHandshakeRateLimited.Add(1)
+		return ErrHandshakeRateLimited
+	}
+
+	if g.limits.CookieThreshold <= 0 {
+		return nil
+	}
+
+	if now.Sub(g.window) >= time.Second {
+		g.window = now
+		g.windowCount = 0
+		g.windowFallback = 0
+	}
+
+	if g.windowCount < g.limits.CookieThreshold {
+		g.windowCount++
+		return nil
+	}
+
+	if cookie == nil {
+		if g.fallback(sourceKey(addr), now) {
+			statHandshakeFallback.Add(1)
+			return nil
+		}
+		statHandshakeChallenged.Add(1)
+		return ErrHandshakeChallenged
+	}
+
+	if !g.verifyCookie(cookie, addr, csid, now) {
+		statHandshakeBadCookie.Add(1)
+		return ErrHandshakeChallenged
+	}
+
+	return nil
+}
+
+// fallback returns true when a plain handshake from a source which did not
+// answer its cookie challenge may be decrypted. The source is remembered as
+// challenged otherwise.
+func (g *handshakeGuard) fallback(source string, now time.Time) bool {
+	s := g.challenged[source]
+	if s == nil || now.Sub(s.bucket.last) > fallbackLifetime {
+		if len(g.challenged) >= maxHandshakeBuckets {
+			g.pruneChallenged(now)
+		}
+		g.challenged[source] = &challengedSource{since: now, bucket: tokenBucket{tokens: 1, last: now}}
+		return false
+	}
+
+	if now.Sub(s.since) < cookieFallbackDelay {
+		return false
+	}
+
+	s.bucket.tokens += now.Sub(s.bucket.last).Seconds() * fallbackSourceRate
+	if s.bucket.tokens > 1 {
+		s.bucket.tokens = 1
+	}
+	s.bucket.last = now
+
+	if s.bucket.tokens < 1 || g.windowFallback >= g.limits.CookieThreshold {
+		return false
+	}
+
+	s.bucket.tokens--
+	g.windowFallback++
+	return true
+}
+
+// pruneChallenged forgets the sources which were not seen for
+// fallbackLifetime. When that is not enough all sources are forgotten.
+func (g *handshakeGuard) pruneChallenged(now time.Time) {
+	for source, s := range g.challenged {
+		if now.Sub(s.bucket.last) > fallbackLifetime {
+			delete(g.challenged, source)
+		}
+	}
+
+	if len(g.challenged) >= maxHandshakeBuckets {
+		g.challenged = make(map[string]*challengedSource)
+	}
+}
+
+// take removes a token from the bucket of source.
+func (g *handshakeGuard) take(source string, now time.Time) bool {
+	b := g.buckets[source]
+	if b == nil {
+		if len(g.buckets) >= maxHandshakeBuckets {
+			g.pruneBuckets(now)
+		}
+		b = &tokenBucket{tokens: float64(g.limits.SourceBurst), last: now}
+		g.buckets[source] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * g.limits.SourceRate
+	if max := float64(g.limits.SourceBurst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// pruneBuckets forgets the sources whose buckets are full again. When that is
+// not enough all buckets are forgotten.
+func (g *handshakeGuard) pruneBuckets(now time.Time) {
+	burst := float64(g.limits.SourceBurst)
+	for source, b := range g.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*g.limits.SourceRate >= burst {
+			delete(g.buckets, source)
+		}
+	}
+
+	if len(g.buckets) >= maxHandshakeBuckets {
+		g.buckets = make(map[string]*tokenBucket)
+	}
+}
+
+func (g *handshakeGuard) makeCookie(addr net.Addr, csid uint8, now time.Time) []byte {
+	cookie := make([]byte, cookieSize)
+	binary.BigEndian.PutUint32(cookie, uint32(now.Unix()))
+	copy(cookie[4:], g.cookieMAC(cookie[:4], addr, csid))
+	return cookie
+}
+
+func (g *handshakeGuard) verifyCookie(cookie []byte, addr net.Addr, csid uint8, now time.Time) bool {
+	if len(cookie) != cookieSize {
+		return false
+	}
+
+	issued := time.Unix(int64(binary.BigEndian.Uint32(cookie)), 0)
+	if now.Sub(issued) > cookieLifetime || issued.Sub(now) > time.Second {
+		return false
+	}
+
+	return hmac.Equal(cookie[4:], g.cookieMAC(cookie[:4], addr, csid))
+}
+
+func (g *handshakeGuard) cookieMAC(ts []byte, addr net.Addr, csid uint8) []byte {
+	mac := hmac.New(sha256.New, g.secret[:])
+	mac.Write(ts)
+	mac.Write([]byte{csid})
+	mac.Write([]byte(sourceKey(addr)))
+	return mac.Sum(nil)[:16]
+}
+
+// challenge sends a cookie challenge to conn.
+func (g *handshakeGuard) challenge(conn net.Conn, csid uint8) {
+	g.mtx.Lock()
+	cookie := g.makeCookie(conn.RemoteAddr(), csid, time.Now())
+	g.mtx.Unlock()
+
+	pkt := lob.New(cookie).SetHeader(lob.Header{Bytes: []byte{0, cookieMarker}})
+	buf, err := lob.Encode(pkt)
+	if err != nil {
+		return
+	}
+	conn.Write(buf.RawBytes())
+	buf.Free()
+}
+
+func sourceKey(addr net.Addr) string {
+	s := addr.String()
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return s
+}
+
+// isCookieChallenge returns true when raw is a cookie challenge.
+func isCookieChallenge(raw []byte) bool {
+	return len(raw) == 4+cookieSize && raw[0] == 0 && raw[1] == 2 && raw[2] == 0 && raw[3] == cookieMarker
+}
+
+// isCookieHandshake returns true when raw is a handshake with an echoed
+// cookie.
+func isCookieHandshake(raw []byte) bool {
+	return len(raw) > 4+cookieSize && raw[0] == 0 && raw[1] == 2 && raw[2] != 0 && raw[3] == cookieMarker
+}
+
+// stripCookie turns a cookie handshake into a plain handshake and returns the
+// cookie.
+func stripCookie(msg *bufpool.Buffer) []byte {
+	raw := msg.RawBytes()
+
+	cookie := make([]byte, cookieSize)
+	copy(cookie, raw[4:])
+
+	n := copy(raw[3:], raw[4+cookieSize:])
+	raw[1] = 1
+	msg.SetLen(3 + n)
+
+	return cookie
+}
+
+// withCookie wraps the encoded handshake pkt in a cookie handshake.
+func withCookie(pkt *bufpool.Buffer, cookie []byte) *bufpool.Buffer {
+	raw := pkt.RawBytes()
+	if len(raw) < 3 || raw[0] != 0 || raw[1] != 1 {
+		return pkt
+	}
+
+	buf := make([]byte, 0, len(raw)+1+len(cookie))
+	buf = append(buf, 0, 2, raw[2], cookieMarker)
+	buf = append(buf, cookie...)
+	buf = append(buf, raw[3:]...)
+
+	out := bufpool.New().Set(buf)
+	pkt.Free()
+	return out
+}
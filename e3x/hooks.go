@@ -3,6 +3,9 @@ package e3x
 import (
 	"errors"
 	"net"
+
+	"github.com/telehash/gogotelehash/e3x/cipherset"
+	"github.com/telehash/gogotelehash/internal/lob"
 )
 
 var ErrStopPropagation = errors.New("observer: stop propagation")
@@ -26,6 +29,12 @@ type ChannelHooks struct {
 type EndpointHook struct {
 	OnNetChanged func(e *Endpoint, up, down []net.Addr) error
 	OnDropPacket func(e *Endpoint, msg []byte, conn net.Conn, reason error) error
+
+	// OnAcceptHandshake is called with the first handshake of an unknown peer
+	// before an exchange is created. Returning an error rejects the handshake
+	// (the error is passed to OnDropPacket); returning ErrStopPropagation
+	// accepts it without consulting the remaining hooks.
+	OnAcceptHandshake func(e *Endpoint, handshake cipherset.Handshake, ident *Identity, pipe *Pipe) error
 }
 
 type ExchangeHook struct {
@@ -37,6 +46,24 @@ type ExchangeHook struct {
 type ChannelHook struct {
 	OnOpened func(*Endpoint, *Exchange, *Channel) error
 	OnClosed func(*Endpoint, *Exchange, *Channel) error
+
+	// OnWritePacket and OnReceivedPacket intercept the packets of a channel.
+	// A hook returns the packet to pass it on (it may change the packet or
+	// return a new one) or nil to drop it. When a hook returns a different
+	// packet (or nil) it owns the original packet. Returning
+	// ErrStopPropagation passes the returned packet without consulting the
+	// remaining hooks.
+	//
+	// OnWritePacket is called before the channel adds its headers (c, seq,
+	// ack). The hook runs while the channel is locked and must not call
+	// methods of the channel. A failing hook fails the write; a dropped packet
+	// is never sent. `end` packets must not be dropped.
+	//
+	// OnReceivedPacket is called before the channel processes the packet. A
+	// failing hook drops the packet. A dropped packet of a reliable channel
+	// is treated as lost (the peer will resend it).
+	OnWritePacket    func(*Endpoint, *Exchange, *Channel, *lob.Packet) (*lob.Packet, error)
+	OnReceivedPacket func(*Endpoint, *Exchange, *Channel, *lob.Packet) (*lob.Packet, error)
 }
 
 func (h *EndpointHooks) Register(hook EndpointHook) {
@@ -108,6 +135,15 @@ func (s *EndpointHooks) DropPacket(msg []byte, conn net.Conn, reason error) erro
 	})
 }
 
+func (s *EndpointHooks) AcceptHandshake(handshake cipherset.Handshake, ident *Identity, pipe *Pipe) error {
+	return s.trigger(func(o EndpointHook) error {
+		if o.OnAcceptHandshake == nil {
+			return nil
+		}
+		return o.OnAcceptHandshake(s.endpoint, handshake, ident, pipe)
+	})
+}
+
 func (s *ExchangeHooks) Opened() error {
 	return s.trigger(func(o ExchangeHook) error {
 		if o.OnOpened == nil {
@@ -127,6 +163,10 @@ func (s *ExchangeHooks) Closed(reason error) error {
 }
 
 func (s *ExchangeHooks) DropPacket(msg []byte, pipe *Pipe, reason error) error {
+	if s.exchange != nil {
+		s.exchange.counters.drop()
+	}
+
 	return s.trigger(func(o ExchangeHook) error {
 		if o.OnDropPacket == nil {
 			return nil
@@ -152,3 +192,45 @@ func (s *ChannelHooks) Closed() error {
 		return o.OnClosed(s.endpoint, s.exchange, s.channel)
 	})
 }
+
+func (s *ChannelHooks) WritePacket(pkt *lob.Packet) (*lob.Packet, error) {
+	for _, o := range s.hooks {
+		if o.OnWritePacket == nil {
+			continue
+		}
+
+		var err error
+		pkt, err = o.OnWritePacket(s.endpoint, s.exchange, s.channel, pkt)
+		if err == ErrStopPropagation {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if pkt == nil {
+			break
+		}
+	}
+	return pkt, nil
+}
+
+func (s *ChannelHooks) ReceivedPacket(pkt *lob.Packet) (*lob.Packet, error) {
+	for _, o := range s.hooks {
+		if o.OnReceivedPacket == nil {
+			continue
+		}
+
+		var err error
+		pkt, err = o.OnReceivedPacket(s.endpoint, s.exchange, s.channel, pkt)
+		if err == ErrStopPropagation {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if pkt == nil {
+			break
+		}
+	}
+	return pkt, nil
+}
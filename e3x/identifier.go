@@ -20,7 +20,8 @@ type hashnameIdentifier hashname.H
 
 // HashnameIdentifier returns an identifer which identifies an Identity using only
 // information internal to an endpoint. In other words it will return the Identity
-// associated with a hashname if that information is available within the endpoint.
+// associated with a hashname if that information is available within the endpoint
+// (from an exchange or from the PeerStore).
 func HashnameIdentifier(hn hashname.H) Identifier {
 	return hashnameIdentifier(hn)
 }
@@ -28,9 +29,13 @@ func HashnameIdentifier(hn hashname.H) Identifier {
 func (i hashnameIdentifier) String() string { return string(i) }
 func (i hashnameIdentifier) Identify(endpoint *Endpoint) (*Identity, error) {
 	x := endpoint.hashnames[hashname.H(i)]
-	if x == nil {
-		return nil, ErrUnidentifiable
+	if x != nil {
+		return x.RemoteIdentity(), nil
 	}
 
-	return x.RemoteIdentity(), nil
+	if ident := endpoint.knownPeer(hashname.H(i)); ident != nil {
+		return ident, nil
+	}
+
+	return nil, ErrUnidentifiable
 }
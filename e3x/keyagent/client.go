@@ -0,0 +1,188 @@
+package keyagent
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/telehash/gogotelehash/e3x/cipherset"
+	"github.com/telehash/gogotelehash/internal/lob"
+	"github.com/telehash/gogotelehash/internal/util/base32util"
+)
+
+var _ cipherset.Agreer = (*key)(nil)
+
+// Agent is a connection to a key agent. When the connection breaks it is
+// re-established on the next request.
+type Agent struct {
+	path string
+
+	mtx    sync.Mutex
+	conn   net.Conn
+	closed bool
+}
+
+// Dial connects to the key agent listening on the unix socket at path.
+func Dial(path string) (*Agent, error) {
+	a := &Agent{path: path}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	a.conn = conn
+	return a, nil
+}
+
+// Close closes the connection to the agent. Keys returned by the agent can
+// no longer be used.
+func (a *Agent) Close() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.closed = true
+
+	if a.conn != nil {
+		err := a.conn.Close()
+		a.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+// Keys returns the keys served by the agent. None of them has a private key.
+// The keys of cipher sets the agent can agree on implement cipherset.Agreer;
+// the other keys are public keys which only contribute to the hashname.
+// The cipher sets of all keys must be registered.
+func (a *Agent) Keys() (cipherset.Keys, error) {
+	req := lob.New(nil)
+	hdr := req.Header()
+	hdr.Type, hdr.HasType = "keys", true
+
+	resp, err := a.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Free()
+
+	agree := make(map[uint8]bool)
+	for _, csid := range resp.Body(nil) {
+		agree[csid] = true
+	}
+
+	keys := make(cipherset.Keys, len(resp.Header().Extra))
+	for k, v := range resp.Header().Extra {
+		csid, err := hex.DecodeString(k)
+		if err != nil || len(csid) != 1 {
+			return nil, ErrAgentResponse
+		}
+
+		s, _ := v.(string)
+		pub, err := base32util.DecodeString(s)
+		if err != nil || len(pub) == 0 {
+			return nil, ErrAgentResponse
+		}
+
+		if !agree[csid[0]] {
+			k, err := cipherset.DecodeKeyBytes(csid[0], pub, nil)
+			if err != nil {
+				return nil, err
+			}
+			keys[csid[0]] = k
+			continue
+		}
+
+		keys[csid[0]] = &key{agent: a, csid: csid[0], pub: pub}
+	}
+
+	if len(agree) == 0 || len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	return keys, nil
+}
+
+func (a *Agent) agree(csid uint8, peer []byte) ([]byte, error) {
+	req := lob.New(peer)
+	hdr := req.Header()
+	hdr.Type, hdr.HasType = "agree", true
+	hdr.SetString("csid", hex.EncodeToString([]byte{csid}))
+
+	resp, err := a.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Free()
+
+	return resp.Body(nil), nil
+}
+
+func (a *Agent) roundTrip(req *lob.Packet) (*lob.Packet, error) {
+	defer req.Free()
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.closed {
+		return nil, ErrClosed
+	}
+
+	if a.conn == nil {
+		conn, err := net.Dial("unix", a.path)
+		if err != nil {
+			return nil, err
+		}
+		a.conn = conn
+	}
+
+	err := writePacket(a.conn, req)
+	if err != nil {
+		a.conn.Close()
+		a.conn = nil
+		return nil, err
+	}
+
+	resp, err := readPacket(a.conn)
+	if err != nil {
+		a.conn.Close()
+		a.conn = nil
+		return nil, err
+	}
+
+	if msg, ok := resp.Header().GetString("err"); ok {
+		resp.Free()
+		return nil, errors.New(msg)
+	}
+
+	return resp, nil
+}
+
+// key is a key whose private half is held by the agent.
+type key struct {
+	agent *Agent
+	csid  uint8
+	pub   []byte
+}
+
+func (k *key) CSID() uint8      { return k.csid }
+func (k *key) Private() []byte  { return nil }
+func (k *key) CanSign() bool    { return true }
+func (k *key) CanEncrypt() bool { return true }
+
+func (k *key) String() string {
+	return base32util.EncodeToString(k.pub)
+}
+
+func (k *key) Public() []byte {
+	buf := make([]byte, len(k.pub))
+	copy(buf, k.pub)
+	return buf
+}
+
+// Agree asks the agent to perform the key agreement with peer.
+func (k *key) Agree(peer []byte) ([]byte, error) {
+	return k.agent.agree(k.csid, peer)
+}
@@ -0,0 +1,252 @@
+// Package keyagent implements a key agent for endpoint identities.
+//
+// A key agent is a local daemon which holds the long-term private keys of an
+// endpoint and performs the key agreements (ECDH) the cipher sets need on
+// behalf of the endpoint. The endpoint process only ever sees the public keys,
+// so a compromised endpoint process does not leak the hashname keys.
+//
+// The agent listens on a unix socket. Requests and responses are LOB packets
+// prefixed with their length as a 16 bit big endian integer:
+//
+//   request                           response
+//   {"type":"keys"}                   {"1a":"<public key>",...} AGREE
+//   {"type":"agree","csid":"3a"} PEER {} SHARED
+//
+// Failed requests are answered with {"err":"<message>"}.
+//
+// The public keys of all cipher sets are served, so the endpoint has the same
+// hashname as with the key file. Only keys which implement cipherset.Agreer
+// (cipher sets 1a and 3a) can be used for key agreements; their CSIDs are
+// listed in AGREE (one byte per CSID).
+package keyagent
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/telehash/gogotelehash/e3x/cipherset"
+	"github.com/telehash/gogotelehash/internal/lob"
+	"github.com/telehash/gogotelehash/internal/util/bufpool"
+)
+
+const maxFrameSize = 1500
+
+var (
+	ErrNoKeys        = errors.New("keyagent: no usable keys")
+	ErrUnknownKey    = errors.New("keyagent: unknown key")
+	ErrInvalidFrame  = errors.New("keyagent: invalid frame")
+	ErrAgentResponse = errors.New("keyagent: invalid response")
+	ErrUnknownType   = errors.New("keyagent: unknown request type")
+	ErrClosed        = errors.New("keyagent: agent is closed")
+)
+
+// Server serves the key agreements of a set of keys.
+type Server struct {
+	keys   map[uint8]cipherset.Agreer
+	public map[uint8]cipherset.Key
+
+	mtx   sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewServer makes a Server for keys. Keys which can not perform a key
+// agreement are only served as public keys.
+func NewServer(keys cipherset.Keys) (*Server, error) {
+	s := &Server{
+		keys:   make(map[uint8]cipherset.Agreer, len(keys)),
+		public: make(map[uint8]cipherset.Key, len(keys)),
+		conns:  make(map[net.Conn]struct{}),
+	}
+
+	for csid, key := range keys {
+		if key == nil {
+			continue
+		}
+		s.public[csid] = key
+		if agreer, ok := key.(cipherset.Agreer); ok && key.CanSign() {
+			s.keys[csid] = agreer
+		}
+	}
+
+	if len(s.keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	return s, nil
+}
+
+// ListenAndServe listens on the unix socket at path and serves keys. A stale
+// socket file at path is removed. The socket is only accessible by the owner.
+func ListenAndServe(path string, keys cipherset.Keys) error {
+	s, err := NewServer(keys)
+	if err != nil {
+		return err
+	}
+
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	defer s.closeConns()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		s.mtx.Lock()
+		s.conns[conn] = struct{}{}
+		s.mtx.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) closeConns() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, conn)
+		s.mtx.Unlock()
+
+		conn.Close()
+	}()
+
+	for {
+		req, err := readPacket(conn)
+		if err != nil {
+			return
+		}
+
+		resp := s.handle(req)
+		req.Free()
+
+		err = writePacket(conn, resp)
+		resp.Free()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) handle(req *lob.Packet) *lob.Packet {
+	switch req.Header().Type {
+
+	case "keys":
+		var agree []byte
+		for csid := range s.keys {
+			agree = append(agree, csid)
+		}
+
+		resp := lob.New(agree)
+		for csid, key := range s.public {
+			resp.Header().SetString(hex.EncodeToString([]byte{csid}), key.String())
+		}
+		return resp
+
+	case "agree":
+		csid, _ := req.Header().GetString("csid")
+		key := s.keys[parseCSID(csid)]
+		if key == nil {
+			return errorPacket(ErrUnknownKey)
+		}
+
+		shared, err := key.Agree(req.Body(nil))
+		if err != nil {
+			return errorPacket(err)
+		}
+
+		return lob.New(shared)
+
+	default:
+		return errorPacket(ErrUnknownType)
+
+	}
+}
+
+func errorPacket(err error) *lob.Packet {
+	pkt := lob.New(nil)
+	pkt.Header().SetString("err", err.Error())
+	return pkt
+}
+
+func parseCSID(s string) uint8 {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 1 {
+		return 0
+	}
+	return b[0]
+}
+
+func readPacket(r io.Reader) (*lob.Packet, error) {
+	var size [2]byte
+
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return nil, err
+	}
+
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n > maxFrameSize {
+		return nil, ErrInvalidFrame
+	}
+
+	buf := bufpool.New().SetLen(n)
+	defer buf.Free()
+
+	_, err = io.ReadFull(r, buf.RawBytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return lob.Decode(buf)
+}
+
+func writePacket(w io.Writer, pkt *lob.Packet) error {
+	buf, err := lob.Encode(pkt)
+	if err != nil {
+		return err
+	}
+	defer buf.Free()
+
+	if buf.Len() > maxFrameSize {
+		return ErrInvalidFrame
+	}
+
+	var frame = make([]byte, 2+buf.Len())
+	binary.BigEndian.PutUint16(frame, uint16(buf.Len()))
+	copy(frame[2:], buf.RawBytes())
+
+	_, err = w.Write(frame)
+	return err
+}
@@ -0,0 +1,188 @@
+package keyagent
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+
+	"github.com/telehash/gogotelehash/e3x/cipherset"
+	_ "github.com/telehash/gogotelehash/e3x/cipherset/cs1a"
+	_ "github.com/telehash/gogotelehash/e3x/cipherset/cs2a"
+	_ "github.com/telehash/gogotelehash/e3x/cipherset/cs3a"
+)
+
+func withAgent(t *testing.T, f func(agent *Agent, keys cipherset.Keys, l net.Listener)) {
+	keys, err := cipherset.GenerateKeys(0x1a, 0x2a, 0x3a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "keyagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewServer(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go s.Serve(l)
+
+	agent, err := Dial(filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	f(agent, keys, l)
+}
+
+func TestAgentKeys(t *testing.T) {
+	withAgent(t, func(agent *Agent, keys cipherset.Keys, l net.Listener) {
+		assert := assert.New(t)
+
+		agentKeys, err := agent.Keys()
+		if !assert.NoError(err) {
+			return
+		}
+
+		// cs2a keys can not be used through an agent; only the public key is
+		// served
+		assert.Len(agentKeys, 3)
+		if assert.NotNil(agentKeys[0x2a]) {
+			assert.Equal(keys[0x2a].Public(), agentKeys[0x2a].Public())
+			assert.False(agentKeys[0x2a].CanSign())
+			_, ok := agentKeys[0x2a].(cipherset.Agreer)
+			assert.False(ok)
+		}
+
+		for _, csid := range []uint8{0x1a, 0x3a} {
+			if assert.NotNil(agentKeys[csid]) {
+				assert.Equal(keys[csid].Public(), agentKeys[csid].Public())
+				assert.Nil(agentKeys[csid].Private())
+			}
+		}
+	})
+}
+
+func TestAgentHandshake(t *testing.T) {
+	withAgent(t, func(agent *Agent, keys cipherset.Keys, l net.Listener) {
+		assert := assert.New(t)
+
+		agentKeys, err := agent.Keys()
+		if !assert.NoError(err) {
+			return
+		}
+
+		for _, csid := range []uint8{0x1a, 0x3a} {
+			var (
+				local  = agentKeys[csid]
+				remote cipherset.Key
+			)
+
+			remote, err = cipherset.GenerateKey(csid)
+			if !assert.NoError(err) {
+				return
+			}
+
+			{ // agent side encrypts
+				s, err := cipherset.NewState(csid, local)
+				if !assert.NoError(err) {
+					return
+				}
+				assert.NoError(s.SetRemoteKey(remote))
+
+				box, err := s.EncryptHandshake(1, nil)
+				if !assert.NoError(err) {
+					return
+				}
+
+				h, err := cipherset.DecryptHandshake(csid, remote, box)
+				if assert.NoError(err) {
+					assert.Equal(local.Public(), h.PublicKey().Public())
+				}
+			}
+
+			{ // agent side decrypts
+				s, err := cipherset.NewState(csid, remote)
+				if !assert.NoError(err) {
+					return
+				}
+
+				localPub, err := cipherset.DecodeKeyBytes(csid, local.Public(), nil)
+				if !assert.NoError(err) {
+					return
+				}
+				assert.NoError(s.SetRemoteKey(localPub))
+
+				box, err := s.EncryptHandshake(1, nil)
+				if !assert.NoError(err) {
+					return
+				}
+
+				h, err := cipherset.DecryptHandshake(csid, local, box)
+				if assert.NoError(err) {
+					assert.Equal(remote.Public(), h.PublicKey().Public())
+				}
+
+				box, err = s.EncryptMessage([]byte("Hello World!"))
+				if !assert.NoError(err) {
+					return
+				}
+
+				msg, err := cipherset.DecryptMessage(csid, local, remote, box)
+				if assert.NoError(err) {
+					assert.Equal([]byte("Hello World!"), msg)
+				}
+			}
+		}
+	})
+}
+
+func TestAgentGone(t *testing.T) {
+	withAgent(t, func(agent *Agent, keys cipherset.Keys, l net.Listener) {
+		assert := assert.New(t)
+
+		agentKeys, err := agent.Keys()
+		if !assert.NoError(err) {
+			return
+		}
+
+		remote, err := cipherset.GenerateKey(0x3a)
+		if !assert.NoError(err) {
+			return
+		}
+
+		l.Close()
+
+		// wait for the server to drop its connections
+		for i := 0; i < 100; i++ {
+			_, err = agentKeys[0x3a].(cipherset.Agreer).Agree(remote.Public())
+			if err != nil {
+				break
+			}
+		}
+		assert.Error(err)
+
+		s, err := cipherset.NewState(0x3a, agentKeys[0x3a])
+		if !assert.NoError(err) {
+			return
+		}
+		assert.NoError(s.SetRemoteKey(remote))
+
+		_, err = s.EncryptHandshake(1, nil)
+		assert.Equal(cipherset.ErrInvalidState, err)
+	})
+}
@@ -0,0 +1,324 @@
+// Package keyfile reads and writes key files.
+//
+// A key file holds the private keys of an endpoint. It is either stored as
+// plain JSON:
+//
+//   {
+//     "hashname": "...",
+//     "parts": { "1a": "...", ... },
+//     "keys":  { "1a": { "pub": "...", "prv": "..." }, ... }
+//   }
+//
+// or as an encrypted envelope around that same JSON document:
+//
+//   {
+//     "version":    1,
+//     "hashname":   "...",
+//     "kdf":        { "name": "scrypt", "salt": "...", "n": 32768, "r": 8, "p": 1 },
+//     "cipher":     { "name": "chacha20-poly1305", "nonce": "..." },
+//     "ciphertext": "..."
+//   }
+//
+// The encryption key is derived from a passphrase with the KDF. The plain
+// document is sealed with the cipher; the version, hashname and KDF parameters
+// are authenticated as additional data. All binary values are base32 encoded.
+package keyfile
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/golang.org/x/crypto/chacha20poly1305"
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/golang.org/x/crypto/scrypt"
+
+	"github.com/telehash/gogotelehash/e3x/cipherset"
+	"github.com/telehash/gogotelehash/internal/hashname"
+	"github.com/telehash/gogotelehash/internal/util/base32util"
+)
+
+// Version is the version of the encrypted key file format written by this package.
+const Version = 1
+
+const (
+	kdfScrypt        = "scrypt"
+	cipherChaCha20   = "chacha20-poly1305"
+	defaultScryptN   = 1 << 15
+	defaultScryptR   = 8
+	defaultScryptP   = 1
+	lenSalt          = 32
+	maxScryptN       = 1 << 22
+	maxScryptRP      = 1 << 10
+	lenEncryptionKey = chacha20poly1305.KeySize
+)
+
+var (
+	ErrNoPassphrase       = errors.New("keyfile: key file is encrypted but no passphrase was provided")
+	ErrWrongPassphrase    = errors.New("keyfile: wrong passphrase or corrupt key file")
+	ErrUnsupportedVersion = errors.New("keyfile: unsupported key file version")
+	ErrUnsupportedKDF     = errors.New("keyfile: unsupported key derivation function")
+	ErrUnsupportedCipher  = errors.New("keyfile: unsupported cipher")
+	ErrInvalidFile        = errors.New("keyfile: invalid key file")
+	ErrHashnameMismatch   = errors.New("keyfile: hashname does not match the keys")
+)
+
+// PassphraseFunc is called to obtain the passphrase of an encrypted key file.
+type PassphraseFunc func() ([]byte, error)
+
+// File is the content of a key file.
+type File struct {
+	Hashname hashname.H            `json:"hashname,omitempty"`
+	Parts    cipherset.Parts       `json:"parts,omitempty"`
+	Keys     cipherset.PrivateKeys `json:"keys,omitempty"`
+}
+
+type envelope struct {
+	header
+	Cipher     cipherParams `json:"cipher"`
+	Ciphertext string       `json:"ciphertext"`
+}
+
+// header contains the fields which are authenticated as additional data.
+type header struct {
+	Version  int        `json:"version"`
+	Hashname hashname.H `json:"hashname,omitempty"`
+	KDF      kdfParams  `json:"kdf"`
+}
+
+type kdfParams struct {
+	Name string `json:"name"`
+	Salt string `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+}
+
+type cipherParams struct {
+	Name  string `json:"name"`
+	Nonce string `json:"nonce"`
+}
+
+// New makes a File for keys.
+func New(keys cipherset.Keys) (*File, error) {
+	parts := hashname.PartsFromKeys(keys)
+
+	hn, err := hashname.FromIntermediates(parts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{Hashname: hn, Parts: parts, Keys: cipherset.PrivateKeys(keys)}, nil
+}
+
+// Load reads and decodes the key file at path. passphrase is only called when
+// the key file is encrypted.
+func Load(path string, passphrase PassphraseFunc) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return Decode(data, passphrase)
+}
+
+// IsEncrypted returns true when data contains an encrypted key file.
+func IsEncrypted(data []byte) bool {
+	var probe struct {
+		Version    int    `json:"version"`
+		Ciphertext string `json:"ciphertext"`
+	}
+
+	if json.Unmarshal(data, &probe) != nil {
+		return false
+	}
+
+	return probe.Version != 0 || probe.Ciphertext != ""
+}
+
+// Decode decodes a plain or encrypted key file. passphrase is only called when
+// the key file is encrypted.
+func Decode(data []byte, passphrase PassphraseFunc) (*File, error) {
+	if !IsEncrypted(data) {
+		return decodePlain(data)
+	}
+
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, ErrInvalidFile
+	}
+
+	if env.Version != Version {
+		return nil, ErrUnsupportedVersion
+	}
+
+	if env.Cipher.Name != cipherChaCha20 {
+		return nil, ErrUnsupportedCipher
+	}
+
+	if passphrase == nil {
+		return nil, ErrNoPassphrase
+	}
+
+	pass, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := deriveKey(pass, env.KDF)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := base32util.DecodeString(env.Cipher.Nonce)
+	if err != nil || len(nonce) != chacha20poly1305.NonceSize {
+		return nil, ErrInvalidFile
+	}
+
+	ciphertext, err := base32util.DecodeString(env.Ciphertext)
+	if err != nil {
+		return nil, ErrInvalidFile
+	}
+
+	ad, err := json.Marshal(env.header)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	f, err := decodePlain(plain)
+	if err != nil {
+		return nil, err
+	}
+
+	if env.Hashname != "" && env.Hashname != f.Hashname {
+		return nil, ErrHashnameMismatch
+	}
+
+	return f, nil
+}
+
+func decodePlain(data []byte) (*File, error) {
+	var f File
+
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+
+	if len(f.Keys) == 0 {
+		return nil, ErrInvalidFile
+	}
+
+	hn, err := hashname.FromKeys(cipherset.Keys(f.Keys))
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Hashname != "" && f.Hashname != hn {
+		return nil, ErrHashnameMismatch
+	}
+
+	f.Hashname = hn
+	if f.Parts == nil {
+		f.Parts = hashname.PartsFromKeys(cipherset.Keys(f.Keys))
+	}
+
+	return &f, nil
+}
+
+// Encode encodes f as a plain (unencrypted) key file.
+func (f *File) Encode() ([]byte, error) {
+	return json.MarshalIndent(f, "", "  ")
+}
+
+// Encrypt encodes f as a key file encrypted with passphrase.
+func (f *File) Encrypt(passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrNoPassphrase
+	}
+
+	plain, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		salt  = make([]byte, lenSalt)
+		nonce = make([]byte, chacha20poly1305.NonceSize)
+	)
+
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	env := envelope{
+		header: header{
+			Version:  Version,
+			Hashname: f.Hashname,
+			KDF: kdfParams{
+				Name: kdfScrypt,
+				Salt: base32util.EncodeToString(salt),
+				N:    defaultScryptN,
+				R:    defaultScryptR,
+				P:    defaultScryptP,
+			},
+		},
+		Cipher: cipherParams{
+			Name:  cipherChaCha20,
+			Nonce: base32util.EncodeToString(nonce),
+		},
+	}
+
+	key, err := deriveKey(passphrase, env.KDF)
+	if err != nil {
+		return nil, err
+	}
+
+	ad, err := json.Marshal(env.header)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	env.Ciphertext = base32util.EncodeToString(aead.Seal(nil, nonce, plain, ad))
+
+	return json.MarshalIndent(env, "", "  ")
+}
+
+func deriveKey(passphrase []byte, params kdfParams) ([]byte, error) {
+	if params.Name != kdfScrypt {
+		return nil, ErrUnsupportedKDF
+	}
+
+	// reject parameters which would make decoding unreasonably expensive
+	if params.N <= 1 || params.N > maxScryptN || params.N&(params.N-1) != 0 ||
+		params.R <= 0 || params.R > maxScryptRP ||
+		params.P <= 0 || params.P > maxScryptRP {
+		return nil, ErrInvalidFile
+	}
+
+	salt, err := base32util.DecodeString(params.Salt)
+	if err != nil || len(salt) == 0 {
+		return nil, ErrInvalidFile
+	}
+
+	return scrypt.Key(passphrase, salt, params.N, params.R, params.P, lenEncryptionKey)
+}
@@ -0,0 +1,103 @@
+package keyfile
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+
+	"github.com/telehash/gogotelehash/e3x/cipherset"
+	_ "github.com/telehash/gogotelehash/e3x/cipherset/cs3a"
+)
+
+func newTestFile(t *testing.T) *File {
+	key, err := cipherset.GenerateKey(0x3a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := New(cipherset.Keys{0x3a: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func passphrase(s string) PassphraseFunc {
+	return func() ([]byte, error) { return []byte(s), nil }
+}
+
+func TestPlainRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	f := newTestFile(t)
+
+	data, err := f.Encode()
+	assert.NoError(err)
+	assert.False(IsEncrypted(data))
+
+	g, err := Decode(data, nil)
+	if assert.NoError(err) {
+		assert.Equal(f.Hashname, g.Hashname)
+		assert.Equal(f.Keys[0x3a].Private(), g.Keys[0x3a].Private())
+	}
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	f := newTestFile(t)
+
+	data, err := f.Encrypt([]byte("secret"))
+	assert.NoError(err)
+	assert.True(IsEncrypted(data))
+	assert.NotContains(string(data), f.Keys[0x3a].String())
+
+	g, err := Decode(data, passphrase("secret"))
+	if assert.NoError(err) {
+		assert.Equal(f.Hashname, g.Hashname)
+		assert.Equal(f.Keys[0x3a].Private(), g.Keys[0x3a].Private())
+	}
+
+	_, err = Decode(data, passphrase("wrong"))
+	assert.Equal(ErrWrongPassphrase, err)
+
+	_, err = Decode(data, nil)
+	assert.Equal(ErrNoPassphrase, err)
+
+	errCallback := errors.New("no terminal")
+	_, err = Decode(data, func() ([]byte, error) { return nil, errCallback })
+	assert.Equal(errCallback, err)
+
+	_, err = f.Encrypt(nil)
+	assert.Equal(ErrNoPassphrase, err)
+}
+
+func TestEncryptedHeaderIsAuthenticated(t *testing.T) {
+	assert := assert.New(t)
+	f := newTestFile(t)
+
+	data, err := f.Encrypt([]byte("secret"))
+	assert.NoError(err)
+
+	tamper := func(fn func(env *envelope)) []byte {
+		var env envelope
+		assert.NoError(json.Unmarshal(data, &env))
+		fn(&env)
+		out, err := json.Marshal(env)
+		assert.NoError(err)
+		return out
+	}
+
+	_, err = Decode(tamper(func(env *envelope) { env.Hashname = newTestFile(t).Hashname }), passphrase("secret"))
+	assert.Equal(ErrWrongPassphrase, err)
+
+	_, err = Decode(tamper(func(env *envelope) { env.Version = 2 }), passphrase("secret"))
+	assert.Equal(ErrUnsupportedVersion, err)
+
+	_, err = Decode(tamper(func(env *envelope) { env.KDF.Name = "argon2id" }), passphrase("secret"))
+	assert.Equal(ErrUnsupportedKDF, err)
+
+	_, err = Decode(tamper(func(env *envelope) { env.KDF.N = 1 << 30 }), passphrase("secret"))
+	assert.Equal(ErrInvalidFile, err)
+}
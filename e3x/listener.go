@@ -2,10 +2,14 @@ package e3x
 
 import (
 	"container/list"
+	"context"
 	"errors"
 	"io"
 	"net"
 	"sync"
+
+	"github.com/telehash/gogotelehash/internal/hashname"
+	"github.com/telehash/gogotelehash/internal/lob"
 )
 
 var (
@@ -21,6 +25,7 @@ type listenerSet struct {
 	mtx       sync.RWMutex
 	parent    *listenerSet
 	listeners map[string]*Listener
+	handler   Handler // serves channels without a listener
 }
 
 var (
@@ -71,6 +76,29 @@ func (set *listenerSet) Get(typ string) *Listener {
 	return l
 }
 
+// Handler returns the handler for channels without a listener (or nil).
+func (set *listenerSet) Handler() Handler {
+	if set == nil {
+		return nil
+	}
+
+	set.mtx.RLock()
+	h := set.handler
+	set.mtx.RUnlock()
+
+	if h == nil {
+		h = set.parent.Handler()
+	}
+
+	return h
+}
+
+func (set *listenerSet) setHandler(h Handler) {
+	set.mtx.Lock()
+	set.handler = h
+	set.mtx.Unlock()
+}
+
 func (set *listenerSet) remove(typ string) {
 	set.mtx.Lock()
 	defer set.mtx.Unlock()
@@ -92,7 +120,7 @@ func (set *listenerSet) dropChannel(c *Channel, reason error) {
 	}
 }
 
-func (set *listenerSet) Listen(typ string, reliable bool) *Listener {
+func (set *listenerSet) Listen(typ string, reliable bool, options ...ListenerOption) *Listener {
 	set.mtx.Lock()
 	defer set.mtx.Unlock()
 
@@ -105,10 +133,27 @@ func (set *listenerSet) Listen(typ string, reliable bool) *Listener {
 	}
 
 	l := newListener(set, typ, reliable, 0)
+	for _, option := range options {
+		option(l)
+	}
 	set.listeners[typ] = l
 	return l
 }
 
+// ListenerOption configures a Listener.
+type ListenerOption func(l *Listener)
+
+// WithBacklog sets the maximum number of channels which are waiting to be
+// accepted (default: 512). Additional channels are dropped. n <= 0 keeps the
+// default.
+func WithBacklog(n int) ListenerOption {
+	return func(l *Listener) {
+		if n > 0 {
+			l.maxBacklogSize = n
+		}
+	}
+}
+
 type Listener struct {
 	mtx sync.Mutex
 	cnd *sync.Cond
@@ -180,15 +225,32 @@ func (l *Listener) Accept() (net.Conn, error) {
 }
 
 func (l *Listener) AcceptChannel() (*Channel, error) {
+	return l.AcceptChannelContext(context.Background())
+}
+
+// AcceptChannelContext is like AcceptChannel but gives up when ctx is done.
+func (l *Listener) AcceptChannelContext(ctx context.Context) (*Channel, error) {
+	return l.next(ctx)
+}
+
+// next removes the next channel from the backlog.
+func (l *Listener) next(ctx context.Context) (*Channel, error) {
 	if l == nil {
 		return nil, io.EOF
 	}
 
+	stop := context.AfterFunc(ctx, func() {
+		l.mtx.Lock()
+		l.cnd.Broadcast()
+		l.mtx.Unlock()
+	})
+	defer stop()
+
 	l.mtx.Lock()
 	defer l.mtx.Unlock()
 
 WAIT:
-	for !l.closed && l.backlogSize == 0 {
+	for !l.closed && l.backlogSize == 0 && ctx.Err() == nil {
 		l.cnd.Wait()
 	}
 
@@ -196,6 +258,10 @@ WAIT:
 		return nil, io.EOF
 	}
 
+	if l.backlogSize == 0 {
+		return nil, ctx.Err()
+	}
+
 	elem := l.queue.Front()
 	if elem == nil {
 		goto WAIT
@@ -244,3 +310,96 @@ func (l *Listener) Close() error {
 	l.cnd.Broadcast()
 	return nil
 }
+
+// requeue puts a channel back in front of the backlog.
+func (l *Listener) requeue(c *Channel) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.closed {
+		l.set.dropChannel(c, ErrListenerClosed)
+		return
+	}
+
+	l.queue.PushFront(c)
+	l.backlogSize++
+	l.cnd.Signal()
+}
+
+// AcceptRequest is a request of a remote peer to open a channel. It is
+// returned by Listener.AcceptRequest after the initial packet of the channel
+// was received. The request must be accepted or rejected.
+type AcceptRequest struct {
+	c      *Channel
+	header lob.Header
+}
+
+// AcceptRequest waits for the next channel and returns it as a request which
+// can be inspected before it is accepted or rejected.
+func (l *Listener) AcceptRequest() (*AcceptRequest, error) {
+	return l.AcceptRequestContext(context.Background())
+}
+
+// AcceptRequestContext is like AcceptRequest but gives up when ctx is done.
+func (l *Listener) AcceptRequestContext(ctx context.Context) (*AcceptRequest, error) {
+	for {
+		c, err := l.next(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		hdr, err := c.waitInitialPacket(ctx)
+		if err != nil && ctx.Err() != nil {
+			l.requeue(c)
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			// the channel broke before its initial packet was received
+			continue
+		}
+
+		return &AcceptRequest{c: c, header: hdr}, nil
+	}
+}
+
+// RemoteIdentity returns the identity of the peer which opened the channel.
+func (r *AcceptRequest) RemoteIdentity() *Identity {
+	return r.c.RemoteIdentity()
+}
+
+// RemoteHashname returns the hashname of the peer which opened the channel.
+func (r *AcceptRequest) RemoteHashname() hashname.H {
+	return r.c.RemoteHashname()
+}
+
+// Type returns the type of the requested channel.
+func (r *AcceptRequest) Type() string {
+	return r.c.typ
+}
+
+// Reliable returns true when the requested channel is reliable.
+func (r *AcceptRequest) Reliable() bool {
+	return r.c.reliable
+}
+
+// Header returns the header of the initial packet (without the channel
+// headers c, seq, ack, miss, type and end). It must not be modified.
+func (r *AcceptRequest) Header() *lob.Header {
+	return &r.header
+}
+
+// Accept accepts the request and returns the channel. The initial packet is
+// the first packet read from the channel.
+func (r *AcceptRequest) Accept() *Channel {
+	return r.c
+}
+
+// Reject refuses the request. The peer receives an `err` packet with reason.
+func (r *AcceptRequest) Reject(reason error) error {
+	// a server channel must read the initial packet before it can respond
+	if pkt, err := r.c.ReadPacket(); err == nil {
+		pkt.Free()
+	}
+
+	return r.c.Error(reason)
+}
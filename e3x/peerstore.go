@@ -0,0 +1,257 @@
+package e3x
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/telehash/gogotelehash/internal/hashname"
+	"github.com/telehash/gogotelehash/internal/util/logs"
+)
+
+// PeerRecord is what a PeerStore remembers about a peer.
+type PeerRecord struct {
+	// Identity of the peer with its last working paths (best path first).
+	Identity *Identity `json:"identity"`
+
+	// Latency is the smoothed latency of the best path (zero when unknown).
+	// It is the initial latency of that path when the peer is dialed again.
+	Latency time.Duration `json:"latency,omitempty"`
+
+	// LastSeen is the last time an exchange with the peer was open.
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// PeerStore persists the identities and paths of remote peers so they can
+// be dialed by hashname after a restart (see HashnameIdentifier).
+type PeerStore interface {
+	// Load returns all the stored peers. It is called when the endpoint is
+	// opened.
+	Load() ([]*PeerRecord, error)
+
+	// Save stores (or replaces) the record of a peer.
+	Save(rec *PeerRecord) error
+}
+
+// Peers remembers remote peers in store. The stored peers are loaded when the
+// endpoint is opened and are saved whenever an exchange opens or closes.
+func Peers(store PeerStore) EndpointOption {
+	return func(e *Endpoint) error {
+		records, err := store.Load()
+		if err != nil {
+			return err
+		}
+
+		e.peerStore = store
+		e.peers = make(map[hashname.H]*PeerRecord, len(records))
+		for _, rec := range records {
+			if rec != nil && rec.Identity != nil {
+				e.peers[rec.Identity.Hashname()] = rec
+			}
+		}
+
+		e.exchangeHooks.Register(ExchangeHook{
+			OnOpened: func(e *Endpoint, x *Exchange) error {
+				e.savePeer(x)
+				return nil
+			},
+			OnClosed: func(e *Endpoint, x *Exchange, reason error) error {
+				e.savePeer(x)
+				return nil
+			},
+		})
+
+		return nil
+	}
+}
+
+// knownPeer returns the stored identity of hn or nil.
+func (e *Endpoint) knownPeer(hn hashname.H) *Identity {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if rec := e.peers[hn]; rec != nil {
+		return rec.Identity
+	}
+	return nil
+}
+
+// restorePeerLatency seeds the best stored path of the peer of x with its
+// stored latency. e.mtx must be held.
+func (e *Endpoint) restorePeerLatency(x *Exchange) {
+	if x.addressBook == nil {
+		return
+	}
+
+	rec := e.peers[x.remoteIdent.Hashname()]
+	if rec == nil || rec.Latency <= 0 || len(rec.Identity.addrs) == 0 {
+		return
+	}
+
+	x.addressBook.SeedLatency(rec.Identity.addrs[0], rec.Latency)
+}
+
+func (e *Endpoint) savePeer(x *Exchange) {
+	if x.remoteIdent == nil {
+		return
+	}
+
+	addrs, latency := x.addressBook.WorkingAddresses()
+	if len(addrs) == 0 {
+		// keep the paths we knew before
+		if known := e.knownPeer(x.remoteIdent.Hashname()); known != nil {
+			addrs = known.addrs
+		}
+	}
+
+	rec := &PeerRecord{
+		Identity: x.remoteIdent.withPaths(addrs),
+		Latency:  latency,
+		LastSeen: time.Now(),
+	}
+
+	e.mtx.Lock()
+	e.peers[rec.Identity.Hashname()] = rec
+	e.mtx.Unlock()
+
+	err := e.peerStore.Save(rec)
+	if err != nil {
+		e.log.Printf("failed to save peer %s: %s", rec.Identity.Hashname(), err)
+	}
+}
+
+// NewMemoryPeerStore returns a PeerStore which only keeps peers in memory.
+// It can be shared by endpoints which are opened one after the other.
+func NewMemoryPeerStore() PeerStore {
+	return &memoryPeerStore{peers: make(map[hashname.H]*PeerRecord)}
+}
+
+type memoryPeerStore struct {
+	mtx   sync.Mutex
+	peers map[hashname.H]*PeerRecord
+}
+
+func (s *memoryPeerStore) Load() ([]*PeerRecord, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return sortedPeerRecords(s.peers), nil
+}
+
+func (s *memoryPeerStore) Save(rec *PeerRecord) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.peers[rec.Identity.Hashname()] = rec
+	return nil
+}
+
+// NewFilePeerStore returns a PeerStore which keeps peers in a JSON file at
+// path. The file is replaced atomically on every save.
+func NewFilePeerStore(path string) PeerStore {
+	return &filePeerStore{path: path}
+}
+
+type filePeerStore struct {
+	path string
+
+	mtx   sync.Mutex
+	peers map[hashname.H]*PeerRecord
+}
+
+func (s *filePeerStore) Load() ([]*PeerRecord, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.peers = make(map[hashname.H]*PeerRecord)
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []json.RawMessage
+	err = json.Unmarshal(data, &records)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, data := range records {
+		// a record which can not be decoded (for example a path of a transport
+		// which is not linked in) is skipped instead of failing the endpoint.
+		var rec *PeerRecord
+		err = json.Unmarshal(data, &rec)
+		if err != nil {
+			logs.Module("peerstore").Printf("skipped peer record in %s: %s", s.path, err)
+			continue
+		}
+
+		if rec != nil && rec.Identity != nil {
+			s.peers[rec.Identity.Hashname()] = rec
+		}
+	}
+
+	return sortedPeerRecords(s.peers), nil
+}
+
+func (s *filePeerStore) Save(rec *PeerRecord) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.peers == nil {
+		s.peers = make(map[hashname.H]*PeerRecord)
+	}
+	s.peers[rec.Identity.Hashname()] = rec
+
+	data, err := json.MarshalIndent(sortedPeerRecords(s.peers), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+func sortedPeerRecords(peers map[hashname.H]*PeerRecord) []*PeerRecord {
+	records := make([]*PeerRecord, 0, len(peers))
+	for _, rec := range peers {
+		records = append(records, rec)
+	}
+
+	sort.Sort(peerRecordsByHashname(records))
+	return records
+}
+
+type peerRecordsByHashname []*PeerRecord
+
+func (s peerRecordsByHashname) Len() int      { return len(s) }
+func (s peerRecordsByHashname) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s peerRecordsByHashname) Less(i, j int) bool {
+	return s[i].Identity.Hashname() < s[j].Identity.Hashname()
+}
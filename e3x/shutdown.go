@@ -0,0 +1,106 @@
+package e3x
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/telehash/gogotelehash/internal/lob"
+)
+
+// ErrShuttingDown is returned when an exchange or a channel is opened while
+// the endpoint is shutting down.
+var ErrShuttingDown = errors.New("e3x: endpoint is shutting down")
+
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown gracefully closes the endpoint. New exchanges and channels are
+// refused, all open channels are ended and Shutdown waits until the peers
+// acknowledged all packets written to reliable channels. When ctx is done
+// first the remaining packets are abandoned. Finally the exchanges, the
+// modules and the transport are closed like Close does.
+//
+// Shutdown returns ctx.Err() when the channels could not be flushed in time.
+func (e *Endpoint) Shutdown(ctx context.Context) error {
+	e.mtx.Lock()
+	e.draining = true
+	exchanges := make([]*Exchange, 0, len(e.hashnames))
+	for _, x := range e.hashnames {
+		exchanges = append(exchanges, x)
+	}
+	e.mtx.Unlock()
+
+	for _, x := range exchanges {
+		x.mtx.Lock()
+		x.draining = true
+		x.mtx.Unlock()
+	}
+
+	err := waitDrained(ctx, exchanges)
+
+	if cerr := e.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func waitDrained(ctx context.Context, exchanges []*Exchange) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		drained := true
+		for _, x := range exchanges {
+			if !x.drain() {
+				drained = false
+			}
+		}
+		if drained {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain ends all channels of the exchange and returns true when they are
+// flushed.
+func (x *Exchange) drain() bool {
+	drained := true
+	for _, c := range x.channels.All() {
+		if !c.drain() {
+			drained = false
+		}
+	}
+	return drained
+}
+
+// drain sends the end of the channel (when it can be written) and returns true
+// when the peer acknowledged all written packets.
+func (c *Channel) drain() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.broken {
+		return true
+	}
+
+	if !c.deliveredEnd {
+		if c.blockWrite() {
+			return false
+		}
+
+		pkt := &lob.Packet{}
+		hdr := pkt.Header()
+		hdr.End, hdr.HasEnd = true, true
+		if err := c.write(pkt, nil); err != nil {
+			return true
+		}
+	}
+
+	return len(c.writeBuffer) == 0
+}
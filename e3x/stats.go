@@ -0,0 +1,190 @@
+package e3x
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/telehash/gogotelehash/internal/hashname"
+)
+
+// ExchangeStats is a snapshot of the statistics of an exchange.
+type ExchangeStats struct {
+	Hashname hashname.H
+	State    ExchangeState
+	CSID     uint8
+
+	BytesSent          uint64 // encrypted channel packets
+	BytesReceived      uint64 // encrypted channel packets
+	PacketsSent        uint64
+	PacketsReceived    uint64
+	HandshakesSent     uint64
+	HandshakesReceived uint64
+	Retransmits        uint64 // channel packets which were sent again
+	Drops              uint64 // received packets which were dropped
+
+	Channels   int
+	ActivePath net.Addr
+	Paths      []PathStats
+}
+
+// PathStats is a snapshot of the statistics of a path of an exchange.
+type PathStats struct {
+	Address         net.Addr
+	Active          bool
+	Reachable       bool
+	Latency         time.Duration // last latency sample
+	SmoothedLatency time.Duration // moving average of the latency samples
+}
+
+// EndpointStats is a snapshot of the statistics of all exchanges of an
+// endpoint. The counters are the sums of the counters of the exchanges.
+type EndpointStats struct {
+	BytesSent          uint64
+	BytesReceived      uint64
+	PacketsSent        uint64
+	PacketsReceived    uint64
+	HandshakesSent     uint64
+	HandshakesReceived uint64
+	Retransmits        uint64
+	Drops              uint64
+	Channels           int
+
+	Exchanges []ExchangeStats
+}
+
+// exchangeCounters are the counters of an exchange. They are updated
+// atomically so they can be updated without holding any locks.
+type exchangeCounters struct {
+	bytesSent          uint64
+	bytesReceived      uint64
+	packetsSent        uint64
+	packetsReceived    uint64
+	handshakesSent     uint64
+	handshakesReceived uint64
+	retransmits        uint64
+	drops              uint64
+}
+
+func (c *exchangeCounters) sent(n int) {
+	atomic.AddUint64(&c.bytesSent, uint64(n))
+	atomic.AddUint64(&c.packetsSent, 1)
+}
+
+func (c *exchangeCounters) received(n int) {
+	atomic.AddUint64(&c.bytesReceived, uint64(n))
+	atomic.AddUint64(&c.packetsReceived, 1)
+}
+
+func (c *exchangeCounters) sentHandshake() {
+	atomic.AddUint64(&c.handshakesSent, 1)
+}
+
+func (c *exchangeCounters) receivedHandshake() {
+	atomic.AddUint64(&c.handshakesReceived, 1)
+}
+
+func (c *exchangeCounters) retransmit() {
+	if c != nil {
+		atomic.AddUint64(&c.retransmits, 1)
+	}
+}
+
+func (c *exchangeCounters) drop() {
+	if c != nil {
+		atomic.AddUint64(&c.drops, 1)
+	}
+}
+
+// Stats returns a snapshot of the statistics of the exchange.
+func (x *Exchange) Stats() ExchangeStats {
+	x.mtx.Lock()
+	stats := ExchangeStats{
+		State: x.state,
+		CSID:  x.csid,
+	}
+	if x.remoteIdent != nil {
+		stats.Hashname = x.remoteIdent.Hashname()
+	}
+	x.mtx.Unlock()
+
+	c := &x.counters
+	stats.BytesSent = atomic.LoadUint64(&c.bytesSent)
+	stats.BytesReceived = atomic.LoadUint64(&c.bytesReceived)
+	stats.PacketsSent = atomic.LoadUint64(&c.packetsSent)
+	stats.PacketsReceived = atomic.LoadUint64(&c.packetsReceived)
+	stats.HandshakesSent = atomic.LoadUint64(&c.handshakesSent)
+	stats.HandshakesReceived = atomic.LoadUint64(&c.handshakesReceived)
+	stats.Retransmits = atomic.LoadUint64(&c.retransmits)
+	stats.Drops = atomic.LoadUint64(&c.drops)
+
+	stats.Channels = len(x.channels.All())
+
+	if x.addressBook != nil {
+		stats.Paths = x.addressBook.Stats()
+		for _, p := range stats.Paths {
+			if p.Active {
+				stats.ActivePath = p.Address
+			}
+		}
+	}
+
+	return stats
+}
+
+// Stats returns a snapshot of the statistics of all exchanges of the endpoint.
+func (e *Endpoint) Stats() EndpointStats {
+	e.mtx.Lock()
+	exchanges := make([]*Exchange, 0, len(e.hashnames))
+	for _, x := range e.hashnames {
+		exchanges = append(exchanges, x)
+	}
+	e.mtx.Unlock()
+
+	var stats EndpointStats
+	for _, x := range exchanges {
+		s := x.Stats()
+
+		stats.BytesSent += s.BytesSent
+		stats.BytesReceived += s.BytesReceived
+		stats.PacketsSent += s.PacketsSent
+		stats.PacketsReceived += s.PacketsReceived
+		stats.HandshakesSent += s.HandshakesSent
+		stats.HandshakesReceived += s.HandshakesReceived
+		stats.Retransmits += s.Retransmits
+		stats.Drops += s.Drops
+		stats.Channels += s.Channels
+
+		stats.Exchanges = append(stats.Exchanges, s)
+	}
+
+	return stats
+}
+
+// Stats returns the statistics of all known paths.
+func (book *addressBook) Stats() []PathStats {
+	book.mtx.RLock()
+	defer book.mtx.RUnlock()
+
+	s := make([]PathStats, len(book.known))
+	for i, e := range book.known {
+		s[i] = PathStats{
+			Address:         e.Address,
+			Active:          e == book.active,
+			Reachable:       e.Reachable,
+			Latency:         e.latency,
+			SmoothedLatency: e.ewma,
+		}
+	}
+
+	return s
+}
+
+// counters returns the counters of the exchange of the channel (nil when the
+// channel is not attached to an *Exchange).
+func (c *Channel) counters() *exchangeCounters {
+	if x, ok := c.x.(*Exchange); ok && x != nil {
+		return &x.counters
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package e3x
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/telehash/gogotelehash/internal/hashname"
+)
+
+// ErrInvalidTimeout is returned when a timeout option is out of range.
+var ErrInvalidTimeout = errors.New("e3x: invalid timeout")
+
+const (
+	minExchangeTimeout = 1 * time.Second
+	minChannelInterval = 10 * time.Millisecond
+)
+
+var (
+	defaultExchangeTimeouts = ExchangeTimeouts{
+		IdleTimeout:  2 * time.Minute,
+		BreakTimeout: 2 * time.Minute,
+	}
+
+	defaultChannelTimeouts = ChannelTimeouts{
+		OpenTimeout:    60 * time.Second,
+		CloseTimeout:   60 * time.Second,
+		ResendInterval: 1 * time.Second,
+		AckInterval:    10 * time.Second,
+	}
+)
+
+// ExchangeTimeouts configures the timers of an exchange. A zero field inherits
+// the value of the enclosing scope (endpoint, then peer, then exchange).
+type ExchangeTimeouts struct {
+	// IdleTimeout is how long an exchange without open channels is kept.
+	// (default: 2m)
+	IdleTimeout time.Duration
+
+	// BreakTimeout is how long an exchange is kept when no handshakes are
+	// received from the peer. (default: 2m)
+	BreakTimeout time.Duration
+}
+
+// ChannelTimeouts configures the timers of a channel. A zero field inherits
+// the value of the enclosing scope (endpoint, then peer, then exchange, then
+// channel).
+type ChannelTimeouts struct {
+	// OpenTimeout is how long a channel waits for the first packet of the peer.
+	// (default: 60s)
+	OpenTimeout time.Duration
+
+	// CloseTimeout is how long a closing channel waits for the peer to
+	// acknowledge the end of the channel. (default: 60s)
+	CloseTimeout time.Duration
+
+	// ResendInterval is how often unacknowledged packets of a reliable channel
+	// are resent. (default: 1s)
+	ResendInterval time.Duration
+
+	// AckInterval is how often a reliable channel acknowledges received
+	// packets when it has nothing else to send. (default: 10s)
+	AckInterval time.Duration
+
+	// ReadTimeout makes reads fail with ErrTimeout when no packet was read for
+	// this long. It does not apply while a read deadline is set.
+	// (default: none)
+	ReadTimeout time.Duration
+
+	// WriteTimeout makes writes fail with ErrTimeout when no packet was
+	// written for this long. It does not apply while a write deadline is set.
+	// (default: none)
+	WriteTimeout time.Duration
+}
+
+// Validate checks that the timeouts are in range.
+func (t ExchangeTimeouts) Validate() error {
+	for _, d := range []time.Duration{t.IdleTimeout, t.BreakTimeout} {
+		if d < 0 || (d > 0 && d < minExchangeTimeout) {
+			return ErrInvalidTimeout
+		}
+	}
+	return nil
+}
+
+// Validate checks that the timeouts are in range.
+func (t ChannelTimeouts) Validate() error {
+	for _, d := range []time.Duration{t.OpenTimeout, t.CloseTimeout, t.ReadTimeout, t.WriteTimeout} {
+		if d < 0 {
+			return ErrInvalidTimeout
+		}
+	}
+	for _, d := range []time.Duration{t.ResendInterval, t.AckInterval} {
+		if d < 0 || (d > 0 && d < minChannelInterval) {
+			return ErrInvalidTimeout
+		}
+	}
+	return nil
+}
+
+// merge returns t with its zero fields taken from base.
+func (t ExchangeTimeouts) merge(base ExchangeTimeouts) ExchangeTimeouts {
+	mergeDuration(&t.IdleTimeout, base.IdleTimeout)
+	mergeDuration(&t.BreakTimeout, base.BreakTimeout)
+	return t
+}
+
+// merge returns t with its zero fields taken from base.
+func (t ChannelTimeouts) merge(base ChannelTimeouts) ChannelTimeouts {
+	mergeDuration(&t.OpenTimeout, base.OpenTimeout)
+	mergeDuration(&t.CloseTimeout, base.CloseTimeout)
+	mergeDuration(&t.ResendInterval, base.ResendInterval)
+	mergeDuration(&t.AckInterval, base.AckInterval)
+	mergeDuration(&t.ReadTimeout, base.ReadTimeout)
+	mergeDuration(&t.WriteTimeout, base.WriteTimeout)
+	return t
+}
+
+func mergeDuration(d *time.Duration, base time.Duration) {
+	if *d == 0 {
+		*d = base
+	}
+}
+
+type peerTimeouts struct {
+	exchange ExchangeTimeouts
+	channel  ChannelTimeouts
+}
+
+// Timeouts configures the timers of all exchanges and channels of the
+// endpoint.
+func Timeouts(x ExchangeTimeouts, c ChannelTimeouts) EndpointOption {
+	return func(e *Endpoint) error {
+		if err := x.Validate(); err != nil {
+			return err
+		}
+		if err := c.Validate(); err != nil {
+			return err
+		}
+
+		e.exchangeTimeouts = x.merge(e.exchangeTimeouts)
+		e.channelTimeouts = c.merge(e.channelTimeouts)
+		return nil
+	}
+}
+
+// PeerTimeouts configures the timers of the exchange (and its channels) with
+// the peer identified by hn. They override the endpoint Timeouts.
+func PeerTimeouts(hn hashname.H, x ExchangeTimeouts, c ChannelTimeouts) EndpointOption {
+	return func(e *Endpoint) error {
+		if !hn.Valid() {
+			return os.ErrInvalid
+		}
+		if err := x.Validate(); err != nil {
+			return err
+		}
+		if err := c.Validate(); err != nil {
+			return err
+		}
+
+		if e.peerTimeouts == nil {
+			e.peerTimeouts = make(map[hashname.H]peerTimeouts)
+		}
+
+		p := e.peerTimeouts[hn]
+		p.exchange = x.merge(p.exchange)
+		p.channel = c.merge(p.channel)
+		e.peerTimeouts[hn] = p
+		return nil
+	}
+}
+
+// WithTimeouts configures the timers of an exchange and the defaults of its
+// channels. Changes to a running exchange apply when its timers are next
+// reset.
+func WithTimeouts(x ExchangeTimeouts, c ChannelTimeouts) ExchangeOption {
+	return func(ex *Exchange) error {
+		if err := x.Validate(); err != nil {
+			return err
+		}
+		if err := c.Validate(); err != nil {
+			return err
+		}
+
+		ex.timeouts = x.merge(ex.timeouts)
+		ex.channelTimeouts = c.merge(ex.channelTimeouts)
+		return nil
+	}
+}
+
+// WithChannelTimeouts configures the timers of a channel.
+func WithChannelTimeouts(t ChannelTimeouts) ChannelOption {
+	return func(c *Channel) error {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+
+		c.timeouts = t.merge(c.timeouts)
+		return nil
+	}
+}
+
+// peerOptions returns the exchange options configured for the peer hn.
+func (e *Endpoint) peerOptions(hn hashname.H) []ExchangeOption {
+	p, ok := e.peerTimeouts[hn]
+	if !ok {
+		return nil
+	}
+	return []ExchangeOption{WithTimeouts(p.exchange, p.channel)}
+}
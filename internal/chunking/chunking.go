@@ -0,0 +1,163 @@
+// Package chunking implements the chunking encoding which is used to send
+// packets over streams.
+//
+// A packet is split into chunks. Each chunk starts with a single byte holding
+// the length of the chunk (1-255) followed by that many bytes. A chunk of zero
+// length terminates the packet. A zero length chunk which is not preceded by
+// any data is an ack; it signals that the receiver processed a packet.
+//
+// Reference
+//
+// https://github.com/telehash/telehash.org/blob/v3/v3/lob/chunking.md
+package chunking
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+const (
+	// MaxChunkSize is the largest chunk size.
+	MaxChunkSize = 255
+
+	// DefaultChunkSize is used when the chunk size is zero.
+	DefaultChunkSize = MaxChunkSize
+)
+
+var (
+	// ErrInvalidChunkSize is returned by NewEncoder when the chunk size is out of
+	// range.
+	ErrInvalidChunkSize = errors.New("chunking: invalid chunk size")
+
+	// ErrEmptyPacket is returned by Encode for an empty packet (which would be
+	// read as an ack).
+	ErrEmptyPacket = errors.New("chunking: empty packet")
+
+	// ErrPacketTooLarge is returned by Decode when a packet does not fit in the
+	// buffer. The packet is discarded.
+	ErrPacketTooLarge = errors.New("chunking: packet too large")
+)
+
+// Encoder writes chunked packets to a stream.
+type Encoder struct {
+	w         io.Writer
+	chunkSize int
+	buf       []byte
+}
+
+// NewEncoder returns an encoder which writes to w. Packets are split in chunks
+// of at most chunkSize bytes. A chunkSize of zero selects DefaultChunkSize.
+func NewEncoder(w io.Writer, chunkSize int) (*Encoder, error) {
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize < 1 || chunkSize > MaxChunkSize {
+		return nil, ErrInvalidChunkSize
+	}
+	return &Encoder{w: w, chunkSize: chunkSize}, nil
+}
+
+// Encode writes p as one packet. The chunks of the packet are written with a
+// single call to Write.
+func (e *Encoder) Encode(p []byte) error {
+	if len(p) == 0 {
+		return ErrEmptyPacket
+	}
+
+	nChunks := (len(p) + e.chunkSize - 1) / e.chunkSize
+	size := len(p) + nChunks + 1
+	if cap(e.buf) < size {
+		e.buf = make([]byte, size)
+	}
+	buf := e.buf[:0]
+
+	for len(p) > 0 {
+		n := len(p)
+		if n > e.chunkSize {
+			n = e.chunkSize
+		}
+		buf = append(buf, byte(n))
+		buf = append(buf, p[:n]...)
+		p = p[n:]
+	}
+	buf = append(buf, 0)
+
+	return e.write(buf)
+}
+
+// Ack writes an ack.
+func (e *Encoder) Ack() error {
+	return e.write([]byte{0})
+}
+
+func (e *Encoder) write(b []byte) error {
+	for len(b) > 0 {
+		n, err := e.w.Write(b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// Decoder reads chunked packets from a stream.
+type Decoder struct {
+	r *bufio.Reader
+}
+
+// NewDecoder returns a decoder which reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// Decode reads the next packet into b and returns its length. Decode returns
+// a length of zero (and no error) when it read an ack. When the packet does
+// not fit in b the packet is discarded and ErrPacketTooLarge is returned.
+func (d *Decoder) Decode(b []byte) (n int, err error) {
+	var tooLarge bool
+
+	for {
+		l, err := d.r.ReadByte()
+		if err != nil {
+			if n > 0 || tooLarge {
+				err = noEOF(err)
+			}
+			return 0, err
+		}
+
+		if l == 0 {
+			if tooLarge {
+				return 0, ErrPacketTooLarge
+			}
+			return n, nil
+		}
+
+		if tooLarge || n+int(l) > len(b) {
+			tooLarge = true
+			_, err = d.r.Discard(int(l))
+			if err != nil {
+				return 0, noEOF(err)
+			}
+			continue
+		}
+
+		_, err = io.ReadFull(d.r, b[n:n+int(l)])
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		n += int(l)
+	}
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package chunking
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func TestEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+
+	enc, err := NewEncoder(&buf, 2)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.NoError(enc.Encode([]byte("hello")))
+	assert.Equal([]byte{2, 'h', 'e', 2, 'l', 'l', 1, 'o', 0}, buf.Bytes())
+
+	assert.NoError(enc.Ack())
+	assert.Equal(ErrEmptyPacket, enc.Encode(nil))
+
+	var (
+		dec = NewDecoder(&buf)
+		out [16]byte
+	)
+
+	n, err := dec.Decode(out[:])
+	assert.NoError(err)
+	assert.Equal("hello", string(out[:n]))
+
+	n, err = dec.Decode(out[:])
+	assert.NoError(err)
+	assert.Equal(0, n) // ack
+
+	_, err = dec.Decode(out[:])
+	assert.Equal(io.EOF, err)
+}
+
+func TestChunkSizes(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		buf bytes.Buffer
+		msg = bytes.Repeat([]byte("0123456789"), 150)
+		out [1500]byte
+	)
+
+	for _, size := range []int{0, 1, 7, 128, MaxChunkSize} {
+		buf.Reset()
+
+		enc, err := NewEncoder(&buf, size)
+		if !assert.NoError(err) {
+			continue
+		}
+
+		assert.NoError(enc.Encode(msg))
+		assert.NoError(enc.Encode(msg[:3]))
+
+		dec := NewDecoder(&buf)
+
+		n, err := dec.Decode(out[:])
+		assert.NoError(err)
+		assert.Equal(msg, out[:n], "size=%d", size)
+
+		n, err = dec.Decode(out[:])
+		assert.NoError(err)
+		assert.Equal(msg[:3], out[:n], "size=%d", size)
+	}
+
+	for _, size := range []int{-1, MaxChunkSize + 1} {
+		_, err := NewEncoder(&buf, size)
+		assert.Equal(ErrInvalidChunkSize, err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		buf bytes.Buffer
+		out [4]byte
+	)
+
+	enc, _ := NewEncoder(&buf, 0)
+	enc.Encode([]byte("too large"))
+	enc.Encode([]byte("ok"))
+
+	dec := NewDecoder(&buf)
+
+	_, err := dec.Decode(out[:])
+	assert.Equal(ErrPacketTooLarge, err)
+
+	// the decoder is still in sync
+	n, err := dec.Decode(out[:])
+	assert.NoError(err)
+	assert.Equal("ok", string(out[:n]))
+
+	dec = NewDecoder(bytes.NewReader([]byte{3, 'a', 'b'}))
+	_, err = dec.Decode(out[:])
+	assert.Equal(io.ErrUnexpectedEOF, err)
+
+	dec = NewDecoder(bytes.NewReader([]byte{1, 'a'}))
+	_, err = dec.Decode(out[:])
+	assert.Equal(io.ErrUnexpectedEOF, err)
+}
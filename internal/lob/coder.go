@@ -20,6 +20,14 @@ import (
 // ErrInvalidPacket is returned by Decode
 var ErrInvalidPacket = errors.New("lob: invalid packet")
 
+// ErrInvalidHead is returned when a binary head is empty or too long or when a
+// header has both a binary head and JSON fields.
+var ErrInvalidHead = errors.New("lob: invalid head")
+
+// MaxBinaryHeadLen is the maximum length of a binary head. Longer heads are
+// always JSON objects.
+const MaxBinaryHeadLen = 6
+
 var pktPool = sync.Pool{
 	New: func() interface{} { return new(Packet) },
 }
@@ -79,6 +87,17 @@ func (p *Packet) Header() *Header {
 	return &p.header
 }
 
+// NewBinary returns a new packet with a binary head.
+func NewBinary(head, body []byte) (*Packet, error) {
+	pkt := New(body)
+	err := pkt.header.SetBinary(head)
+	if err != nil {
+		pkt.Free()
+		return nil, err
+	}
+	return pkt, nil
+}
+
 func (p *Packet) Body(buf []byte) []byte {
 	return p.body.Get(buf)
 }
@@ -87,6 +106,21 @@ func (p *Packet) BodyLen() int {
 	return p.body.Len()
 }
 
+// SetBody replaces the body of the packet.
+func (p *Packet) SetBody(body []byte) *Packet {
+	if len(body) == 0 {
+		p.body.Free()
+		p.body = nil
+		return p
+	}
+
+	if p.body == nil {
+		p.body = bufpool.New()
+	}
+	p.body.Set(body)
+	return p
+}
+
 func (p *Packet) SetHeader(header Header) *Packet {
 	p.header = header
 	return p
@@ -130,7 +164,7 @@ func Decode(p *bufpool.Buffer) (*Packet, error) {
 		pkt.body = bufpool.New().Set(body)
 	}
 
-	if len(head) >= 7 {
+	if len(head) > MaxBinaryHeadLen {
 		err := parseHeader(pkt.Header(), head)
 		if err != nil {
 			pkt.Free()
@@ -163,6 +197,12 @@ func Encode(pkt *Packet) (*bufpool.Buffer, error) {
 	buf.WriteByte(0)
 	buf.WriteByte(0)
 
+	if pkt.header.IsBinary() && pkt.header.hasFields() {
+		buf.Reset()
+		byteBufferPool.Put(buf)
+		return nil, ErrInvalidHead
+	}
+
 	if !pkt.header.IsZero() {
 		if !pkt.header.IsBinary() {
 			err = pkt.header.writeTo(buf)
@@ -179,10 +219,10 @@ func Encode(pkt *Packet) (*bufpool.Buffer, error) {
 			}
 		} else {
 			hdrLen = len(pkt.header.Bytes)
-			if hdrLen >= 7 {
+			if hdrLen > MaxBinaryHeadLen {
 				buf.Reset()
 				byteBufferPool.Put(buf)
-				return nil, ErrInvalidPacket
+				return nil, ErrInvalidHead
 			}
 			buf.Write(pkt.header.Bytes)
 		}
@@ -298,13 +338,37 @@ func (h *Header) writeTo(buf *bytes.Buffer) error {
 
 // IsZero returns true when the header is the zero value or equivalent.
 func (h *Header) IsZero() bool {
-	return !h.HasC && !h.HasEnd && !h.HasType && !h.HasSeq && !h.HasAck && (!h.HasMiss || len(h.Miss) == 0) && len(h.Extra) == 0 && len(h.Bytes) == 0
+	return !h.hasFields() && len(h.Bytes) == 0
 }
 
+// hasFields returns true when any of the JSON fields is set.
+func (h *Header) hasFields() bool {
+	return h.HasC || h.HasEnd || h.HasType || h.HasSeq || h.HasAck || (h.HasMiss && len(h.Miss) > 0) || len(h.Extra) > 0
+}
+
+// IsBinary returns true when the header is a binary head.
 func (h *Header) IsBinary() bool {
 	return len(h.Bytes) != 0
 }
 
+// Binary returns the binary head or nil when the head is not binary.
+func (h *Header) Binary() []byte {
+	if h == nil || len(h.Bytes) == 0 {
+		return nil
+	}
+	return h.Bytes
+}
+
+// SetBinary replaces the header with the binary head b (1-6 bytes). All JSON
+// fields are cleared.
+func (h *Header) SetBinary(b []byte) error {
+	if len(b) == 0 || len(b) > MaxBinaryHeadLen {
+		return ErrInvalidHead
+	}
+	*h = Header{Bytes: append(make([]byte, 0, len(b)), b...)}
+	return nil
+}
+
 // Get the value for key k. found is false if k is not present.
 func (h *Header) Get(k string) (v interface{}, found bool) {
 	if h == nil || h.Extra == nil {
@@ -6,6 +6,17 @@ import (
 	"testing"
 )
 
+type testExtension struct {
+	Peer    string   `lob:"peer"`
+	Hops    int      `lob:"hops,omitempty"`
+	Paths   []string `lob:"paths,omitempty"`
+	Ignored string
+}
+
+func init() {
+	RegisterExtension(testExtension{})
+}
+
 func TestCoding(t *testing.T) {
 	assert := assert.New(t)
 
@@ -39,6 +50,108 @@ func TestCoding(t *testing.T) {
 	}
 }
 
+func TestSetBody(t *testing.T) {
+	assert := assert.New(t)
+
+	pkt := New(nil)
+	assert.Nil(pkt.Body(nil))
+
+	pkt.SetBody([]byte("hello"))
+	assert.Equal("hello", string(pkt.Body(nil)))
+
+	pkt.SetBody([]byte("hi"))
+	assert.Equal("hi", string(pkt.Body(nil)))
+
+	pkt.SetBody(nil)
+	assert.Equal(0, pkt.BodyLen())
+
+	pkt.Free()
+}
+
+func TestBinaryHead(t *testing.T) {
+	assert := assert.New(t)
+
+	pkt, err := NewBinary([]byte{0x1a}, []byte("body"))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal([]byte{0x1a}, pkt.Header().Binary())
+
+	data, err := Encode(pkt)
+	if assert.NoError(err) {
+		assert.Equal([]byte{0, 1, 0x1a, 'b', 'o', 'd', 'y'}, data.RawBytes())
+
+		o, err := Decode(data)
+		if assert.NoError(err) {
+			assert.True(o.Header().IsBinary())
+			assert.Equal([]byte{0x1a}, o.Header().Binary())
+			assert.Equal([]byte("body"), o.Body(nil))
+			o.Free()
+		}
+		data.Free()
+	}
+	pkt.Free()
+
+	_, err = NewBinary(nil, nil)
+	assert.Equal(ErrInvalidHead, err)
+	_, err = NewBinary([]byte("seven!!"), nil)
+	assert.Equal(ErrInvalidHead, err)
+
+	// binary heads and JSON fields are exclusive
+	pkt = New(nil).SetHeader(Header{Bytes: []byte{1}, HasC: true, C: 1})
+	_, err = Encode(pkt)
+	assert.Equal(ErrInvalidHead, err)
+
+	pkt.Header().SetBinary([]byte{2})
+	assert.False(pkt.Header().HasC)
+	assert.Nil(New(nil).Header().Binary())
+}
+
+func TestHeaderExtension(t *testing.T) {
+	assert := assert.New(t)
+
+	pkt := New(nil)
+	err := pkt.Header().SetExtension(&testExtension{Peer: "abc", Paths: []string{"x", "y"}, Ignored: "z"})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(map[string]interface{}{"peer": "abc", "paths": []string{"x", "y"}}, pkt.Header().Extra)
+
+	data, err := Encode(pkt)
+	if !assert.NoError(err) {
+		return
+	}
+
+	o, err := Decode(data)
+	if !assert.NoError(err) {
+		return
+	}
+
+	var ext = testExtension{Hops: 3}
+	assert.NoError(o.Header().Extension(&ext))
+	assert.Equal(testExtension{Peer: "abc", Hops: 3, Paths: []string{"x", "y"}}, ext)
+
+	o.Header().Set("hops", "three")
+	assert.Equal(ErrInvalidExtension, o.Header().Extension(&ext))
+
+	var unregistered struct {
+		Peer string `lob:"peer"`
+	}
+	assert.Equal(ErrUnregisteredExtension, o.Header().Extension(&unregistered))
+	assert.Equal(ErrUnregisteredExtension, o.Header().SetExtension(unregistered))
+
+	assert.Panics(func() { RegisterExtension(testExtension{}) })
+	assert.Panics(func() {
+		RegisterExtension(struct {
+			C uint32 `lob:"c"`
+		}{})
+	})
+
+	data.Free()
+	o.Free()
+	pkt.Free()
+}
+
 func BenchmarkEncode(b *testing.B) {
 	var tab = []*Packet{
 		New([]byte("world")).SetHeader(Header{Bytes: []byte("h")}),
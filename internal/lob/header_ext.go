@@ -0,0 +1,209 @@
+package lob
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Header extensions
+//
+// A header extension is a struct type whose fields map to keys in the JSON
+// head of a packet. The keys are taken from the `lob` field tags:
+//
+//	type peerHeader struct {
+//		Peer string `lob:"peer"`
+//		Hops int    `lob:"hops,omitempty"`
+//	}
+//
+//	func init() { lob.RegisterExtension(peerHeader{}) }
+//
+//	var hdr peerHeader
+//	err := pkt.Header().Extension(&hdr)
+//
+// Fields without a tag (or with the tag "-") are ignored. The keys of the
+// packet header (c, type, seq, ack, miss and end) can not be used.
+
+var (
+	// ErrUnregisteredExtension is returned when a header extension type was
+	// not registered with RegisterExtension.
+	ErrUnregisteredExtension = errors.New("lob: unregistered header extension")
+
+	// ErrInvalidExtension is returned by Extension when a header value does
+	// not match the type of its field.
+	ErrInvalidExtension = errors.New("lob: invalid header extension")
+)
+
+var extensions = struct {
+	mtx   sync.RWMutex
+	types map[reflect.Type]*extension
+}{types: make(map[reflect.Type]*extension)}
+
+type extension struct {
+	fields []extensionField
+}
+
+type extensionField struct {
+	index     int
+	key       string
+	omitEmpty bool
+}
+
+var reservedKeys = map[string]bool{
+	"c": true, "type": true, "seq": true, "ack": true, "miss": true, "end": true,
+}
+
+// RegisterExtension registers the header extension type of ext (a struct or a
+// pointer to a struct). RegisterExtension panics when the type is invalid or
+// already registered.
+func RegisterExtension(ext interface{}) {
+	typ := reflect.TypeOf(ext)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("lob: header extension must be a struct (not %T)", ext))
+	}
+
+	var (
+		x    = &extension{}
+		keys = make(map[string]bool)
+	)
+
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+
+		tag := f.Tag.Get("lob")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		if f.PkgPath != "" {
+			panic(fmt.Sprintf("lob: header extension field %s.%s is not exported", typ, f.Name))
+		}
+
+		parts := strings.Split(tag, ",")
+		field := extensionField{index: i, key: parts[0]}
+		for _, opt := range parts[1:] {
+			if opt != "omitempty" {
+				panic(fmt.Sprintf("lob: invalid tag option %q on %s.%s", opt, typ, f.Name))
+			}
+			field.omitEmpty = true
+		}
+
+		if field.key == "" || reservedKeys[field.key] {
+			panic(fmt.Sprintf("lob: invalid header key %q on %s.%s", field.key, typ, f.Name))
+		}
+		if keys[field.key] {
+			panic(fmt.Sprintf("lob: duplicate header key %q in %s", field.key, typ))
+		}
+		keys[field.key] = true
+
+		x.fields = append(x.fields, field)
+	}
+
+	extensions.mtx.Lock()
+	defer extensions.mtx.Unlock()
+
+	if extensions.types[typ] != nil {
+		panic(fmt.Sprintf("lob: header extension %s is already registered", typ))
+	}
+	extensions.types[typ] = x
+}
+
+func lookupExtension(typ reflect.Type) *extension {
+	extensions.mtx.RLock()
+	x := extensions.types[typ]
+	extensions.mtx.RUnlock()
+	return x
+}
+
+// Extension decodes the header values into the fields of ext (a pointer to a
+// registered header extension). Fields whose keys are not present in the
+// header are left unchanged.
+func (h *Header) Extension(ext interface{}) error {
+	v := reflect.ValueOf(ext)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return ErrUnregisteredExtension
+	}
+	v = v.Elem()
+
+	x := lookupExtension(v.Type())
+	if x == nil {
+		return ErrUnregisteredExtension
+	}
+
+	for _, f := range x.fields {
+		value, found := h.Get(f.key)
+		if !found {
+			continue
+		}
+
+		// header values are decoded as generic JSON values; re-encoding them
+		// lets encoding/json do the conversion to the field type.
+		data, err := json.Marshal(value)
+		if err != nil {
+			return ErrInvalidExtension
+		}
+
+		err = json.Unmarshal(data, v.Field(f.index).Addr().Interface())
+		if err != nil {
+			return ErrInvalidExtension
+		}
+	}
+
+	return nil
+}
+
+// SetExtension sets the header values from the fields of ext (a registered
+// header extension or a pointer to one). Empty fields tagged with omitempty
+// remove their keys from the header.
+func (h *Header) SetExtension(ext interface{}) error {
+	v := reflect.ValueOf(ext)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ErrUnregisteredExtension
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return ErrUnregisteredExtension
+	}
+
+	x := lookupExtension(v.Type())
+	if x == nil {
+		return ErrUnregisteredExtension
+	}
+
+	for _, f := range x.fields {
+		fv := v.Field(f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			delete(h.Extra, f.key)
+			continue
+		}
+		h.Set(f.key, fv.Interface())
+	}
+
+	return nil
+}
+
+// isEmptyValue follows the definition of empty used by encoding/json.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
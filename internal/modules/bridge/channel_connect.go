@@ -59,10 +59,10 @@ func (mod *module) handle_connect(ch *e3x.Channel) {
 	}
 
 	innerHdr := inner.Header()
-	if innerHdr.IsBinary() && len(innerHdr.Bytes) == 1 {
+	if head := innerHdr.Binary(); len(head) == 1 {
 		// handshake
 		var (
-			csid = innerHdr.Bytes[0]
+			csid = head[0]
 			key  = localIdent.Keys()[csid]
 		)
 		if key == nil {
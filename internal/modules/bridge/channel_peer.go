@@ -10,6 +10,15 @@ import (
 	"github.com/telehash/gogotelehash/internal/util/bufpool"
 )
 
+// peerHeader is the header of a peer request.
+type peerHeader struct {
+	Peer hashname.H `lob:"peer"`
+}
+
+func init() {
+	lob.RegisterExtension(peerHeader{})
+}
+
 func (mod *module) peerVia(router *e3x.Exchange, to hashname.H, body *bufpool.Buffer) error {
 	ch, err := router.Open("peer", false)
 	if err != nil {
@@ -18,7 +27,7 @@ func (mod *module) peerVia(router *e3x.Exchange, to hashname.H, body *bufpool.Bu
 	defer ch.Kill()
 
 	pkt := lob.New(body.RawBytes())
-	pkt.Header().SetString("peer", string(to))
+	pkt.Header().SetExtension(&peerHeader{Peer: to})
 	ch.WritePacket(pkt)
 
 	return nil
@@ -74,12 +83,12 @@ func (mod *module) handle_peer(ch *e3x.Channel) {
 		return
 	}
 
-	peerStr, ok := pkt.Header().GetString("peer")
-	if !ok {
+	var hdr peerHeader
+	if err := pkt.Header().Extension(&hdr); err != nil || hdr.Peer == "" {
 		log.Printf("drop: no peer in packet")
 		return
 	}
-	peer := hashname.H(peerStr)
+	peer := hdr.Peer
 
 	// MUST have link to either endpoint
 	if mod.e.GetExchange(ch.RemoteHashname()) == nil && mod.e.GetExchange(peer) == nil {
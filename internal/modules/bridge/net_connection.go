@@ -78,7 +78,7 @@ func (c *connection) sendHandshake(body []byte) error {
 	// defer e3x.ForgetterFromEndpoint(c.ex.).ForgetChannel(ch)
 
 	pkt := lob.New(body)
-	pkt.Header().SetString("peer", string(c.target))
+	pkt.Header().SetExtension(&peerHeader{Peer: c.target})
 	ch.WritePacket(pkt)
 
 	return nil
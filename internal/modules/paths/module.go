@@ -14,6 +14,15 @@ import (
 
 const moduleKey = "paths"
 
+// pathsHeader is the header of a path request.
+type pathsHeader struct {
+	Paths []json.RawMessage `lob:"paths,omitempty"`
+}
+
+func init() {
+	lob.RegisterExtension(pathsHeader{})
+}
+
 type module struct {
 	endpoint *e3x.Endpoint
 	listener *e3x.Listener
@@ -88,8 +97,17 @@ func (mod *module) negotiatePaths(x *e3x.Exchange) {
 
 	c.SetDeadline(time.Now().Add(1 * time.Minute))
 
+	hdr := pathsHeader{Paths: make([]json.RawMessage, 0, len(addrs))}
+	for _, addr := range addrs {
+		data, err := json.Marshal(addr)
+		if err != nil {
+			continue // ignore
+		}
+		hdr.Paths = append(hdr.Paths, data)
+	}
+
 	pkt := &lob.Packet{}
-	pkt.Header().Set("paths", addrs)
+	pkt.Header().SetExtension(&hdr)
 	if err := c.WritePacket(pkt); err != nil {
 		return // ignore
 	}
@@ -114,25 +132,15 @@ func (mod *module) handlePathRequest(c *e3x.Channel) {
 	}
 
 	// decode paths known by peer and add them as candidates
-	if header, found := pkt.Header().Get("paths"); found {
-		data, err := json.Marshal(header)
-		if err != nil {
-			return // ignore
-		}
-
-		var entries []json.RawMessage
-		err = json.Unmarshal(data, &entries)
-		if err != nil {
-			return // ignore
-		}
+	var hdr pathsHeader
+	if err := pkt.Header().Extension(&hdr); err != nil {
+		return // ignore
+	}
 
-		for _, entry := range entries {
-			addr, err := transports.DecodeAddr(entry)
-			if err != nil {
-			}
-			if err == nil {
-				c.Exchange().AddPathCandidate(addr)
-			}
+	for _, entry := range hdr.Paths {
+		addr, err := transports.DecodeAddr(entry)
+		if err == nil {
+			c.Exchange().AddPathCandidate(addr)
 		}
 	}
 
@@ -0,0 +1,42 @@
+// Package term reads passphrases from the terminal.
+package term
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// ReadLine prints prompt to stderr and reads a line from in, which must read
+// from os.Stdin. When stdin is a terminal the line is read with echo turned
+// off. The line is returned without its line ending.
+func ReadLine(in *bufio.Reader, prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+
+	readLine := func() ([]byte, error) {
+		line, err := in.ReadBytes('\n')
+		if err != nil && len(line) == 0 {
+			return nil, err
+		}
+		return line, nil
+	}
+
+	var (
+		line []byte
+		err  error
+	)
+
+	if fd := os.Stdin.Fd(); isTerminal(fd) {
+		// don't echo the passphrase
+		line, err = readNoEcho(fd, readLine)
+		fmt.Fprintln(os.Stderr)
+	} else {
+		line, err = readLine()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimRight(line, "\r\n"), nil
+}
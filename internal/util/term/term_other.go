@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package term
+
+import "errors"
+
+func isTerminal(fd uintptr) bool {
+	return false
+}
+
+func readNoEcho(fd uintptr, readLine func() ([]byte, error)) ([]byte, error) {
+	return nil, errors.New("terminal input is not supported")
+}
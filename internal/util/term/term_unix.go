@@ -0,0 +1,51 @@
+//go:build linux || darwin
+
+package term
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func isTerminal(fd uintptr) bool {
+	_, err := getTermios(fd)
+	return err == nil
+}
+
+// readNoEcho reads a line from the terminal fd with echo turned off.
+func readNoEcho(fd uintptr, readLine func() ([]byte, error)) ([]byte, error) {
+	old, err := getTermios(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	state := *old
+	state.Lflag &^= syscall.ECHO
+	state.Lflag |= syscall.ICANON | syscall.ISIG
+	state.Iflag |= syscall.ICRNL
+
+	err = setTermios(fd, &state)
+	if err != nil {
+		return nil, err
+	}
+	defer setTermios(fd, old)
+
+	return readLine()
+}
+
+func getTermios(fd uintptr) (*syscall.Termios, error) {
+	var t syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, ioctlGetTermios, uintptr(unsafe.Pointer(&t)))
+	if errno != 0 {
+		return nil, errno
+	}
+	return &t, nil
+}
+
+func setTermios(fd uintptr, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, ioctlSetTermios, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/github.com/docopt/docopt-go"
+
+	_ "github.com/telehash/gogotelehash/e3x"
+	"github.com/telehash/gogotelehash/e3x/cipherset"
+	"github.com/telehash/gogotelehash/e3x/keyagent"
+	"github.com/telehash/gogotelehash/e3x/keyfile"
+	"github.com/telehash/gogotelehash/internal/util/term"
+)
+
+const usage = `Telehash key agent.
+
+Holds the private keys of an endpoint and performs the key agreements for
+endpoints which connect to its unix socket. Key agreements are only served
+for cipher sets 1a and 3a; the public keys of the other cipher sets are served
+so the endpoint keeps the hashname of the key file.
+
+Usage:
+  th-keyagent [--socket=<path>] [--passphrase-file=<file>] <keyfile>
+  th-keyagent -h | --help
+  th-keyagent --version
+
+Options:
+  -s --socket=<path>        Location of the unix socket. [default: th-keyagent.sock]
+  --passphrase-file=<file>  Read the passphrase from a file instead of the
+                            TH_PASSPHRASE variable or the terminal.
+  -h --help                 Show this screen.
+  --version                 Show version.
+`
+
+func main() {
+	args, _ := docopt.Parse(usage, nil, true, "0.1-dev", false)
+
+	var (
+		socket = args["--socket"].(string)
+	)
+
+	f, err := keyfile.Load(args["<keyfile>"].(string), func() ([]byte, error) {
+		return readPassphrase(args["--passphrase-file"])
+	})
+	assert(err)
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		os.Remove(socket)
+		os.Exit(0)
+	}()
+
+	fmt.Fprintf(os.Stderr, "Serving keys for %s on %s\n", f.Hashname, socket)
+	err = keyagent.ListenAndServe(socket, cipherset.Keys(f.Keys))
+	assert(err)
+}
+
+func readPassphrase(file interface{}) ([]byte, error) {
+	var pass []byte
+
+	if path, ok := file.(string); ok && path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		pass = data
+	} else if env := os.Getenv("TH_PASSPHRASE"); env != "" {
+		pass = []byte(env)
+	} else {
+		line, err := term.ReadLine(bufio.NewReader(os.Stdin), "Passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		pass = line
+	}
+
+	pass = bytes.TrimRight(pass, "\r\n")
+	if len(pass) == 0 {
+		return nil, keyfile.ErrNoPassphrase
+	}
+	return pass, nil
+}
+
+func assert(err error) {
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+		os.Exit(1)
+	}
+}
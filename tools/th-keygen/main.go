@@ -1,7 +1,8 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -10,35 +11,87 @@ import (
 
 	_ "github.com/telehash/gogotelehash/e3x"
 	"github.com/telehash/gogotelehash/e3x/cipherset"
-	"github.com/telehash/gogotelehash/internal/hashname"
+	"github.com/telehash/gogotelehash/e3x/keyfile"
+	"github.com/telehash/gogotelehash/internal/util/term"
 )
 
 const usage = `Telehash key generation tool.
 
 Usage:
-  th-keygen [--output=<file>]
+  th-keygen [--output=<file>] [--encrypt] [--passphrase-file=<file>]
+  th-keygen encrypt [--output=<file>] [--passphrase-file=<file>] <keyfile>
+  th-keygen decrypt [--output=<file>] [--passphrase-file=<file>] <keyfile>
+  th-keygen re-encrypt [--output=<file>] [--passphrase-file=<file>] [--new-passphrase-file=<file>] <keyfile>
   th-keygen -h | --help
   th-keygen --version
 
+Commands:
+  encrypt     Encrypt a plain key file with a passphrase.
+  decrypt     Decrypt an encrypted key file.
+  re-encrypt  Change the passphrase of an encrypted key file.
+
 Options:
-  -o --output=<file>  Location to store the keys. [default: -]
-  -h --help           Show this screen.
-  --version           Show version.
+  -o --output=<file>            Location to store the keys. [default: -]
+  -e --encrypt                  Encrypt the generated keys with a passphrase.
+  --passphrase-file=<file>      Read the passphrase from a file instead of the
+                                TH_PASSPHRASE variable or the terminal.
+                                This is the new passphrase for encrypt.
+  --new-passphrase-file=<file>  Read the new passphrase from a file instead of
+                                the TH_NEW_PASSPHRASE variable or the terminal.
+  -h --help                     Show this screen.
+  --version                     Show version.
 `
 
+var stdin = bufio.NewReader(os.Stdin)
+
 func main() {
 	args, _ := docopt.Parse(usage, nil, true, "0.1-dev", false)
 
 	var (
 		output = args["--output"].(string)
-		keys   = cipherset.Keys{}
 		data   []byte
 		err    error
-		out    struct {
-			Hashname hashname.H            `json:"hashname,omitempty"`
-			Parts    cipherset.Parts       `json:"parts,omitempty"`
-			Keys     cipherset.PrivateKeys `json:"keys,omitempty"`
+	)
+
+	switch {
+	case args["encrypt"].(bool):
+		f := load(args["<keyfile>"].(string), nil)
+		data, err = f.Encrypt(newPassphrase(args["--passphrase-file"], "TH_PASSPHRASE"))
+		assert(err)
+
+	case args["decrypt"].(bool):
+		f := load(args["<keyfile>"].(string), passphraseFunc(args["--passphrase-file"]))
+		data, err = f.Encode()
+		assert(err)
+
+	case args["re-encrypt"].(bool):
+		f := load(args["<keyfile>"].(string), passphraseFunc(args["--passphrase-file"]))
+		data, err = f.Encrypt(newPassphrase(args["--new-passphrase-file"], "TH_NEW_PASSPHRASE"))
+		assert(err)
+
+	default:
+		f := generate()
+		fmt.Fprintf(os.Stderr, "Generated keys for: %s\n", f.Hashname)
+
+		if args["--encrypt"].(bool) {
+			data, err = f.Encrypt(newPassphrase(args["--passphrase-file"], "TH_PASSPHRASE"))
+		} else {
+			data, err = f.Encode()
 		}
+		assert(err)
+	}
+
+	if output == "-" {
+		fmt.Println(string(data))
+	} else {
+		err := ioutil.WriteFile(output, data, 0600)
+		assert(err)
+	}
+}
+
+func generate() *keyfile.File {
+	var (
+		keys = cipherset.Keys{}
 	)
 
 	{ // CS 1a
@@ -47,35 +100,103 @@ func main() {
 		keys[0x1a] = k
 	}
 
+	{ // CS 2a
+		k, err := cipherset.GenerateKey(0x2a)
+		assert(err)
+		keys[0x2a] = k
+	}
+
 	{ // CS 3a
 		k, err := cipherset.GenerateKey(0x3a)
 		assert(err)
 		keys[0x3a] = k
 	}
 
-	out.Keys = cipherset.PrivateKeys(keys)
-	out.Parts = hashname.PartsFromKeys(keys)
-	out.Hashname, err = hashname.FromIntermediates(out.Parts)
+	{ // CS 3b
+		k, err := cipherset.GenerateKey(0x3b)
+		assert(err)
+		keys[0x3b] = k
+	}
+
+	f, err := keyfile.New(keys)
+	assert(err)
+	return f
+}
+
+func load(path string, passphrase keyfile.PassphraseFunc) *keyfile.File {
+	data, err := ioutil.ReadFile(path)
 	assert(err)
 
-	if len(out.Keys) == 0 {
-		out.Keys = nil
+	if passphrase == nil && keyfile.IsEncrypted(data) {
+		assert(fmt.Errorf("%s is already encrypted (use re-encrypt)", path))
 	}
-	if len(out.Parts) == 0 {
-		out.Keys = nil
+	if passphrase != nil && !keyfile.IsEncrypted(data) {
+		assert(fmt.Errorf("%s is not encrypted", path))
 	}
 
-	data, err = json.MarshalIndent(out, "", "  ")
+	f, err := keyfile.Decode(data, passphrase)
 	assert(err)
+	return f
+}
 
-	fmt.Fprintf(os.Stderr, "Generated keys for: %s\n", out.Hashname)
+// passphraseFunc returns a function which reads the passphrase of an existing
+// key file.
+func passphraseFunc(file interface{}) keyfile.PassphraseFunc {
+	return func() ([]byte, error) {
+		return readPassphrase(file, "TH_PASSPHRASE", "Passphrase: ")
+	}
+}
 
-	if output == "-" {
-		fmt.Println(string(data))
-	} else {
-		err := ioutil.WriteFile(output, data, 0600)
+// newPassphrase reads a new passphrase. When it is read from the terminal it
+// must be entered twice.
+func newPassphrase(file interface{}, env string) []byte {
+	if file != nil || os.Getenv(env) != "" {
+		pass, err := readPassphrase(file, env, "")
 		assert(err)
+		return pass
+	}
+
+	pass, err := readPassphrase(nil, "", "New passphrase: ")
+	assert(err)
+
+	confirm, err := readPassphrase(nil, "", "Repeat passphrase: ")
+	assert(err)
+
+	if !bytes.Equal(pass, confirm) {
+		assert(fmt.Errorf("passphrases do not match"))
+	}
+
+	return pass
+}
+
+func readPassphrase(file interface{}, env, prompt string) ([]byte, error) {
+	if path, ok := file.(string); ok && path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return nonEmpty(bytes.TrimRight(data, "\r\n"))
+	}
+
+	if env != "" {
+		if pass := os.Getenv(env); pass != "" {
+			return []byte(pass), nil
+		}
+	}
+
+	line, err := term.ReadLine(stdin, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	return nonEmpty(line)
+}
+
+func nonEmpty(pass []byte) ([]byte, error) {
+	if len(pass) == 0 {
+		return nil, keyfile.ErrNoPassphrase
 	}
+	return pass, nil
 }
 
 func assert(err error) {
@@ -0,0 +1,250 @@
+// Package cloak implements packet cloaking for transports.
+//
+// Cloaking XORs each packet with a ChaCha20 keystream derived from a random
+// nonce so that the traffic is not trivially identifiable as telehash. The
+// nonce is prepended to the cloaked packet. A packet may be cloaked multiple
+// times (rounds).
+//
+// Plain packets always start with a zero byte (the high byte of the LOB head
+// length) while the first byte of a nonce is never zero. This allows cloaked
+// and plain peers to coexist: incoming packets are uncloaked until they are
+// plain and replies are cloaked only when the peer cloaks its packets. A
+// dialed connection which gets no response to its cloaked packets (a plain
+// peer drops them) falls back to plain packets.
+//
+//	e3x.New(keys, cloak.Config{Config: udp.Config{}})
+//
+// See https://github.com/telehash/telehash.org/blob/v3/v3/e3x/cloaking.md
+package cloak
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/golang.org/x/crypto/chacha20"
+
+	"github.com/telehash/gogotelehash/transports"
+)
+
+var (
+	_ transports.Config    = Config{}
+	_ transports.Transport = (*transport)(nil)
+)
+
+// ErrInvalidRounds is returned by Open when Rounds is out of range.
+var ErrInvalidRounds = errors.New("cloak: invalid number of rounds")
+
+const (
+	nonceSize = 8
+
+	// MaxRounds is the maximum number of cloaking rounds.
+	MaxRounds = 16
+
+	// a dialed connection falls back to plain packets when the peer did not
+	// respond to maxUnansweredWrites cloaked packets or within
+	// fallbackTimeout of the first one.
+	maxUnansweredWrites = 3
+	fallbackTimeout     = time.Second
+)
+
+// key is the well-known cloaking key.
+var key = []byte{
+	0xd7, 0xf0, 0xe5, 0x55, 0x54, 0x62, 0x41, 0xb2,
+	0xa9, 0x44, 0xec, 0xd6, 0xd0, 0xde, 0x66, 0x85,
+	0x6a, 0xc5, 0x0b, 0x0b, 0xab, 0xa7, 0x6a, 0x6f,
+	0x5a, 0x47, 0x82, 0x95, 0x6c, 0xa9, 0x45, 0x9a,
+}
+
+// Config for the cloak transport.
+type Config struct {
+	// The configuration of the sub-transport.
+	Config transports.Config
+
+	// Rounds is the number of times each outgoing packet is cloaked
+	// (default: 1).
+	Rounds int
+
+	// Passive disables cloaking of packets to peers which did not (yet) send
+	// cloaked packets. By default packets on dialed connections are cloaked
+	// until the peer responds with plain packets or does not respond at all.
+	Passive bool
+}
+
+type transport struct {
+	t       transports.Transport
+	rounds  int
+	passive bool
+}
+
+type connection struct {
+	net.Conn
+	rounds int
+
+	mtx        sync.Mutex
+	cloak      bool      // cloak outgoing packets
+	answered   bool      // the peer sent a packet
+	unanswered int       // number of cloaked packets sent before an answer
+	firstWrite time.Time // time of the first cloaked packet
+}
+
+// Open opens the sub-transport.
+func (c Config) Open() (transports.Transport, error) {
+	if c.Rounds == 0 {
+		c.Rounds = 1
+	}
+	if c.Rounds < 0 || c.Rounds > MaxRounds {
+		return nil, ErrInvalidRounds
+	}
+
+	t, err := c.Config.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	return &transport{t: t, rounds: c.Rounds, passive: c.Passive}, nil
+}
+
+func (t *transport) Addrs() []net.Addr {
+	return t.t.Addrs()
+}
+
+func (t *transport) Dial(addr net.Addr) (net.Conn, error) {
+	conn, err := t.t.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &connection{Conn: conn, rounds: t.rounds, cloak: !t.passive}, nil
+}
+
+func (t *transport) Accept() (c net.Conn, err error) {
+	conn, err := t.t.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &connection{Conn: conn, rounds: t.rounds}, nil
+}
+
+func (t *transport) Close() error {
+	return t.t.Close()
+}
+
+// Read reads the next packet and uncloaks it. Packets which can not be
+// uncloaked are dropped.
+func (c *connection) Read(b []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(b)
+		if err != nil {
+			return 0, err
+		}
+
+		plain, rounds, ok := uncloak(b[:n])
+		if !ok {
+			continue // drop
+		}
+
+		c.mtx.Lock()
+		c.cloak = rounds > 0
+		c.answered = true
+		c.mtx.Unlock()
+
+		return copy(b, plain), nil
+	}
+}
+
+// Write cloaks the packet in b (when the peer expects cloaked packets) and
+// writes it to the sub-transport.
+func (c *connection) Write(b []byte) (int, error) {
+	c.mtx.Lock()
+	if c.cloak && !c.answered {
+		now := time.Now()
+		if c.unanswered == 0 {
+			c.firstWrite = now
+		}
+		if c.unanswered >= maxUnansweredWrites || now.Sub(c.firstWrite) >= fallbackTimeout {
+			// the peer does not understand cloaked packets
+			c.cloak = false
+		}
+		c.unanswered++
+	}
+	cloaked := c.cloak
+	c.mtx.Unlock()
+
+	if !cloaked {
+		return c.Conn.Write(b)
+	}
+
+	p := make([]byte, len(b)+c.rounds*nonceSize)
+	copy(p[c.rounds*nonceSize:], b)
+
+	for i := c.rounds - 1; i >= 0; i-- {
+		err := cloak(p[i*nonceSize:])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err := c.Conn.Write(p)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// cloak cloaks the packet in p[nonceSize:] in place and writes the nonce to
+// p[:nonceSize].
+func cloak(p []byte) error {
+	nonce := p[:nonceSize]
+
+	for {
+		_, err := rand.Read(nonce)
+		if err != nil {
+			return err
+		}
+		if nonce[0] != 0 {
+			break
+		}
+	}
+
+	return xorKeyStream(p[nonceSize:], nonce)
+}
+
+// uncloak removes all cloaking rounds from p (in place). It returns the plain
+// packet and the number of removed rounds.
+func uncloak(p []byte) (plain []byte, rounds int, ok bool) {
+	for len(p) > 0 && p[0] != 0 {
+		if len(p) <= nonceSize || rounds == MaxRounds {
+			return nil, 0, false
+		}
+
+		nonce, data := p[:nonceSize], p[nonceSize:]
+		if xorKeyStream(data, nonce) != nil {
+			return nil, 0, false
+		}
+
+		p = data
+		rounds++
+	}
+
+	return p, rounds, len(p) > 0
+}
+
+// xorKeyStream XORs p with the keystream for nonce. The 8 byte nonce of the
+// original ChaCha20 is equivalent to the 12 byte nonce of RFC 7539 prefixed
+// with four zero bytes.
+func xorKeyStream(p, nonce []byte) error {
+	var n [chacha20.NonceSize]byte
+	copy(n[chacha20.NonceSize-nonceSize:], nonce)
+
+	s, err := chacha20.NewUnauthenticatedCipher(key, n[:])
+	if err != nil {
+		return err
+	}
+
+	s.XORKeyStream(p, p)
+	return nil
+}
@@ -0,0 +1,202 @@
+package cloak
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+
+	"github.com/telehash/gogotelehash/e3x"
+	"github.com/telehash/gogotelehash/transports"
+	"github.com/telehash/gogotelehash/transports/inproc"
+)
+
+func TestCloak(t *testing.T) {
+	assert := assert.New(t)
+
+	var msg = []byte{0, 2, 'h', 'i', 'b', 'o', 'd', 'y'}
+
+	for rounds := 1; rounds <= MaxRounds; rounds++ {
+		p := make([]byte, len(msg)+rounds*nonceSize)
+		copy(p[rounds*nonceSize:], msg)
+		for i := rounds - 1; i >= 0; i-- {
+			assert.NoError(cloak(p[i*nonceSize:]))
+		}
+		assert.NotEqual(byte(0), p[0])
+
+		plain, n, ok := uncloak(p)
+		assert.True(ok)
+		assert.Equal(rounds, n)
+		assert.Equal(msg, plain)
+	}
+
+	plain, n, ok := uncloak(append([]byte(nil), msg...))
+	assert.True(ok)
+	assert.Equal(0, n)
+	assert.Equal(msg, plain)
+
+	_, _, ok = uncloak([]byte{1, 2, 3})
+	assert.False(ok)
+}
+
+func TestTransport(t *testing.T) {
+	assert := assert.New(t)
+
+	var tab = []struct {
+		a, b   transports.Config
+		rawB   bool // B is plain and receives cloaked packets
+		cloakA bool // A cloaks after the response of B
+	}{
+		{Config{Config: inproc.Config{}}, Config{Config: inproc.Config{}}, false, true},
+		{Config{Config: inproc.Config{}, Rounds: 3}, Config{Config: inproc.Config{}}, false, true},
+		{Config{Config: inproc.Config{}, Passive: true}, Config{Config: inproc.Config{}}, false, false},
+		{Config{Config: inproc.Config{}}, inproc.Config{}, true, false},
+	}
+
+	for i, e := range tab {
+		A, err := e.a.Open()
+		if !assert.NoError(err) {
+			continue
+		}
+		B, err := e.b.Open()
+		if !assert.NoError(err) {
+			A.Close()
+			continue
+		}
+
+		var out [1500]byte
+
+		w, err := A.Dial(B.Addrs()[0])
+		if assert.NoError(err) {
+			_, err = w.Write([]byte("\x00\x00ping"))
+			assert.NoError(err)
+
+			r, err := B.Accept()
+			if assert.NoError(err) {
+				n, err := r.Read(out[:])
+				if assert.NoError(err) {
+					if e.rawB {
+						assert.NotEqual(byte(0), out[0], "tab=%d", i)
+					} else {
+						assert.Equal("\x00\x00ping", string(out[:n]), "tab=%d", i)
+					}
+				}
+
+				_, err = r.Write([]byte("\x00\x00pong"))
+				assert.NoError(err)
+
+				n, err = w.Read(out[:])
+				if assert.NoError(err) {
+					assert.Equal("\x00\x00pong", string(out[:n]), "tab=%d", i)
+				}
+
+				assert.Equal(e.cloakA, w.(*connection).cloak, "tab=%d", i)
+			}
+		}
+
+		A.Close()
+		B.Close()
+	}
+
+	_, err := Config{Config: inproc.Config{}, Rounds: MaxRounds + 1}.Open()
+	assert.Equal(ErrInvalidRounds, err)
+}
+
+func TestFallback(t *testing.T) {
+	assert := assert.New(t)
+
+	A, err := Config{Config: inproc.Config{}}.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := inproc.Config{}.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	w, err := A.Dial(B.Addrs()[0])
+	if !assert.NoError(err) {
+		return
+	}
+
+	var (
+		r   net.Conn
+		out [1500]byte
+	)
+
+	// the plain peer never answers cloaked packets
+	for i := 0; i <= maxUnansweredWrites; i++ {
+		_, err = w.Write([]byte("\x00\x00ping"))
+		assert.NoError(err)
+		if i == 0 {
+			r, err = B.Accept()
+			if !assert.NoError(err) {
+				return
+			}
+		}
+
+		n, err := r.Read(out[:])
+		if !assert.NoError(err) {
+			return
+		}
+
+		if i < maxUnansweredWrites {
+			assert.NotEqual(byte(0), out[0], "write=%d", i)
+		} else {
+			assert.Equal("\x00\x00ping", string(out[:n]), "write=%d", i)
+		}
+	}
+}
+
+func TestPlainEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	A, err := e3x.Open(e3x.Transport(Config{Config: inproc.Config{}}), e3x.Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.Close()
+
+	B, err := e3x.Open(e3x.Transport(inproc.Config{}), e3x.Log(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.Close()
+
+	identA, err := A.LocalIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identB, err := B.LocalIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	// a cloaking endpoint reaches a plain endpoint and the other way around
+	_, err = A.DialContext(ctx, identB)
+	assert.NoError(err)
+
+	_, err = B.DialContext(ctx, identA)
+	assert.NoError(err)
+}
+
+func TestEquivalentNonce(t *testing.T) {
+	assert := assert.New(t)
+
+	// the keystream for a nonce must not depend on the data
+	a := bytes.Repeat([]byte{0}, 128)
+	b := bytes.Repeat([]byte{0}, 64)
+	nonce := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.NoError(xorKeyStream(a, nonce))
+	assert.NoError(xorKeyStream(b, nonce))
+	assert.Equal(a[:64], b)
+}
@@ -4,6 +4,7 @@ package inproc
 import (
 	"encoding/json"
 	"io"
+	"math/rand"
 	"net"
 	"strconv"
 	"sync"
@@ -26,10 +27,13 @@ func init() {
 	})
 }
 
-// Config for the inproc transport. There are no configuration options for now.
+// Config for the inproc transport.
 //
 //   e3x.New(keys, inproc.Config{})
 type Config struct {
+	// Loss is the fraction (0 to 1) of the written packets which are dropped
+	// at random. It simulates lossy links in tests and benchmarks.
+	Loss float64
 }
 
 type inprocAddr struct {
@@ -39,6 +43,7 @@ type inprocAddr struct {
 type transport struct {
 	laddr *inprocAddr
 	c     chan packet
+	loss  float64
 }
 
 type packet struct {
@@ -62,7 +67,7 @@ var (
 func (c Config) Open() (transports.Transport, error) {
 	mtx.Lock()
 	id := netxID
-	t := &transport{&inprocAddr{id}, make(chan packet, 10)}
+	t := &transport{&inprocAddr{id}, make(chan packet, 10), c.Loss}
 	netxID++
 	pipes[id] = t
 	mtx.Unlock()
@@ -104,6 +109,10 @@ func (t *transport) Write(p []byte, dst dgram.Addr) (int, error) {
 		return 0, nil // drop
 	}
 
+	if t.loss > 0 && rand.Float64() < t.loss {
+		return len(p), nil // drop (simulated loss)
+	}
+
 	buf := bufpool.New().Set(p)
 
 	func() {
@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/telehash/gogotelehash/internal/chunking"
 	"github.com/telehash/gogotelehash/transports"
 	"github.com/telehash/gogotelehash/transports/transportsutil"
 )
@@ -27,6 +28,15 @@ type Config struct {
 	// When port is unspecified ("127.0.0.1") a random port will be chosen.
 	// When ip is unspecified (":3000") the transport will listen on all interfaces.
 	Addr string
+
+	// ChunkSize enables the chunking encoding (as used by the C implementation)
+	// when it is non-zero. Packets are split in chunks of at most ChunkSize
+	// bytes (1-255). Both ends of a connection must use the same encoding.
+	ChunkSize int
+
+	// ChunkAcks makes the transport ack every received packet.
+	// ChunkAcks is ignored unless ChunkSize is set.
+	ChunkAcks bool
 }
 
 const (
@@ -37,9 +47,11 @@ const (
 )
 
 type transport struct {
-	net      string
-	laddr    tcpAddr
-	listener *net.TCPListener
+	net       string
+	laddr     tcpAddr
+	listener  *net.TCPListener
+	chunkSize int
+	chunkAcks bool
 }
 
 type connection struct {
@@ -47,6 +59,8 @@ type connection struct {
 	raddr     tcpAddr
 	conn      *net.TCPConn
 	bufr      *bufio.Reader
+	enc       *chunking.Encoder // nil unless chunking is enabled
+	dec       *chunking.Decoder // nil unless chunking is enabled
 	mtxWrite  sync.Mutex
 	mtxRead   sync.Mutex
 }
@@ -74,6 +88,10 @@ func (c Config) Open() (transports.Transport, error) {
 		return nil, errors.New("tcp: Network must be either `tcp4` or `tcp6`")
 	}
 
+	if c.ChunkSize < 0 || c.ChunkSize > chunking.MaxChunkSize {
+		return nil, chunking.ErrInvalidChunkSize
+	}
+
 	{ // parse and verify source address
 		addr, err = net.ResolveTCPAddr(c.Network, c.Addr)
 		if err != nil {
@@ -96,7 +114,13 @@ func (c Config) Open() (transports.Transport, error) {
 
 	addr = listener.Addr().(*net.TCPAddr)
 
-	return &transport{net: c.Network, laddr: wrapAddr(addr), listener: listener}, nil
+	return &transport{
+		net:       c.Network,
+		laddr:     wrapAddr(addr),
+		listener:  listener,
+		chunkSize: c.ChunkSize,
+		chunkAcks: c.ChunkAcks,
+	}, nil
 }
 
 func (t *transport) Addrs() []net.Addr {
@@ -140,7 +164,7 @@ func (t *transport) Dial(addr net.Addr) (net.Conn, error) {
 			return nil, err
 		}
 
-		return &connection{transport: t, raddr: x, conn: conn, bufr: bufio.NewReader(conn)}, nil
+		return t.newConnection(x, conn), nil
 	case *net.TCPAddr:
 		return t.Dial(wrapAddr(x))
 	default:
@@ -156,10 +180,19 @@ func (t *transport) Accept() (c net.Conn, err error) {
 
 	raddr := tconn.RemoteAddr().(*net.TCPAddr)
 
-	conn := &connection{transport: t, raddr: wrapAddr(raddr), conn: tconn, bufr: bufio.NewReader(tconn)}
+	conn := t.newConnection(wrapAddr(raddr), tconn)
 	return conn, nil
 }
 
+func (t *transport) newConnection(raddr tcpAddr, conn *net.TCPConn) *connection {
+	c := &connection{transport: t, raddr: raddr, conn: conn, bufr: bufio.NewReader(conn)}
+	if t.chunkSize > 0 {
+		c.enc, _ = chunking.NewEncoder(conn, t.chunkSize)
+		c.dec = chunking.NewDecoder(c.bufr)
+	}
+	return c
+}
+
 func (t *transport) Close() error {
 	return t.listener.Close()
 }
@@ -170,6 +203,10 @@ func (c *connection) Read(b []byte) (n int, err error) {
 	c.mtxRead.Lock()
 	defer c.mtxRead.Unlock()
 
+	if c.dec != nil {
+		return c.readChunked(b)
+	}
+
 	_, err = io.ReadFull(c.bufr, hdr[:])
 	if err != nil {
 		return 0, err
@@ -193,6 +230,14 @@ func (c *connection) Write(b []byte) (n int, err error) {
 	c.mtxWrite.Lock()
 	defer c.mtxWrite.Unlock()
 
+	if c.enc != nil {
+		err = c.enc.Encode(b)
+		if err != nil {
+			return 0, err
+		}
+		return lenB, nil
+	}
+
 	for len(hdrP) > 0 {
 		n, err := c.conn.Write(hdrP)
 		if err != nil {
@@ -212,6 +257,30 @@ func (c *connection) Write(b []byte) (n int, err error) {
 	return lenB, nil
 }
 
+func (c *connection) readChunked(b []byte) (n int, err error) {
+	for {
+		n, err = c.dec.Decode(b)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			// the peer acked a packet
+			continue
+		}
+
+		if c.transport.chunkAcks {
+			c.mtxWrite.Lock()
+			err = c.enc.Ack()
+			c.mtxWrite.Unlock()
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		return n, nil
+	}
+}
+
 func (c *connection) SetDeadline(t time.Time) error {
 	return c.conn.SetDeadline(t)
 }
@@ -14,6 +14,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/telehash/gogotelehash/internal/chunking"
 	"github.com/telehash/gogotelehash/transports"
 )
 
@@ -40,13 +41,24 @@ type Config struct {
 	// Mode is the mode for the socket.
 	// Deault to srwx------ (user only)
 	Mode os.FileMode
+
+	// ChunkSize enables the chunking encoding (as used by the C implementation)
+	// when it is non-zero. Packets are split in chunks of at most ChunkSize
+	// bytes (1-255). Both ends of a connection must use the same encoding.
+	ChunkSize int
+
+	// ChunkAcks makes the transport ack every received packet.
+	// ChunkAcks is ignored unless ChunkSize is set.
+	ChunkAcks bool
 }
 
 type unixAddr net.UnixAddr
 
 type transport struct {
-	laddr    *unixAddr
-	listener *net.UnixListener
+	laddr     *unixAddr
+	listener  *net.UnixListener
+	chunkSize int
+	chunkAcks bool
 }
 
 type connection struct {
@@ -54,6 +66,8 @@ type connection struct {
 	raddr     *unixAddr
 	conn      *net.UnixConn
 	bufr      *bufio.Reader
+	enc       *chunking.Encoder // nil unless chunking is enabled
+	dec       *chunking.Decoder // nil unless chunking is enabled
 	mtxWrite  sync.Mutex
 	mtxRead   sync.Mutex
 }
@@ -73,6 +87,10 @@ func (c Config) Open() (transports.Transport, error) {
 	if c.Mode == 0 {
 		c.Mode = 0700
 	}
+
+	if c.ChunkSize < 0 || c.ChunkSize > chunking.MaxChunkSize {
+		return nil, chunking.ErrInvalidChunkSize
+	}
 	c.Mode &= os.ModePerm
 	c.Mode |= os.ModeSocket
 
@@ -93,7 +111,12 @@ func (c Config) Open() (transports.Transport, error) {
 		return nil, err
 	}
 
-	return &transport{(*unixAddr)(laddr), listener}, nil
+	return &transport{
+		laddr:     (*unixAddr)(laddr),
+		listener:  listener,
+		chunkSize: c.ChunkSize,
+		chunkAcks: c.ChunkAcks,
+	}, nil
 }
 
 // func (t *transport) ReadMessage(p []byte) (int, net.Addr, error) {
@@ -138,7 +161,7 @@ func (t *transport) Dial(addr net.Addr) (net.Conn, error) {
 			return nil, err
 		}
 
-		return &connection{transport: t, raddr: x, conn: conn, bufr: bufio.NewReader(conn)}, nil
+		return t.newConnection(x, conn), nil
 	case *net.UnixAddr:
 		return t.Dial((*unixAddr)(x))
 	default:
@@ -154,10 +177,19 @@ func (t *transport) Accept() (c net.Conn, err error) {
 
 	raddr := uconn.RemoteAddr().(*net.UnixAddr)
 
-	conn := &connection{transport: t, raddr: (*unixAddr)(raddr), conn: uconn, bufr: bufio.NewReader(uconn)}
+	conn := t.newConnection((*unixAddr)(raddr), uconn)
 	return conn, nil
 }
 
+func (t *transport) newConnection(raddr *unixAddr, conn *net.UnixConn) *connection {
+	c := &connection{transport: t, raddr: raddr, conn: conn, bufr: bufio.NewReader(conn)}
+	if t.chunkSize > 0 {
+		c.enc, _ = chunking.NewEncoder(conn, t.chunkSize)
+		c.dec = chunking.NewDecoder(c.bufr)
+	}
+	return c
+}
+
 func (t *transport) Close() error {
 	err := t.listener.Close()
 
@@ -174,6 +206,10 @@ func (c *connection) Read(b []byte) (n int, err error) {
 	c.mtxRead.Lock()
 	defer c.mtxRead.Unlock()
 
+	if c.dec != nil {
+		return c.readChunked(b)
+	}
+
 	_, err = io.ReadFull(c.bufr, hdr[:])
 	if err != nil {
 		return 0, err
@@ -197,6 +233,14 @@ func (c *connection) Write(b []byte) (n int, err error) {
 	c.mtxWrite.Lock()
 	defer c.mtxWrite.Unlock()
 
+	if c.enc != nil {
+		err = c.enc.Encode(b)
+		if err != nil {
+			return 0, err
+		}
+		return lenB, nil
+	}
+
 	for len(hdrP) > 0 {
 		n, err := c.conn.Write(hdrP)
 		if err != nil {
@@ -216,6 +260,30 @@ func (c *connection) Write(b []byte) (n int, err error) {
 	return lenB, nil
 }
 
+func (c *connection) readChunked(b []byte) (n int, err error) {
+	for {
+		n, err = c.dec.Decode(b)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			// the peer acked a packet
+			continue
+		}
+
+		if c.transport.chunkAcks {
+			c.mtxWrite.Lock()
+			err = c.enc.Ack()
+			c.mtxWrite.Unlock()
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		return n, nil
+	}
+}
+
 func (c *connection) SetDeadline(t time.Time) error {
 	return c.conn.SetDeadline(t)
 }
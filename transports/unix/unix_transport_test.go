@@ -30,6 +30,59 @@ func TestLocalAddresses(t *testing.T) {
 	}
 }
 
+func TestChunking(t *testing.T) {
+	assert := assert.New(t)
+
+	A, err := Config{ChunkSize: 100, ChunkAcks: true}.Open()
+	if !assert.NoError(err) {
+		return
+	}
+	defer A.Close()
+
+	B, err := Config{ChunkSize: 100, ChunkAcks: true}.Open()
+	if !assert.NoError(err) {
+		return
+	}
+	defer B.Close()
+
+	var (
+		msg = bytes.Repeat([]byte{'x'}, 1450)
+		out [1500]byte
+	)
+
+	w, err := A.Dial(B.Addrs()[0])
+	if !assert.NoError(err) {
+		return
+	}
+	defer w.Close()
+
+	_, err = w.Write(msg)
+	assert.NoError(err)
+
+	r, err := B.Accept()
+	if !assert.NoError(err) {
+		return
+	}
+	defer r.Close()
+
+	n, err := r.Read(out[:])
+	if assert.NoError(err) {
+		assert.Equal(msg, out[:n])
+	}
+
+	_, err = r.Write([]byte("pong"))
+	assert.NoError(err)
+
+	// the ack of the first packet is skipped
+	n, err = w.Read(out[:])
+	if assert.NoError(err) {
+		assert.Equal("pong", string(out[:n]))
+	}
+
+	_, err = Config{ChunkSize: 256}.Open()
+	assert.Error(err)
+}
+
 func Benchmark(b *testing.B) {
 	A, err := Config{}.Open()
 	if err != nil {
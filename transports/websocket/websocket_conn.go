@@ -0,0 +1,95 @@
+package websocket
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/github.com/gorilla/websocket"
+)
+
+const (
+	maxMessageSize = 1 << 16
+
+	handshakeTimeout = 30 * time.Second
+	closeTimeout     = time.Second
+)
+
+// conn is a net.Conn which reads and writes every packet as one binary
+// WebSocket message. Text messages are dropped.
+type conn struct {
+	ws    *websocket.Conn
+	laddr net.Addr
+	raddr net.Addr
+
+	mtxRead  sync.Mutex
+	mtxWrite sync.Mutex
+}
+
+func newConn(ws *websocket.Conn, laddr, raddr net.Addr) *conn {
+	ws.SetReadLimit(maxMessageSize)
+	return &conn{ws: ws, laddr: laddr, raddr: raddr}
+}
+
+// Read reads the next binary message into b.
+func (c *conn) Read(b []byte) (int, error) {
+	c.mtxRead.Lock()
+	defer c.mtxRead.Unlock()
+
+	for {
+		typ, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if typ != websocket.BinaryMessage {
+			continue // drop text messages
+		}
+		if len(msg) > len(b) {
+			return 0, io.ErrShortBuffer
+		}
+		return copy(b, msg), nil
+	}
+}
+
+// Write writes b as one binary message.
+func (c *conn) Write(b []byte) (int, error) {
+	c.mtxWrite.Lock()
+	defer c.mtxWrite.Unlock()
+
+	err := c.ws.WriteMessage(websocket.BinaryMessage, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *conn) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout))
+	return c.ws.Close()
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	err := c.ws.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
@@ -0,0 +1,388 @@
+// Package websocket implements the WebSocket transport.
+//
+// The transport lets browsers and clients behind restrictive firewalls reach
+// an endpoint over HTTP(S). Each packet is sent as one binary WebSocket
+// message.
+//
+// The server side is either a standalone HTTP listener:
+//
+//	e3x.New(keys, websocket.Config{Addr: ":8080"})
+//
+// or a Handler mounted on an existing HTTP server:
+//
+//	h := websocket.NewHandler()
+//	http.Handle("/telehash", h)
+//	e3x.New(keys, websocket.Config{Handler: h, URL: "wss://example.com/telehash"})
+//
+// The zero Config only dials out.
+//
+// The WebSocket protocol is implemented by github.com/gorilla/websocket.
+package websocket
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/github.com/gorilla/websocket"
+
+	"github.com/telehash/gogotelehash/transports"
+	"github.com/telehash/gogotelehash/transports/transportsutil"
+)
+
+func init() {
+	transports.RegisterAddr(&wsAddr{})
+
+	transports.RegisterResolver("websocket", func(str string) (net.Addr, error) {
+		return parseAddr(str)
+	})
+}
+
+// ErrHandlerInUse is returned by Open when the Handler is already used by
+// another transport.
+var ErrHandlerInUse = errors.New("websocket: handler is already in use")
+
+// DefaultPath is the HTTP path of the standalone listener.
+const DefaultPath = "/telehash"
+
+// Config for the WebSocket transport.
+type Config struct {
+	// Addr is the address of the standalone HTTP listener (for example
+	// ":8080"). No listener is started when Addr is empty.
+	Addr string
+
+	// Path is the HTTP path of the standalone listener.
+	// Defaults to DefaultPath.
+	Path string
+
+	// Handler accepts connections through an existing HTTP server.
+	Handler *Handler
+
+	// URL is the public URL of the endpoint (for example
+	// "wss://example.com/telehash"). It is required to advertise the address
+	// of a Handler and overrides the addresses of the standalone listener.
+	URL string
+
+	// TLSConfig is used to dial "wss" URLs.
+	TLSConfig *tls.Config
+}
+
+// Handler is an http.Handler which accepts WebSocket connections for a
+// transport.
+type Handler struct {
+	// CheckOrigin returns true when a request from a browser with the given
+	// origin is allowed. All origins are allowed when CheckOrigin is nil.
+	CheckOrigin func(r *http.Request) bool
+
+	mtx sync.RWMutex
+	t   *transport
+}
+
+type wsAddr struct {
+	url string
+}
+
+// clientAddr is the address of an accepted connection. It can not be dialed.
+type clientAddr string
+
+type transport struct {
+	handler   *Handler
+	listener  net.Listener
+	server    *http.Server
+	url       string
+	path      string
+	tlsConfig *tls.Config
+
+	cAccept   chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var (
+	_ net.Addr                 = (*wsAddr)(nil)
+	_ transports.AddrMarshaler = (*wsAddr)(nil)
+	_ net.Addr                 = clientAddr("")
+	_ transports.Transport     = (*transport)(nil)
+	_ transports.Config        = Config{}
+	_ http.Handler             = (*Handler)(nil)
+)
+
+// NewHandler returns a new Handler. It must be passed to exactly one Config.
+func NewHandler() *Handler {
+	return &Handler{}
+}
+
+// Open opens the transport.
+func (c Config) Open() (transports.Transport, error) {
+	if c.Path == "" {
+		c.Path = DefaultPath
+	}
+
+	if c.URL != "" {
+		if _, err := parseAddr(c.URL); err != nil {
+			return nil, err
+		}
+	}
+
+	t := &transport{
+		handler:   c.Handler,
+		url:       c.URL,
+		path:      c.Path,
+		tlsConfig: c.TLSConfig,
+		cAccept:   make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+
+	if t.handler != nil {
+		err := t.handler.attach(t)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Addr != "" {
+		listener, err := net.Listen("tcp", c.Addr)
+		if err != nil {
+			t.detach()
+			return nil, err
+		}
+
+		h := &Handler{t: t}
+		if t.handler != nil {
+			h.CheckOrigin = t.handler.CheckOrigin
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle(c.Path, h)
+
+		t.listener = listener
+		t.server = &http.Server{Handler: mux}
+		go t.server.Serve(listener)
+	}
+
+	return t, nil
+}
+
+func (t *transport) detach() {
+	if t.handler != nil {
+		t.handler.mtx.Lock()
+		if t.handler.t == t {
+			t.handler.t = nil
+		}
+		t.handler.mtx.Unlock()
+	}
+}
+
+func (t *transport) Addrs() []net.Addr {
+	if t.url != "" {
+		addr, _ := parseAddr(t.url)
+		return []net.Addr{addr}
+	}
+
+	if t.listener == nil {
+		return nil
+	}
+
+	var (
+		laddr = t.listener.Addr().(*net.TCPAddr)
+		port  = strconv.Itoa(laddr.Port)
+		addrs []net.Addr
+	)
+
+	if !laddr.IP.IsUnspecified() {
+		return []net.Addr{&wsAddr{"ws://" + net.JoinHostPort(laddr.IP.String(), port) + t.path}}
+	}
+
+	ips, err := transportsutil.InterfaceIPs()
+	if err != nil {
+		return nil
+	}
+
+	for _, ip := range ips {
+		if ip.IP.To4() == nil && laddr.IP.To4() != nil {
+			continue
+		}
+		host := ip.IP.String()
+		if ip.Zone != "" {
+			host += "%25" + ip.Zone
+		}
+		addrs = append(addrs, &wsAddr{"ws://" + net.JoinHostPort(host, port) + t.path})
+	}
+
+	return addrs
+}
+
+func (t *transport) Dial(addr net.Addr) (net.Conn, error) {
+	x, ok := addr.(*wsAddr)
+	if !ok {
+		return nil, transports.ErrInvalidAddr
+	}
+
+	select {
+	case <-t.done:
+		return nil, io.EOF
+	default:
+	}
+
+	dialer := websocket.Dialer{
+		TLSClientConfig:  t.tlsConfig,
+		HandshakeTimeout: handshakeTimeout,
+	}
+
+	ws, resp, err := dialer.Dial(x.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return newConn(ws, clientAddr(ws.LocalAddr().String()), x), nil
+}
+
+func (t *transport) Accept() (net.Conn, error) {
+	select {
+	case c := <-t.cAccept:
+		return c, nil
+	case <-t.done:
+		return nil, io.EOF
+	}
+}
+
+func (t *transport) Close() error {
+	var err error
+
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.detach()
+
+		if t.server != nil {
+			err = t.server.Close()
+		}
+	})
+
+	return err
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection and passes it to
+// the transport.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mtx.RLock()
+	t := h.t
+	h.mtx.RUnlock()
+
+	if t == nil {
+		http.Error(w, "websocket: transport is not open", http.StatusServiceUnavailable)
+		return
+	}
+
+	if h.CheckOrigin != nil && req.Header.Get("Origin") != "" && !h.CheckOrigin(req) {
+		http.Error(w, "websocket: origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	if !websocket.IsWebSocketUpgrade(req) {
+		http.Error(w, "websocket: upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+
+	// the origin was checked above
+	upgrader := websocket.Upgrader{
+		HandshakeTimeout: handshakeTimeout,
+		CheckOrigin:      func(*http.Request) bool { return true },
+	}
+
+	ws, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+
+	var laddr net.Addr = clientAddr(ws.LocalAddr().String())
+	if t.url != "" {
+		laddr, _ = parseAddr(t.url)
+	}
+
+	wc := newConn(ws, laddr, clientAddr(ws.RemoteAddr().String()))
+
+	select {
+	case t.cAccept <- wc:
+	case <-t.done:
+		wc.Close()
+	}
+}
+
+func (h *Handler) attach(t *transport) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.t != nil {
+		return ErrHandlerInUse
+	}
+
+	h.t = t
+	return nil
+}
+
+func parseAddr(str string) (*wsAddr, error) {
+	u, err := url.Parse(str)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		return nil, transports.ErrInvalidAddr
+	}
+
+	return &wsAddr{u.String()}, nil
+}
+
+func (a *wsAddr) Network() string {
+	return "websocket"
+}
+
+func (a *wsAddr) String() string {
+	return a.url
+}
+
+func (a *wsAddr) MarshalJSON() ([]byte, error) {
+	var desc = struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	}{
+		Type: a.Network(),
+		URL:  a.url,
+	}
+	return json.Marshal(&desc)
+}
+
+func (a *wsAddr) UnmarshalJSON(p []byte) error {
+	var desc struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	}
+	err := json.Unmarshal(p, &desc)
+	if err != nil {
+		return err
+	}
+
+	addr, err := parseAddr(desc.URL)
+	if err != nil {
+		return err
+	}
+
+	*a = *addr
+	return nil
+}
+
+func (a *wsAddr) Equal(x net.Addr) bool {
+	b, ok := x.(*wsAddr)
+	return ok && b.url == a.url
+}
+
+func (a clientAddr) Network() string {
+	return "websocket"
+}
+
+func (a clientAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,219 @@
+package websocket
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/telehash/gogotelehash/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+
+	"github.com/telehash/gogotelehash/e3x"
+	"github.com/telehash/gogotelehash/internal/lob"
+	"github.com/telehash/gogotelehash/transports"
+)
+
+func TestAddr(t *testing.T) {
+	assert := assert.New(t)
+
+	addr, err := transports.ResolveAddr("websocket", "wss://example.com/telehash")
+	if assert.NoError(err) {
+		assert.Equal("websocket", addr.Network())
+		assert.Equal("wss://example.com/telehash", addr.String())
+
+		data, err := transports.EncodeAddr(addr)
+		if assert.NoError(err) {
+			assert.Equal(`{"type":"websocket","url":"wss://example.com/telehash"}`, string(data))
+
+			addr2, err := transports.DecodeAddr(data)
+			if assert.NoError(err) {
+				assert.True(transports.EqualAddr(addr, addr2))
+			}
+		}
+	}
+
+	for _, str := range []string{"http://example.com/", "ws://", "example.com"} {
+		_, err = transports.ResolveAddr("websocket", str)
+		assert.Equal(transports.ErrInvalidAddr, err, str)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	h := NewHandler()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	B, err := Config{Handler: h, URL: "ws" + strings.TrimPrefix(srv.URL, "http") + "/"}.Open()
+	if !assert.NoError(err) {
+		return
+	}
+	defer B.Close()
+
+	_, err = Config{Handler: h}.Open()
+	assert.Equal(ErrHandlerInUse, err)
+
+	A, err := Config{}.Open()
+	if !assert.NoError(err) {
+		return
+	}
+	defer A.Close()
+
+	assert.Empty(A.Addrs())
+	if assert.Len(B.Addrs(), 1) {
+		exchangeMessages(t, A, B)
+	}
+
+	// plain HTTP requests are refused
+	resp, err := http.Get(srv.URL)
+	if assert.NoError(err) {
+		assert.Equal(http.StatusUpgradeRequired, resp.StatusCode)
+		resp.Body.Close()
+	}
+}
+
+func TestListener(t *testing.T) {
+	assert := assert.New(t)
+
+	B, err := Config{Addr: "127.0.0.1:0"}.Open()
+	if !assert.NoError(err) {
+		return
+	}
+	defer B.Close()
+
+	A, err := Config{}.Open()
+	if !assert.NoError(err) {
+		return
+	}
+	defer A.Close()
+
+	if assert.Len(B.Addrs(), 1) {
+		assert.True(strings.HasSuffix(B.Addrs()[0].String(), DefaultPath))
+		exchangeMessages(t, A, B)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	assert := assert.New(t)
+
+	h := NewHandler()
+	h.CheckOrigin = func(r *http.Request) bool { return false }
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	B, err := Config{Handler: h}.Open()
+	if !assert.NoError(err) {
+		return
+	}
+	defer B.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Origin", "http://example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(err) {
+		assert.Equal(http.StatusForbidden, resp.StatusCode)
+		resp.Body.Close()
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	h := NewHandler()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	A, err := e3x.Open(e3x.Transport(Config{Handler: h, URL: "ws" + strings.TrimPrefix(srv.URL, "http") + "/"}), e3x.Log(nil))
+	if !assert.NoError(err) {
+		return
+	}
+	defer A.Close()
+
+	B, err := e3x.Open(e3x.Transport(Config{}), e3x.Log(nil))
+	if !assert.NoError(err) {
+		return
+	}
+	defer B.Close()
+
+	l := A.Listen("ping", true)
+	defer l.Close()
+
+	go func() {
+		c, err := l.AcceptChannel()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		pkt, err := c.ReadPacket()
+		if err != nil {
+			return
+		}
+		c.WritePacket(lob.New(pkt.Body(nil)))
+	}()
+
+	ident, err := A.LocalIdentity()
+	if !assert.NoError(err) {
+		return
+	}
+
+	c, err := B.Open(ident, "ping", true)
+	if !assert.NoError(err) {
+		return
+	}
+	defer c.Close()
+
+	assert.NoError(c.WritePacket(lob.New([]byte("ping"))))
+
+	pkt, err := c.ReadPacket()
+	if assert.NoError(err) {
+		assert.Equal([]byte("ping"), pkt.Body(nil))
+	}
+}
+
+func exchangeMessages(t *testing.T, A, B transports.Transport) {
+	assert := assert.New(t)
+
+	var (
+		small = []byte("ping")
+		large = bytes.Repeat([]byte{'x'}, 1450)
+		out   [1500]byte
+	)
+
+	w, err := A.Dial(B.Addrs()[0])
+	if !assert.NoError(err) {
+		return
+	}
+	defer w.Close()
+
+	r, err := B.Accept()
+	if !assert.NoError(err) {
+		return
+	}
+	defer r.Close()
+
+	for _, msg := range [][]byte{small, large} {
+		_, err = w.Write(msg)
+		assert.NoError(err)
+
+		n, err := r.Read(out[:])
+		if assert.NoError(err) {
+			assert.Equal(msg, out[:n])
+		}
+
+		_, err = r.Write(msg)
+		assert.NoError(err)
+
+		n, err = w.Read(out[:])
+		if assert.NoError(err) {
+			assert.Equal(msg, out[:n])
+		}
+	}
+
+	// a closed connection ends the peer
+	w.Close()
+	_, err = r.Read(out[:])
+	assert.Error(err)
+}